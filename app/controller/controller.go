@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+
+	"github.com/fast-ml/nezha/pkg/controller"
+)
+
+const (
+	defaultConfigmapName      = "hostaliases-config"
+	defaultConfigMapNamespace = "default"
+)
+
+var (
+	kubeConfig         string
+	kubeMaster         string
+	configMapName      string
+	configMapNamespace string
+	workers            int
+	opts               controller.Options
+)
+
+func main() {
+	flag.StringVar(&configMapName, "configmap", defaultConfigmapName, "hostAliases configuration configmap")
+	flag.StringVar(&configMapNamespace, "namespace", defaultConfigMapNamespace, "The configuration namespace")
+	flag.StringVar(&kubeConfig, "kubeconfig", "", "Absolute path to the kubeconfig")
+	flag.StringVar(&kubeMaster, "kubemaster", "", "Kubernetes Controller Master URL")
+	flag.IntVar(&workers, "workers", 2, "Number of pods processed concurrently")
+	flag.BoolVar(&opts.Recreate, "recreate-missed-pods", false, "Delete controller-owned pods that missed their host aliases so they get recreated through the webhook")
+	flag.Float64Var(&opts.RolloutQPS, "rollout-qps", 0.2, "Workloads reconciled per second after a config change")
+	flag.IntVar(&opts.RolloutBurst, "rollout-burst", 5, "Burst of workloads reconciled after a config change")
+	flag.StringVar(&opts.DNSConfigMap, "dns-configmap", "", "namespace/name of the ConfigMap the Corefile of the DNS entries is written to, none when empty")
+	flag.Parse()
+	flag.Set("logtostderr", "true")
+	if len(opts.DNSConfigMap) > 0 && len(strings.Split(opts.DNSConfigMap, "/")) != 2 {
+		glog.Fatalf("-dns-configmap must be namespace/name")
+	}
+
+	clientset := controller.GetClient(kubeMaster, kubeConfig)
+	ctrl := controller.NewHostAliasesController(clientset, configMapNamespace, configMapName, opts)
+
+	glog.Infof("Starting controller")
+	stop := make(chan struct{})
+	go ctrl.Run(workers, stop)
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	<-signalChan
+
+	close(stop)
+}
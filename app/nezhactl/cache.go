@@ -0,0 +1,343 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fast-ml/nezha/pkg/apis/nezha/v1alpha1"
+	"github.com/fast-ml/nezha/pkg/proxy"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// cacheCommands warm the caches through the DatasetPrefetch API, and
+// manage the objects of a Nezha proxy through its admin API.
+var cacheCommands = map[string]command{
+	"list":     {"list the objects of a proxy", runCacheList},
+	"pin":      {"keep the objects of a dataset from being evicted", runCachePin},
+	"prefetch": {"warm a cache with URLs or bucket prefixes", runCachePrefetch},
+	"purge":    {"delete objects from a proxy", runCachePurge},
+	"stats":    {"show the statistics of a proxy by route", runCacheStats},
+	"status":   {"show the progress of the prefetches", runCacheStatus},
+	"unpin":    {"let the objects of a dataset be evicted again", runCacheUnpin},
+}
+
+func runCache(args []string) error {
+	if len(args) == 0 {
+		cacheUsage()
+		os.Exit(2)
+	}
+	cmd, ok := cacheCommands[args[0]]
+	if !ok {
+		cacheUsage()
+		os.Exit(2)
+	}
+	return cmd.run(args[1:])
+}
+
+func cacheUsage() {
+	fmt.Fprintf(os.Stderr, "usage: nezhactl cache <command> [flags]\n\ncommands:\n")
+	names := make([]string, 0, len(cacheCommands))
+	for name := range cacheCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, cacheCommands[name].summary)
+	}
+}
+
+func runCachePrefetch(args []string) error {
+	fs := flag.NewFlagSet("cache prefetch", flag.ExitOnError)
+	f := addClusterFlags(fs)
+	var urls, prefixes stringList
+	namespace := fs.String("namespace", "default", "namespace of the DatasetPrefetch, the jobs it holds are in the same namespace")
+	name := fs.String("name", "", "name of the DatasetPrefetch, the dataset name jobs are annotated with")
+	service := fs.String("service", "", "namespace/name of the cache Service to prefetch through")
+	ip := fs.String("ip", "", "address of the cache to prefetch through, instead of -service")
+	port := fs.Int("port", 0, "port of the cache, 80 when 0")
+	parallelism := fs.Int("parallelism", 0, "objects fetched at once, the prefetcher default when 0")
+	holdJobs := fs.Bool("hold-jobs", false, "suspend the jobs annotated with the dataset until the prefetch is complete")
+	waitComplete := fs.Bool("wait", false, "wait until the prefetch is complete or failed")
+	fs.Var(&urls, "url", "URL to prefetch, repeatable")
+	fs.Var(&prefixes, "prefix", "bucket URL prefix whose objects are prefetched, repeatable")
+	fs.Parse(args)
+	if len(*name) == 0 {
+		return fmt.Errorf("-name is required")
+	}
+	if len(urls) == 0 && len(prefixes) == 0 {
+		return fmt.Errorf("-url or -prefix is required")
+	}
+
+	prefetch := &v1alpha1.DatasetPrefetch{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.SchemeGroupVersion.String(),
+			Kind:       "DatasetPrefetch",
+		},
+		ObjectMeta: metav1.ObjectMeta{Namespace: *namespace, Name: *name},
+		Spec: v1alpha1.DatasetPrefetchSpec{
+			URLs:        urls,
+			Prefixes:    prefixes,
+			Port:        int32(*port),
+			Parallelism: int32(*parallelism),
+			HoldJobs:    *holdJobs,
+		},
+	}
+	switch {
+	case len(*service) > 0 && len(*ip) > 0:
+		return fmt.Errorf("-service and -ip are exclusive")
+	case len(*service) > 0:
+		parts := strings.Split(*service, "/")
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return fmt.Errorf("-service must be namespace/name")
+		}
+		prefetch.Spec.Target.Service = &v1alpha1.ServiceReference{Namespace: parts[0], Name: parts[1]}
+	case len(*ip) > 0:
+		prefetch.Spec.Target.IP = *ip
+	default:
+		return fmt.Errorf("-service or -ip is required")
+	}
+
+	nezhaClient, err := f.nezhaClient()
+	if err != nil {
+		return err
+	}
+	if _, err := nezhaClient.DatasetPrefetches(*namespace).Create(prefetch); err != nil {
+		return err
+	}
+	fmt.Printf("DatasetPrefetch %s/%s created\n", *namespace, *name)
+	if !*waitComplete {
+		return nil
+	}
+
+	var phase v1alpha1.PrefetchPhase
+	err = wait.PollInfinite(2*time.Second, func() (bool, error) {
+		latest, err := nezhaClient.DatasetPrefetches(*namespace).Get(*name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		prefetch = latest
+		status := prefetch.Status
+		if status.Phase != phase {
+			fmt.Printf("%s: %d/%d objects, %d bytes, %d failures\n",
+				status.Phase, status.ObjectsFetched, status.ObjectsTotal, status.BytesFetched, status.Failures)
+			phase = status.Phase
+		}
+		return phase == v1alpha1.PrefetchComplete || phase == v1alpha1.PrefetchFailed, nil
+	})
+	if err != nil {
+		return err
+	}
+	if phase == v1alpha1.PrefetchFailed {
+		return fmt.Errorf("prefetch failed: %s", prefetch.Status.Message)
+	}
+	return nil
+}
+
+func runCacheStatus(args []string) error {
+	fs := flag.NewFlagSet("cache status", flag.ExitOnError)
+	f := addClusterFlags(fs)
+	namespace := fs.String("namespace", "", "namespace of the DatasetPrefetches, all namespaces if empty")
+	prefix := fs.String("prefix", "", "only show the prefetches with a URL or prefix starting with this")
+	fs.Parse(args)
+
+	nezhaClient, err := f.nezhaClient()
+	if err != nil {
+		return err
+	}
+	list, err := nezhaClient.DatasetPrefetches(*namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tTARGET\tPHASE\tFETCHED\tTOTAL\tBYTES\tFAILURES\tAGE")
+	var fetched, total, bytes, failures int64
+	for _, p := range list.Items {
+		if len(*prefix) > 0 && !hasPrefix(p.Spec.URLs, *prefix) && !hasPrefix(p.Spec.Prefixes, *prefix) {
+			continue
+		}
+		target := p.Spec.Target.IP
+		if p.Spec.Target.Service != nil {
+			target = p.Spec.Target.Service.Namespace + "/" + p.Spec.Target.Service.Name
+		}
+		s := p.Status
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%v\n", p.Namespace, p.Name, target,
+			s.Phase, s.ObjectsFetched, s.ObjectsTotal, s.BytesFetched, s.Failures,
+			time.Since(p.CreationTimestamp.Time).Round(time.Second))
+		fetched += s.ObjectsFetched
+		total += s.ObjectsTotal
+		bytes += s.BytesFetched
+		failures += s.Failures
+	}
+	fmt.Fprintf(w, "\t\tTOTAL\t\t%d\t%d\t%d\t%d\t\n", fetched, total, bytes, failures)
+	return w.Flush()
+}
+
+func hasPrefix(urls []string, prefix string) bool {
+	for _, u := range urls {
+		if strings.HasPrefix(u, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// objectFlags select the objects of a proxy.
+type objectFlags struct {
+	key, prefix, route, dataset *string
+}
+
+func addObjectFlags(fs *flag.FlagSet) objectFlags {
+	return objectFlags{
+		key:     fs.String("key", "", "object key, hostname and path, or URL"),
+		prefix:  fs.String("prefix", "", "prefix of the object keys, or URL prefix"),
+		route:   fs.String("route", "", "route of the objects"),
+		dataset: fs.String("dataset", "", "dataset of the objects"),
+	}
+}
+
+func (f objectFlags) query() url.Values {
+	query := url.Values{}
+	for param, value := range map[string]string{"key": *f.key, "prefix": *f.prefix, "route": *f.route, "dataset": *f.dataset} {
+		if len(value) > 0 {
+			query.Set(param, value)
+		}
+	}
+	return query
+}
+
+func runCacheList(args []string) error {
+	fs := flag.NewFlagSet("cache list", flag.ExitOnError)
+	f := addAdminFlags(fs)
+	objects := addObjectFlags(fs)
+	fs.Parse(args)
+	admin, err := f.admin()
+	if err != nil {
+		return err
+	}
+	var list []proxy.ObjectStatus
+	if err := admin.do(http.MethodGet, "/objects", objects.query(), &list); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "KEY\tROUTE\tDATASET\tSIZE\tAGE\tHITS\tPINNED")
+	var size, hits int64
+	for _, obj := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%d\t%v\n", obj.Key, obj.Route, obj.Dataset, formatBytes(obj.Size),
+			time.Since(obj.Stored).Round(time.Second), obj.Hits, obj.Pinned)
+		size += obj.Size
+		hits += obj.Hits
+	}
+	fmt.Fprintf(w, "%d objects\t\t\t%s\t\t%d\t\n", len(list), formatBytes(size), hits)
+	return w.Flush()
+}
+
+func runCacheStats(args []string) error {
+	fs := flag.NewFlagSet("cache stats", flag.ExitOnError)
+	f := addAdminFlags(fs)
+	fs.Parse(args)
+	admin, err := f.admin()
+	if err != nil {
+		return err
+	}
+	var stats proxy.Stats
+	if err := admin.do(http.MethodGet, "/stats", nil, &stats); err != nil {
+		return err
+	}
+
+	fmt.Printf("%d objects, %s of %s", stats.Objects, formatBytes(stats.Size), formatBytes(stats.Capacity))
+	if len(stats.Pinned) > 0 {
+		fmt.Printf(", pinned datasets: %s", strings.Join(stats.Pinned, ","))
+	}
+	fmt.Printf("\n\n")
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "ROUTE\tOBJECTS\tSIZE\tREQUESTS\tHIT RATIO\tFROM CACHE\tFROM ORIGIN")
+	for _, s := range stats.Routes {
+		var requests int64
+		for _, n := range s.Requests {
+			requests += n
+		}
+		ratio := "-"
+		if r, ok := proxy.HitRatio(s.Requests); ok {
+			ratio = fmt.Sprintf("%.1f%%", 100*r)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\t%s\t%s\n", s.Route, s.Objects, formatBytes(s.Size), requests, ratio,
+			formatBytes(s.CacheBytes), formatBytes(s.OriginBytes))
+	}
+	return w.Flush()
+}
+
+func runCachePurge(args []string) error {
+	fs := flag.NewFlagSet("cache purge", flag.ExitOnError)
+	f := addAdminFlags(fs)
+	objects := addObjectFlags(fs)
+	all := fs.Bool("all", false, "purge every object")
+	fs.Parse(args)
+	query := objects.query()
+	if len(query) == 0 && !*all {
+		return fmt.Errorf("-key, -prefix, -route, -dataset or -all is required")
+	}
+	if *all {
+		query.Set("all", "true")
+	}
+	admin, err := f.admin()
+	if err != nil {
+		return err
+	}
+	var result proxy.PurgeResult
+	if err := admin.do(http.MethodPost, "/purge", query, &result); err != nil {
+		return err
+	}
+	fmt.Printf("%d objects purged\n", result.Purged)
+	return nil
+}
+
+func runCachePin(args []string) error {
+	return pinDataset("pin", args)
+}
+
+func runCacheUnpin(args []string) error {
+	return pinDataset("unpin", args)
+}
+
+func pinDataset(verb string, args []string) error {
+	fs := flag.NewFlagSet("cache "+verb, flag.ExitOnError)
+	f := addAdminFlags(fs)
+	dataset := fs.String("dataset", "", "dataset of the route config of the proxy")
+	fs.Parse(args)
+	if len(*dataset) == 0 {
+		return fmt.Errorf("-dataset is required")
+	}
+	admin, err := f.admin()
+	if err != nil {
+		return err
+	}
+	var pinned []string
+	if err := admin.do(http.MethodPost, "/"+verb, url.Values{"dataset": {*dataset}}, &pinned); err != nil {
+		return err
+	}
+	fmt.Printf("pinned datasets: %s\n", strings.Join(pinned, ","))
+	return nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
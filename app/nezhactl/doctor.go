@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fast-ml/nezha/pkg/admission"
+	"github.com/fast-ml/nezha/pkg/client"
+	"github.com/fast-ml/nezha/pkg/controller"
+	"github.com/fast-ml/nezha/pkg/proxy"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Results of a doctor check.
+const (
+	checkOK   = "ok"
+	checkFail = "FAIL"
+	checkWarn = "warn"
+	checkSkip = "skip"
+)
+
+// doctor walks the checks explaining why a workload does or does not get
+// the host aliases of a cache.
+type doctor struct {
+	clientset   kubernetes.Interface
+	nezhaClient client.Interface
+	failures    []string
+}
+
+func (d *doctor) report(result, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Printf("%-5s %s\n", result, msg)
+	if result == checkFail {
+		d.failures = append(d.failures, msg)
+	}
+}
+
+// registeredWebhooks is the part of a webhook configuration checked by
+// doctor.
+type registeredWebhooks struct {
+	Webhooks []struct {
+		Name         string `json:"name"`
+		ClientConfig struct {
+			Service *struct {
+				Namespace string `json:"namespace"`
+				Name      string `json:"name"`
+			} `json:"service"`
+			CABundle []byte `json:"caBundle"`
+		} `json:"clientConfig"`
+		NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector"`
+	} `json:"webhooks"`
+}
+
+// clusterRoutes provides the configs of the CacheRoutes listed from the
+// cluster, as the webhook's CacheRouteController does.
+type clusterRoutes []clusterRoute
+
+type clusterRoute struct {
+	configs   []controller.Config
+	resources []string
+}
+
+func (r clusterRoutes) Configs(resource string) []controller.Config {
+	var configs []controller.Config
+	for _, route := range r {
+		if len(route.resources) > 0 && !containsString(route.resources, resource) {
+			continue
+		}
+		configs = append(configs, route.configs...)
+	}
+	return configs
+}
+
+func (r clusterRoutes) RecordInjection(string) {}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func runDoctor(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	f := addClusterFlags(fs)
+	namespace := fs.String("namespace", "default", "namespace of the workload")
+	configMap := fs.String("configmap", "default/hostaliases-config", "namespace/name of the hostaliases config ConfigMap, as the webhook flag")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: nezhactl doctor [flags] pod/<name>|job/<name>")
+	}
+	parts := strings.SplitN(fs.Arg(0), "/", 2)
+	if len(parts) != 2 || (parts[0] != "pod" && parts[0] != "job") {
+		return fmt.Errorf("%s: expected pod/<name> or job/<name>", fs.Arg(0))
+	}
+	nezhaClient, err := f.nezhaClient()
+	if err != nil {
+		return err
+	}
+	d := &doctor{
+		clientset:   controller.GetClient(*f.kubeMaster, *f.kubeConfig),
+		nezhaClient: nezhaClient,
+	}
+
+	// the labels matched by the webhook and the pods that should have the
+	// aliases
+	var (
+		resource    string
+		objLabels   map[string]string
+		annotations map[string]string
+		pods        []coreV1.Pod
+	)
+	if parts[0] == "job" {
+		job, err := d.clientset.BatchV1().Jobs(*namespace).Get(parts[1], metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		resource, objLabels, annotations = "jobs", job.Labels, job.Annotations
+		selector, err := metav1.LabelSelectorAsSelector(job.Spec.Selector)
+		if err != nil {
+			return err
+		}
+		list, err := d.clientset.CoreV1().Pods(*namespace).List(metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return err
+		}
+		pods = list.Items
+	} else {
+		pod, err := d.clientset.CoreV1().Pods(*namespace).Get(parts[1], metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		resource, objLabels, annotations = "pods", pod.Labels, pod.Annotations
+		pods = []coreV1.Pod{*pod}
+	}
+
+	d.checkWebhook(resource, *namespace)
+	if conf := d.checkConfig(resource, objLabels, *configMap); conf != nil && len(conf.Aliases) > 0 {
+		if conf.DNS {
+			d.checkDNS(fs.Arg(0), pods, conf.Aliases)
+		} else {
+			d.checkAliases(fs.Arg(0), annotations, pods, conf.HostAliases())
+		}
+		d.checkHitRatio(pods, d.checkProxies(conf.Aliases))
+	}
+
+	if len(d.failures) > 0 {
+		fmt.Printf("\nverdict: %s is not accelerated: %s\n", fs.Arg(0), d.failures[0])
+		return fmt.Errorf("%d checks failed", len(d.failures))
+	}
+	fmt.Printf("\nverdict: %s gets the host aliases of its cache\n", fs.Arg(0))
+	return nil
+}
+
+// checkWebhook checks that the webhook of resource is registered, selects
+// the namespace and has ready endpoints.
+func (d *doctor) checkWebhook(resource, namespace string) {
+	name := map[string]string{"jobs": "hostaliases-webhook-cfg-job", "pods": "hostaliases-webhook-cfg-pod"}[resource]
+	apiVersion, err := webhookAPIVersion(d.clientset)
+	if err != nil {
+		d.report(checkFail, "webhook configuration %s: %v", name, err)
+		return
+	}
+	path := fmt.Sprintf("/apis/admissionregistration.k8s.io/%s/mutatingwebhookconfigurations/%s", apiVersion, name)
+	raw, err := d.clientset.CoreV1().RESTClient().Get().AbsPath(path).DoRaw()
+	if errors.IsNotFound(err) {
+		d.report(checkFail, "webhook configuration %s is not installed", name)
+		return
+	} else if err != nil {
+		d.report(checkFail, "webhook configuration %s: %v", name, err)
+		return
+	}
+	config := registeredWebhooks{}
+	if err := json.Unmarshal(raw, &config); err != nil || len(config.Webhooks) == 0 {
+		d.report(checkFail, "webhook configuration %s has no webhook", name)
+		return
+	}
+	webhook := config.Webhooks[0]
+	d.report(checkOK, "webhook configuration %s is installed", name)
+	if len(webhook.ClientConfig.CABundle) == 0 {
+		d.report(checkFail, "webhook %s has no caBundle, the API server cannot call it", webhook.Name)
+	}
+
+	ns, err := d.clientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err != nil {
+		d.report(checkFail, "namespace %s: %v", namespace, err)
+	} else if webhook.NamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(webhook.NamespaceSelector)
+		switch {
+		case err != nil:
+			d.report(checkFail, "namespaceSelector of %s: %v", name, err)
+		case !selector.Matches(labels.Set(ns.Labels)):
+			d.report(checkFail, "namespace %s does not match the namespaceSelector %s of %s", namespace, selector, name)
+		default:
+			d.report(checkOK, "namespace %s matches the namespaceSelector %s", namespace, selector)
+		}
+	}
+
+	if svc := webhook.ClientConfig.Service; svc != nil {
+		if ready, err := d.readyEndpoints(svc.Namespace, svc.Name); err != nil {
+			d.report(checkFail, "webhook service %s/%s: %v", svc.Namespace, svc.Name, err)
+		} else if ready == 0 {
+			d.report(checkFail, "webhook service %s/%s has no ready endpoint", svc.Namespace, svc.Name)
+		} else {
+			d.report(checkOK, "webhook service %s/%s has %d ready endpoints", svc.Namespace, svc.Name, ready)
+		}
+	}
+}
+
+// checkConfig explains which config entry matches the labels and returns
+// it.
+func (d *doctor) checkConfig(resource string, objLabels map[string]string, configMap string) *controller.Config {
+	var configs []controller.Config
+	parts := strings.SplitN(configMap, "/", 2)
+	if len(parts) != 2 {
+		d.report(checkFail, "invalid -configmap %s", configMap)
+		return nil
+	}
+	cm, err := d.clientset.CoreV1().ConfigMaps(parts[0]).Get(parts[1], metav1.GetOptions{})
+	if err == nil {
+		conf, err := controller.ConfigMapToConfig(cm)
+		if err != nil {
+			d.report(checkFail, "hostaliases config %s: %v", configMap, err)
+		} else {
+			configs = *conf
+		}
+	} else if !errors.IsNotFound(err) {
+		d.report(checkFail, "hostaliases config %s: %v", configMap, err)
+	}
+
+	var routes clusterRoutes
+	list, err := d.nezhaClient.CacheRoutes().List(metav1.ListOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		d.report(checkWarn, "cacheroutes not checked: %v", err)
+	} else if err == nil {
+		for i := range list.Items {
+			route := &list.Items[i]
+			if route.Spec.Policies.Paused {
+				continue
+			}
+			ip, err := controller.ResolveTarget(d.clientset, route.Spec.Target)
+			if err != nil {
+				d.report(checkWarn, "cacheroute %s: %v", route.Name, err)
+				continue
+			}
+			routes = append(routes, clusterRoute{
+				configs:   controller.RouteToConfig(route, ip),
+				resources: route.Spec.Policies.Resources,
+			})
+		}
+	}
+
+	admitter := &admission.Admitter{
+		Configs: func() []controller.Config { return configs },
+		Routes:  routes,
+	}
+	var selected string
+	for _, m := range admitter.Explain(resource, objLabels) {
+		if m.Matched {
+			selected = m.Config
+		}
+		fmt.Printf("      config %s: %s\n", m.Config, m.Reason)
+	}
+	if len(selected) == 0 {
+		d.report(checkFail, "no config entry or CacheRoute matches the labels %v", labels.Set(objLabels))
+		return nil
+	}
+	d.report(checkOK, "config %s matches", selected)
+	if conf := controller.GetConfigByName(selected, configs); conf != nil {
+		return conf
+	}
+	name := strings.TrimPrefix(selected, controller.CacheRouteConfigPrefix)
+	routeConfigs := routes.Configs(resource)
+	for i := range routeConfigs {
+		if routeConfigs[i].Name == name {
+			return &routeConfigs[i]
+		}
+	}
+	return nil
+}
+
+// checkAliases checks that the pods got the expected aliases.
+func (d *doctor) checkAliases(title string, annotations map[string]string, pods []coreV1.Pod, expected []coreV1.HostAlias) {
+	if _, ok := annotations[controller.DriftAnnotation]; ok {
+		d.report(checkFail, "%s is flagged by the controller as missing the aliases of its config", title)
+	}
+	if len(pods) == 0 {
+		d.report(checkWarn, "%s has no pod to check the aliases of", title)
+		return
+	}
+	missing := 0
+	for _, pod := range pods {
+		if !controller.HasAliases(pod.Spec.HostAliases, expected) {
+			missing++
+			d.report(checkFail, "pod %s misses host aliases %s, it was created before the config matched or the webhook was not called", pod.Name, formatAliases(expected))
+		}
+	}
+	if missing == 0 {
+		d.report(checkOK, "%d pods resolve %s through their /etc/hosts", len(pods), formatAliases(expected))
+	}
+}
+
+// checkDNS checks that the pods of a DNS entry use a nameserver of their
+// own, which is expected to be the Nezha one.
+func (d *doctor) checkDNS(title string, pods []coreV1.Pod, expected []coreV1.HostAlias) {
+	if len(pods) == 0 {
+		d.report(checkWarn, "%s has no pod to check the DNS config of", title)
+		return
+	}
+	missing := 0
+	for _, pod := range pods {
+		if pod.Spec.DNSPolicy != coreV1.DNSNone || pod.Spec.DNSConfig == nil || len(pod.Spec.DNSConfig.Nameservers) == 0 {
+			missing++
+			d.report(checkFail, "pod %s uses the cluster DNS, it was created before the config matched, the webhook was not called or has no -dns-server", pod.Name)
+		}
+	}
+	if missing == 0 {
+		d.report(checkOK, "%d pods resolve %s through nameserver %s", len(pods), formatAliases(expected), pods[0].Spec.DNSConfig.Nameservers[0])
+	}
+}
+
+// checkProxies checks that the aliased addresses are Services with ready
+// endpoints, and returns those Services.
+func (d *doctor) checkProxies(expected []coreV1.HostAlias) []*coreV1.Service {
+	services, err := d.clientset.CoreV1().Services("").List(metav1.ListOptions{})
+	if err != nil {
+		d.report(checkWarn, "proxy services not checked: %v", err)
+		return nil
+	}
+	var proxies []*coreV1.Service
+	for _, alias := range expected {
+		var svc *coreV1.Service
+		for i := range services.Items {
+			if services.Items[i].Spec.ClusterIP == alias.IP {
+				svc = &services.Items[i]
+				break
+			}
+		}
+		if svc == nil {
+			if net.ParseIP(alias.IP) == nil {
+				d.report(checkFail, "alias address %s is not an IP", alias.IP)
+			} else {
+				d.report(checkSkip, "%s is not the address of a Service, its reachability is not checked", alias.IP)
+			}
+			continue
+		}
+		ready, err := d.readyEndpoints(svc.Namespace, svc.Name)
+		switch {
+		case err != nil:
+			d.report(checkFail, "proxy service %s/%s: %v", svc.Namespace, svc.Name, err)
+		case ready == 0:
+			d.report(checkFail, "proxy service %s/%s (%s) has no ready endpoint", svc.Namespace, svc.Name, alias.IP)
+		default:
+			d.report(checkOK, "proxy service %s/%s (%s) has %d ready endpoints", svc.Namespace, svc.Name, alias.IP, ready)
+			proxies = append(proxies, svc)
+		}
+	}
+	return proxies
+}
+
+// checkHitRatio sums the requests of the pods in the metrics of every
+// ready pod of the proxy Services, on their admin port.
+func (d *doctor) checkHitRatio(pods []coreV1.Pod, services []*coreV1.Service) {
+	clients := map[string]bool{}
+	for _, pod := range pods {
+		if len(pod.Status.PodIP) > 0 {
+			clients[pod.Status.PodIP] = true
+		}
+	}
+	if len(clients) == 0 || len(services) == 0 {
+		return
+	}
+	requests := map[string]int64{}
+	scraped := 0
+	seen := map[string]bool{}
+	for _, svc := range services {
+		if seen[svc.Namespace+"/"+svc.Name] {
+			continue
+		}
+		seen[svc.Namespace+"/"+svc.Name] = true
+		endpoints, err := d.clientset.CoreV1().Endpoints(svc.Namespace).Get(svc.Name, metav1.GetOptions{})
+		if err != nil {
+			d.report(checkWarn, "cache hit ratio through %s/%s not checked: %v", svc.Namespace, svc.Name, err)
+			continue
+		}
+		for _, subset := range endpoints.Subsets {
+			var port int32
+			for _, p := range subset.Ports {
+				if p.Name == adminPort {
+					port = p.Port
+				}
+			}
+			if port == 0 {
+				d.report(checkSkip, "proxy service %s/%s has no %s port, the cache hit ratio is not checked", svc.Namespace, svc.Name, adminPort)
+				break
+			}
+			for _, address := range subset.Addresses {
+				if address.TargetRef == nil || address.TargetRef.Kind != "Pod" {
+					continue
+				}
+				admin := podAdmin(d.clientset.CoreV1().RESTClient(), address.TargetRef.Namespace, address.TargetRef.Name, port)
+				text, err := admin.raw("GET", "/metrics", nil)
+				if err != nil {
+					d.report(checkWarn, "metrics of proxy pod %s/%s: %v", address.TargetRef.Namespace, address.TargetRef.Name, err)
+					continue
+				}
+				scraped++
+				for client, counts := range clientRequests(string(text)) {
+					if clients[client] {
+						for result, n := range counts {
+							requests[result] += n
+						}
+					}
+				}
+			}
+		}
+	}
+	if scraped == 0 {
+		return
+	}
+	var total int64
+	for _, n := range requests {
+		total += n
+	}
+	ratio, ok := proxy.HitRatio(requests)
+	switch {
+	case total == 0:
+		d.report(checkWarn, "the pods sent no request to the %d proxy pods since they started, or beyond their -max-clients", scraped)
+	case !ok:
+		d.report(checkWarn, "none of the %d requests of the pods to the proxies could be cached", total)
+	case ratio < 0.5:
+		d.report(checkWarn, "cache hit ratio of the pods is %.1f%% of %d requests, the dataset is not cached yet or was evicted", 100*ratio, total)
+	default:
+		d.report(checkOK, "cache hit ratio of the pods is %.1f%% of %d requests", 100*ratio, total)
+	}
+}
+
+// clientRequestsSample is a sample of nezha_proxy_client_requests_total.
+var clientRequestsSample = regexp.MustCompile(`^nezha_proxy_client_requests_total\{client="([^"]*)",result="([^"]*)"\} (\S+)$`)
+
+// clientRequests returns the requests by client and result in the metrics
+// of a proxy.
+func clientRequests(text string) map[string]map[string]int64 {
+	requests := map[string]map[string]int64{}
+	for _, line := range strings.Split(text, "\n") {
+		m := clientRequestsSample.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		n, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			continue
+		}
+		if requests[m[1]] == nil {
+			requests[m[1]] = map[string]int64{}
+		}
+		requests[m[1]][m[2]] += int64(n)
+	}
+	return requests
+}
+
+func (d *doctor) readyEndpoints(namespace, name string) (int, error) {
+	endpoints, err := d.clientset.CoreV1().Endpoints(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	ready := 0
+	for _, subset := range endpoints.Subsets {
+		ready += len(subset.Addresses)
+	}
+	return ready, nil
+}
+
+func formatAliases(aliases []coreV1.HostAlias) string {
+	var s []string
+	for _, alias := range aliases {
+		s = append(s, strings.Join(alias.Hostnames, ",")+"="+alias.IP)
+	}
+	return strings.Join(s, " ")
+}
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	ghyaml "github.com/ghodss/yaml"
+	"gopkg.in/yaml.v2"
+
+	"github.com/fast-ml/nezha/pkg/controller"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// values configures the objects rendered by install.
+type values struct {
+	Namespace         string              `yaml:"namespace"`
+	CreateNamespace   bool                `yaml:"createNamespace"`
+	Image             string              `yaml:"image"`
+	ImagePullPolicy   string              `yaml:"imagePullPolicy"`
+	Replicas          int                 `yaml:"replicas"`
+	LogLevel          int                 `yaml:"logLevel"`
+	LocalityWeight    int                 `yaml:"localityWeight"`
+	HoldForPrefetch   bool                `yaml:"holdForPrefetch"`
+	CacheRoutes       bool                `yaml:"cacheRoutes"`
+	ClientAuth        bool                `yaml:"clientAuth"`
+	ClusterCIDRs      []string            `yaml:"clusterCIDRs"`
+	DNSServer         string              `yaml:"dnsServer"`
+	NativeSidecars    string              `yaml:"nativeSidecars"`
+	FailurePolicy     string              `yaml:"failurePolicy"`
+	NamespaceSelector map[string]string   `yaml:"namespaceSelector"`
+	Config            []controller.Config `yaml:"config"`
+	Proxy             proxyValues         `yaml:"proxy"`
+	// CRDs is the directory of the CustomResourceDefinitions, relative to
+	// the values file, none are installed when empty.
+	CRDs       string           `yaml:"crds"`
+	Controller componentValues  `yaml:"controller"`
+	Prefetcher prefetcherValues `yaml:"prefetcher"`
+	DNS        dnsValues        `yaml:"dns"`
+
+	// set by loadValues and render
+	CRDManifests      []string               `yaml:"-"`
+	ControllerArgs    []string               `yaml:"-"`
+	WebhookAPIVersion string                 `yaml:"-"`
+	ConfigData        string                 `yaml:"-"`
+	Args              []string               `yaml:"-"`
+	Webhooks          []webhookConfiguration `yaml:"-"`
+}
+
+type proxyValues struct {
+	Enabled  bool   `yaml:"enabled"`
+	Name     string `yaml:"name"`
+	Image    string `yaml:"image"`
+	Replicas int    `yaml:"replicas"`
+	// nginx.conf of the proxy, inline or read from a file relative to
+	// the values file
+	Config     string `yaml:"config"`
+	ConfigFile string `yaml:"configFile"`
+	// When label is set, a config entry aliases hostnames, by default the
+	// server_name of the proxy config, to the proxy Service for the
+	// objects whose app label is label.
+	App       string   `yaml:"app"`
+	Label     string   `yaml:"label"`
+	Hostnames []string `yaml:"hostnames"`
+	ClusterIP string   `yaml:"clusterIP"`
+}
+
+// componentValues configure one of the Deployments of Nezha.
+type componentValues struct {
+	Enabled  bool   `yaml:"enabled"`
+	Image    string `yaml:"image"`
+	Replicas int    `yaml:"replicas"`
+}
+
+type prefetcherValues struct {
+	componentValues `yaml:",inline"`
+	// TFJobs releases the Kubeflow TFJobs held for a prefetch.
+	TFJobs bool `yaml:"tfJobs"`
+}
+
+// dnsValues configure the Nezha nameserver of the DNS entries, which the
+// webhook points the matched pods to unless dnsServer is set.
+type dnsValues struct {
+	componentValues `yaml:",inline"`
+	ClusterIP       string `yaml:"clusterIP"`
+}
+
+// defaults sets the image and replicas of c when they are not set.
+func (c *componentValues) defaults(image string, replicas int) {
+	if len(c.Image) == 0 {
+		c.Image = image
+	}
+	if c.Replicas == 0 {
+		c.Replicas = replicas
+	}
+}
+
+type webhookConfiguration struct {
+	Kind     string
+	Config   string
+	Webhooks []webhook
+}
+
+type webhook struct {
+	Name           string
+	Path           string
+	FailurePolicy  string
+	Mutating       bool
+	Operations     []string
+	Group          string
+	Version        string
+	Resource       string
+	ObjectSelector map[string]string
+}
+
+func loadValues(file string) (*values, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	v := &values{}
+	if err := yaml.UnmarshalStrict(data, v); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if len(v.Namespace) == 0 {
+		v.Namespace = "default"
+	}
+	if len(v.Image) == 0 {
+		v.Image = "docker.io/rootfs/hostalias-webhook:latest"
+	}
+	if len(v.ImagePullPolicy) == 0 {
+		v.ImagePullPolicy = "IfNotPresent"
+	}
+	if v.Replicas == 0 {
+		v.Replicas = 2
+	}
+	if len(v.FailurePolicy) == 0 {
+		v.FailurePolicy = "Ignore"
+	}
+	if len(v.NamespaceSelector) == 0 {
+		v.NamespaceSelector = map[string]string{"hostaliases-injector": "enabled"}
+	}
+	v.Controller.defaults("docker.io/rootfs/nezha-controller:latest", 1)
+	v.Prefetcher.defaults("docker.io/rootfs/nezha-prefetcher:latest", 1)
+	v.DNS.defaults("coredns/coredns:1.11.1", 2)
+	if len(v.CRDs) > 0 {
+		dir := v.CRDs
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(file), dir)
+		}
+		files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%s: no CRDs in %s", file, dir)
+		}
+		for _, f := range files {
+			crd, err := ioutil.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			v.CRDManifests = append(v.CRDManifests, strings.TrimSpace(string(crd)))
+		}
+	}
+	p := &v.Proxy
+	if len(p.Name) == 0 {
+		p.Name = "proxy-cache"
+	}
+	if len(p.Image) == 0 {
+		p.Image = "nginx"
+	}
+	if p.Replicas == 0 {
+		p.Replicas = 1
+	}
+	if len(p.ConfigFile) > 0 {
+		if !filepath.IsAbs(p.ConfigFile) {
+			p.ConfigFile = filepath.Join(filepath.Dir(file), p.ConfigFile)
+		}
+		conf, err := ioutil.ReadFile(p.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		p.Config = string(conf)
+	}
+	if p.Enabled && len(p.Config) == 0 {
+		return nil, fmt.Errorf("%s: proxy.config or proxy.configFile is required", file)
+	}
+	if len(p.Hostnames) == 0 {
+		p.Hostnames = serverNames(p.Config)
+	}
+	return v, nil
+}
+
+// serverNames returns the server_name of the server blocks of an nginx
+// config.
+func serverNames(conf string) []string {
+	var names []string
+	for _, line := range strings.Split(conf, "\n") {
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(line), ";"))
+		if len(fields) > 1 && fields[0] == "server_name" {
+			names = append(names, fields[1:]...)
+		}
+	}
+	return names
+}
+
+// proxyAliases tells whether a config entry points at the proxy.
+func (v *values) proxyAliases() bool {
+	return v.Proxy.Enabled && len(v.Proxy.Label) > 0 && len(v.Proxy.Hostnames) > 0
+}
+
+// configs returns the hostaliases config, with the proxy entry once the
+// address of the proxy is known.
+func (v *values) configs() []controller.Config {
+	configs := v.Config
+	if v.proxyAliases() && len(v.Proxy.ClusterIP) > 0 {
+		configs = append(append([]controller.Config{}, configs...), controller.Config{
+			Name:  v.Proxy.Name,
+			App:   v.Proxy.App,
+			Label: v.Proxy.Label,
+			Aliases: []coreV1.HostAlias{{
+				IP:        v.Proxy.ClusterIP,
+				Hostnames: v.Proxy.Hostnames,
+			}},
+		})
+	}
+	return configs
+}
+
+// render returns the YAML documents of tmpl. Webhook configurations are
+// rendered for admissionregistration apiVersion.
+func render(v *values, tmpl, apiVersion string) ([][]byte, error) {
+	if configs := v.configs(); len(configs) > 0 {
+		data, err := yaml.Marshal(configs)
+		if err != nil {
+			return nil, err
+		}
+		v.ConfigData = string(data)
+	} else {
+		v.ConfigData = "[]\n"
+	}
+
+	v.Args = []string{
+		"-configmap=" + v.Namespace + "/hostaliases-config",
+		"-self-managed-certs",
+		"-cert-secret=" + v.Namespace + "/hostaliases-injector-webhook-certs",
+		fmt.Sprintf("-v=%d", v.LogLevel),
+	}
+	if v.CacheRoutes {
+		v.Args = append(v.Args, "-cacheroutes")
+	}
+	if v.HoldForPrefetch {
+		v.Args = append(v.Args, "-hold-for-prefetch")
+	}
+	if v.LocalityWeight > 0 {
+		v.Args = append(v.Args, fmt.Sprintf("-locality-weight=%d", v.LocalityWeight))
+	}
+	if v.ClientAuth {
+		v.Args = append(v.Args, "-client-auth")
+	}
+	if len(v.ClusterCIDRs) > 0 {
+		v.Args = append(v.Args, "-cluster-cidrs="+strings.Join(v.ClusterCIDRs, ","))
+	}
+	if len(v.DNSServer) > 0 {
+		v.Args = append(v.Args, "-dns-server="+v.DNSServer)
+	} else if v.DNS.Enabled && len(v.DNS.ClusterIP) > 0 {
+		v.Args = append(v.Args, "-dns-server="+v.DNS.ClusterIP)
+	}
+	v.ControllerArgs = []string{
+		"-configmap=hostaliases-config",
+		"-namespace=" + v.Namespace,
+		fmt.Sprintf("-v=%d", v.LogLevel),
+	}
+	if v.DNS.Enabled {
+		v.ControllerArgs = append(v.ControllerArgs, "-dns-configmap="+v.Namespace+"/nezha-dns")
+	}
+	if len(v.NativeSidecars) > 0 {
+		v.Args = append(v.Args, "-native-sidecars="+v.NativeSidecars)
+	}
+
+	v.WebhookAPIVersion = apiVersion
+	v.Webhooks = webhookConfigurations(v, apiVersion)
+
+	t, err := template.New("manifests").Funcs(template.FuncMap{
+		"json": func(obj interface{}) (string, error) {
+			data, err := json.Marshal(obj)
+			return string(data), err
+		},
+	}).Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, v); err != nil {
+		return nil, err
+	}
+	return splitDocuments(out.Bytes())
+}
+
+func webhookConfigurations(v *values, apiVersion string) []webhookConfiguration {
+	deploymentGroup, deploymentVersion := "apps", "v1"
+	if apiVersion == "v1beta1" {
+		deploymentGroup, deploymentVersion = "extensions", "v1beta1"
+	}
+	mutating := func(name, path string, operations []string, group, version, resource string) webhookConfiguration {
+		return webhookConfiguration{
+			Kind:   "MutatingWebhookConfiguration",
+			Config: "hostaliases-webhook-cfg-" + name,
+			Webhooks: []webhook{{
+				Name:          "hostaliases-injector-" + name + ".webhook.io",
+				Path:          path,
+				FailurePolicy: v.FailurePolicy,
+				Mutating:      true,
+				Operations:    operations,
+				Group:         group,
+				Version:       version,
+				Resource:      resource,
+			}},
+		}
+	}
+	jobs := mutating("job", "/mutate-job", []string{"CREATE"}, "batch", "v1", "jobs")
+	if v.HoldForPrefetch {
+		tfJobs := mutating("tfjob", "/mutate-tfjob", []string{"CREATE"}, "kubeflow.org", "v1", "tfjobs")
+		jobs.Webhooks = append(jobs.Webhooks, tfJobs.Webhooks...)
+	}
+	return []webhookConfiguration{
+		mutating("dp", "/mutate-deployment", []string{"CREATE", "UPDATE"}, deploymentGroup, deploymentVersion, "deployments"),
+		jobs,
+		mutating("pod", "/mutate-pod", []string{"CREATE"}, "", "v1", "pods"),
+		{
+			Kind:   "ValidatingWebhookConfiguration",
+			Config: "hostaliases-webhook-cfg-validate",
+			Webhooks: []webhook{{
+				Name:           "hostaliases-config.webhook.io",
+				Path:           "/validate-configmap",
+				FailurePolicy:  "Fail",
+				Operations:     []string{"CREATE", "UPDATE"},
+				Version:        "v1",
+				Resource:       "configmaps",
+				ObjectSelector: map[string]string{controller.ConfigLabel: "true"},
+			}, {
+				Name:          "hostaliases-cacheroute.webhook.io",
+				Path:          "/validate-cacheroute",
+				FailurePolicy: "Fail",
+				Operations:    []string{"CREATE", "UPDATE"},
+				Group:         "nezha.fast-ml.io",
+				Version:       "v1alpha1",
+				Resource:      "cacheroutes",
+			}},
+		},
+	}
+}
+
+func splitDocuments(data []byte) ([][]byte, error) {
+	var docs [][]byte
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			return docs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(doc)) > 0 {
+			docs = append(docs, bytes.TrimSpace(doc))
+		}
+	}
+}
+
+// installFlags are the flags shared by install and uninstall.
+type installFlags struct {
+	clusterFlags
+	values *string
+}
+
+func addInstallFlags(fs *flag.FlagSet) installFlags {
+	return installFlags{
+		clusterFlags: addClusterFlags(fs),
+		values:       fs.String("f", "", "values file"),
+	}
+}
+
+func runInstall(args []string) error {
+	fs := flag.NewFlagSet("install", flag.ExitOnError)
+	f := addInstallFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "print the manifests instead of applying them")
+	apiVersion := fs.String("webhook-api-version", "", "admissionregistration version of the webhook configurations, v1 or v1beta1, discovered from the cluster when empty")
+	fs.Parse(args)
+	if len(*f.values) == 0 {
+		return fmt.Errorf("-f is required")
+	}
+	v, err := loadValues(*f.values)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		if len(*apiVersion) == 0 {
+			*apiVersion = "v1"
+		}
+		if v.proxyAliases() && len(v.Proxy.ClusterIP) == 0 {
+			return fmt.Errorf("proxy.clusterIP is required with -dry-run, the proxy Service address is known once applied")
+		}
+		if v.DNS.Enabled && len(v.DNSServer) == 0 && len(v.DNS.ClusterIP) == 0 {
+			return fmt.Errorf("dns.clusterIP or dnsServer is required with -dry-run, the nameserver Service address is known once applied")
+		}
+		if errs := controller.ValidateConfig(v.configs()); len(errs) > 0 {
+			return errs.ToAggregate()
+		}
+		return printManifests(v, *apiVersion)
+	}
+
+	clientset := controller.GetClient(*f.kubeMaster, *f.kubeConfig)
+	if len(*apiVersion) == 0 {
+		if *apiVersion, err = webhookAPIVersion(clientset); err != nil {
+			return err
+		}
+	}
+	a := &applier{client: clientset.CoreV1().RESTClient()}
+	for _, tmpl := range templates[:len(templates)-1] {
+		docs, err := render(v, tmpl, *apiVersion)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if err := a.apply(doc); err != nil {
+				return err
+			}
+		}
+	}
+	if v.DNS.Enabled && len(v.DNSServer) == 0 && len(v.DNS.ClusterIP) == 0 {
+		svc, err := clientset.CoreV1().Services(v.Namespace).Get("nezha-dns", metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		v.DNS.ClusterIP = svc.Spec.ClusterIP
+	}
+	if v.proxyAliases() && len(v.Proxy.ClusterIP) == 0 {
+		svc, err := clientset.CoreV1().Services(v.Namespace).Get(v.Proxy.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		v.Proxy.ClusterIP = svc.Spec.ClusterIP
+	}
+	if errs := controller.ValidateConfig(v.configs()); len(errs) > 0 {
+		return errs.ToAggregate()
+	}
+	docs, err := render(v, webhookTemplate, *apiVersion)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if err := a.apply(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runUninstall(args []string) error {
+	fs := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	f := addInstallFlags(fs)
+	fs.Parse(args)
+	if len(*f.values) == 0 {
+		return fmt.Errorf("-f is required")
+	}
+	v, err := loadValues(*f.values)
+	if err != nil {
+		return err
+	}
+	clientset := controller.GetClient(*f.kubeMaster, *f.kubeConfig)
+	apiVersion, err := webhookAPIVersion(clientset)
+	if err != nil {
+		return err
+	}
+	var docs [][]byte
+	for _, tmpl := range templates {
+		rendered, err := render(v, tmpl, apiVersion)
+		if err != nil {
+			return err
+		}
+		for _, doc := range rendered {
+			// the CRDs are kept, deleting them would delete every
+			// CacheRoute and DatasetPrefetch
+			if obj := (object{}); ghyaml.Unmarshal(doc, &obj) == nil && obj.Kind == "CustomResourceDefinition" {
+				continue
+			}
+			docs = append(docs, doc)
+		}
+	}
+	a := &applier{client: clientset.CoreV1().RESTClient()}
+	for i := len(docs) - 1; i >= 0; i-- {
+		if err := a.delete(docs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printManifests(v *values, apiVersion string) error {
+	printed := false
+	for _, tmpl := range templates {
+		docs, err := render(v, tmpl, apiVersion)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if printed {
+				fmt.Println("---")
+			}
+			printed = true
+			fmt.Println(string(doc))
+		}
+	}
+	return nil
+}
+
+// webhookAPIVersion returns v1 if the cluster serves
+// admissionregistration.k8s.io/v1, v1beta1 otherwise.
+func webhookAPIVersion(clientset kubernetes.Interface) (string, error) {
+	_, err := clientset.Discovery().ServerResourcesForGroupVersion("admissionregistration.k8s.io/v1")
+	switch {
+	case err == nil:
+		return "v1", nil
+	case errors.IsNotFound(err):
+		return "v1beta1", nil
+	}
+	return "", err
+}
+
+// kinds maps the kinds rendered by install to their resource and scope.
+var kinds = map[string]struct {
+	resource   string
+	namespaced bool
+}{
+	"Namespace":                      {"namespaces", false},
+	"CustomResourceDefinition":       {"customresourcedefinitions", false},
+	"ServiceAccount":                 {"serviceaccounts", true},
+	"ConfigMap":                      {"configmaps", true},
+	"Secret":                         {"secrets", true},
+	"Service":                        {"services", true},
+	"Deployment":                     {"deployments", true},
+	"ClusterRole":                    {"clusterroles", false},
+	"ClusterRoleBinding":             {"clusterrolebindings", false},
+	"Role":                           {"roles", true},
+	"RoleBinding":                    {"rolebindings", true},
+	"MutatingWebhookConfiguration":   {"mutatingwebhookconfigurations", false},
+	"ValidatingWebhookConfiguration": {"validatingwebhookconfigurations", false},
+}
+
+// applyPatchType is the server-side apply content type, served from 1.16.
+const applyPatchType = types.PatchType("application/apply-patch+yaml")
+
+// applier applies and deletes YAML documents through raw REST calls.
+type applier struct {
+	client rest.Interface
+	// the cluster does not serve server-side apply
+	noServerSideApply bool
+}
+
+// paths returns the collection and object paths of a document.
+func paths(doc []byte) (string, string, string, error) {
+	obj := object{}
+	if err := ghyaml.Unmarshal(doc, &obj); err != nil {
+		return "", "", "", err
+	}
+	kind, ok := kinds[obj.Kind]
+	if !ok {
+		return "", "", "", fmt.Errorf("unknown kind %s", obj.Kind)
+	}
+	prefix := "/apis/" + obj.APIVersion
+	if obj.APIVersion == "v1" {
+		prefix = "/api/v1"
+	}
+	if kind.namespaced {
+		prefix += "/namespaces/" + obj.Namespace
+	}
+	collection := prefix + "/" + kind.resource
+	title := obj.Kind + " " + obj.Name
+	if kind.namespaced {
+		title = obj.Kind + " " + obj.Namespace + "/" + obj.Name
+	}
+	return title, collection, collection + "/" + obj.Name, nil
+}
+
+// apply sends doc with server-side apply as the nezhactl field manager, so
+// that fields set by others, like the caBundle patched by the webhook, are
+// kept. Clusters without server-side apply get a create or a merge patch.
+func (a *applier) apply(doc []byte) error {
+	title, collection, path, err := paths(doc)
+	if err != nil {
+		return err
+	}
+	if !a.noServerSideApply {
+		_, err = a.client.Patch(applyPatchType).AbsPath(path).
+			Param("fieldManager", "nezhactl").Param("force", "true").
+			Body(doc).Timeout(30 * time.Second).DoRaw()
+		if errors.IsUnsupportedMediaType(err) {
+			a.noServerSideApply = true
+		} else if err != nil {
+			return fmt.Errorf("%s: %v", title, err)
+		} else {
+			fmt.Printf("%s applied\n", title)
+			return nil
+		}
+	}
+
+	js, err := ghyaml.YAMLToJSON(doc)
+	if err != nil {
+		return err
+	}
+	_, err = a.client.Get().AbsPath(path).DoRaw()
+	if errors.IsNotFound(err) {
+		if _, err := a.client.Post().AbsPath(collection).Body(js).DoRaw(); err != nil {
+			return fmt.Errorf("%s: %v", title, err)
+		}
+		fmt.Printf("%s created\n", title)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: %v", title, err)
+	}
+	if _, err := a.client.Patch(types.MergePatchType).AbsPath(path).Body(js).DoRaw(); err != nil {
+		return fmt.Errorf("%s: %v", title, err)
+	}
+	fmt.Printf("%s configured\n", title)
+	return nil
+}
+
+func (a *applier) delete(doc []byte) error {
+	title, _, path, err := paths(doc)
+	if err != nil {
+		return err
+	}
+	_, err = a.client.Delete().AbsPath(path).DoRaw()
+	if errors.IsNotFound(err) {
+		fmt.Printf("%s not found\n", title)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: %v", title, err)
+	}
+	fmt.Printf("%s deleted\n", title)
+	return nil
+}
@@ -0,0 +1,554 @@
+package main
+
+// Templates rendered by install, in the order the objects are applied.
+// uninstall deletes them in reverse order.
+
+// templates are applied in order. The webhook comes last since its config
+// and flags need the addresses of the proxy and the nameserver.
+var templates = []string{clusterTemplate, componentsTemplate, proxyTemplate, webhookTemplate}
+
+// clusterTemplate renders the namespace and the CRDs.
+const clusterTemplate = `{{- if .CreateNamespace}}
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: {{.Namespace}}
+{{- range .CRDManifests}}
+---
+{{.}}
+{{- end}}
+{{- else}}
+{{- range $i, $crd := .CRDManifests}}
+{{- if $i}}
+---
+{{- end}}
+{{$crd}}
+{{- end}}
+{{- end}}
+`
+
+// componentsTemplate renders the controller, the prefetcher and the
+// nameserver of the DNS entries, with their RBAC.
+const componentsTemplate = `{{- if .Controller.Enabled}}
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: hostaliases-controller
+  namespace: {{.Namespace}}
+  labels:
+    app: hostaliases-controller
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: hostaliases-controller
+  labels:
+    app: hostaliases-controller
+rules:
+  - apiGroups: [""]
+    resources: ["configmaps"]
+    verbs: ["get", "list", "watch", "create", "update"]
+  - apiGroups: [""]
+    resources: ["pods"]
+    verbs: ["get", "list", "watch", "patch", "delete"]
+  - apiGroups: [""]
+    resources: ["namespaces"]
+    verbs: ["get"]
+  - apiGroups: ["apps"]
+    resources: ["deployments"]
+    verbs: ["get", "list", "patch"]
+  - apiGroups: ["batch"]
+    resources: ["jobs"]
+    verbs: ["get", "list", "patch"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: hostaliases-controller
+  labels:
+    app: hostaliases-controller
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: hostaliases-controller
+subjects:
+  - kind: ServiceAccount
+    name: hostaliases-controller
+    namespace: {{.Namespace}}
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: hostaliases-controller
+  namespace: {{.Namespace}}
+  labels:
+    app: hostaliases-controller
+spec:
+  replicas: {{.Controller.Replicas}}
+  selector:
+    matchLabels:
+      app: hostaliases-controller
+  template:
+    metadata:
+      labels:
+        app: hostaliases-controller
+    spec:
+      serviceAccountName: hostaliases-controller
+      containers:
+        - name: controller
+          image: {{.Controller.Image}}
+          imagePullPolicy: {{.ImagePullPolicy}}
+          args:
+{{- range .ControllerArgs}}
+            - {{json .}}
+{{- end}}
+---
+{{- end}}
+{{- if .Prefetcher.Enabled}}
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: nezha-prefetcher
+  namespace: {{.Namespace}}
+  labels:
+    app: nezha-prefetcher
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: nezha-prefetcher
+  labels:
+    app: nezha-prefetcher
+rules:
+  - apiGroups: ["nezha.fast-ml.io"]
+    resources: ["datasetprefetches"]
+    verbs: ["get", "list", "watch"]
+  - apiGroups: ["nezha.fast-ml.io"]
+    resources: ["datasetprefetches/status"]
+    verbs: ["get", "update"]
+  - apiGroups: [""]
+    resources: ["services"]
+    verbs: ["get"]
+  - apiGroups: ["batch"]
+    resources: ["jobs"]
+    verbs: ["list", "patch"]
+  - apiGroups: ["kubeflow.org"]
+    resources: ["tfjobs"]
+    verbs: ["list", "patch"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: nezha-prefetcher
+  labels:
+    app: nezha-prefetcher
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: nezha-prefetcher
+subjects:
+  - kind: ServiceAccount
+    name: nezha-prefetcher
+    namespace: {{.Namespace}}
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nezha-prefetcher
+  namespace: {{.Namespace}}
+  labels:
+    app: nezha-prefetcher
+spec:
+  replicas: {{.Prefetcher.Replicas}}
+  selector:
+    matchLabels:
+      app: nezha-prefetcher
+  template:
+    metadata:
+      labels:
+        app: nezha-prefetcher
+    spec:
+      serviceAccountName: nezha-prefetcher
+      containers:
+        - name: prefetcher
+          image: {{.Prefetcher.Image}}
+          imagePullPolicy: {{.ImagePullPolicy}}
+          args:
+            - {{json (printf "-v=%d" .LogLevel)}}
+{{- if .Prefetcher.TFJobs}}
+            - -tfjobs
+{{- end}}
+---
+{{- end}}
+{{- if .DNS.Enabled}}
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: nezha-dns
+  namespace: {{.Namespace}}
+  labels:
+    app: nezha-dns
+data:
+  Corefile: |
+    .:53 {
+        errors
+        health :8080
+        ready :8181
+        reload 10s
+        forward . /etc/resolv.conf
+        cache 30
+    }
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: nezha-dns
+  namespace: {{.Namespace}}
+  labels:
+    app: nezha-dns
+spec:
+{{- if .DNS.ClusterIP}}
+  clusterIP: {{.DNS.ClusterIP}}
+{{- end}}
+  selector:
+    app: nezha-dns
+  ports:
+    - name: dns
+      port: 53
+      protocol: UDP
+    - name: dns-tcp
+      port: 53
+      protocol: TCP
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nezha-dns
+  namespace: {{.Namespace}}
+  labels:
+    app: nezha-dns
+spec:
+  replicas: {{.DNS.Replicas}}
+  selector:
+    matchLabels:
+      app: nezha-dns
+  template:
+    metadata:
+      labels:
+        app: nezha-dns
+    spec:
+      containers:
+        - name: coredns
+          image: {{.DNS.Image}}
+          args: ["-conf", "/etc/coredns/Corefile"]
+          ports:
+            - name: dns
+              containerPort: 53
+              protocol: UDP
+            - name: dns-tcp
+              containerPort: 53
+              protocol: TCP
+          livenessProbe:
+            httpGet:
+              path: /health
+              port: 8080
+          readinessProbe:
+            httpGet:
+              path: /ready
+              port: 8181
+          volumeMounts:
+            - name: config
+              mountPath: /etc/coredns
+              readOnly: true
+      volumes:
+        - name: config
+          configMap:
+            name: nezha-dns
+{{- end}}
+`
+
+// proxyTemplate renders the caching proxy the host aliases point to.
+const proxyTemplate = `{{- if .Proxy.Enabled}}
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{.Proxy.Name}}-conf
+  namespace: {{.Namespace}}
+  labels:
+    app: {{.Proxy.Name}}
+data:
+  nginx.conf: {{json .Proxy.Config}}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{.Proxy.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    app: {{.Proxy.Name}}
+spec:
+{{- if .Proxy.ClusterIP}}
+  clusterIP: {{.Proxy.ClusterIP}}
+{{- end}}
+  ports:
+  - port: 80
+    name: http
+  selector:
+    app: {{.Proxy.Name}}
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{.Proxy.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    app: {{.Proxy.Name}}
+spec:
+  replicas: {{.Proxy.Replicas}}
+  selector:
+    matchLabels:
+      app: {{.Proxy.Name}}
+  template:
+    metadata:
+      labels:
+        app: {{.Proxy.Name}}
+    spec:
+      containers:
+      - name: nginx
+        image: {{.Proxy.Image}}
+        ports:
+        - containerPort: 80
+          name: http
+        command: ["nginx"]
+        args: ["-c", "/cfg/nginx.conf"]
+        volumeMounts:
+        - name: nginx-conf
+          mountPath: /cfg
+      volumes:
+      - name: nginx-conf
+        configMap:
+          name: {{.Proxy.Name}}-conf
+{{- end}}
+`
+
+// webhookTemplate renders the webhook, its RBAC, config and registration.
+// The webhook runs with -self-managed-certs: it fills the certificate
+// Secret and the caBundle of the webhook configurations, which are left out
+// here so that applying again does not reset them.
+const webhookTemplate = `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: hostaliases-injector
+  namespace: {{.Namespace}}
+  labels:
+    app: hostaliases-injector
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: hostaliases-injector
+  labels:
+    app: hostaliases-injector
+rules:
+  - apiGroups: ["nezha.fast-ml.io"]
+    resources: ["cacheroutes"]
+    verbs: ["get", "list", "watch"]
+  - apiGroups: ["nezha.fast-ml.io"]
+    resources: ["cacheroutes/status"]
+    verbs: ["get", "update"]
+  - apiGroups: ["nezha.fast-ml.io"]
+    resources: ["datasetprefetches"]
+    verbs: ["get", "list", "watch"]
+  - apiGroups: [""]
+    resources: ["services"]
+    verbs: ["get"]
+  - apiGroups: [""]
+    resources: ["nodes"]
+    verbs: ["list"]
+  - apiGroups: [""]
+    resources: ["configmaps"]
+    verbs: ["get", "list", "watch"]
+  - apiGroups: ["admissionregistration.k8s.io"]
+    resources: ["mutatingwebhookconfigurations", "validatingwebhookconfigurations"]
+    verbs: ["get", "patch"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: hostaliases-injector
+  labels:
+    app: hostaliases-injector
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: hostaliases-injector
+subjects:
+  - kind: ServiceAccount
+    name: hostaliases-injector
+    namespace: {{.Namespace}}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: hostaliases-injector-certs
+  namespace: {{.Namespace}}
+  labels:
+    app: hostaliases-injector
+rules:
+  - apiGroups: [""]
+    resources: ["secrets"]
+    verbs: ["get", "create", "update"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: hostaliases-injector-certs
+  namespace: {{.Namespace}}
+  labels:
+    app: hostaliases-injector
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: hostaliases-injector-certs
+subjects:
+  - kind: ServiceAccount
+    name: hostaliases-injector
+    namespace: {{.Namespace}}
+---
+{{- if .ClientAuth}}
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: hostaliases-injector-client-ca
+  namespace: kube-system
+  labels:
+    app: hostaliases-injector
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: extension-apiserver-authentication-reader
+subjects:
+  - kind: ServiceAccount
+    name: hostaliases-injector
+    namespace: {{.Namespace}}
+---
+{{- end}}
+apiVersion: v1
+kind: Secret
+metadata:
+  name: hostaliases-injector-webhook-certs
+  namespace: {{.Namespace}}
+  labels:
+    app: hostaliases-injector
+type: Opaque
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: hostaliases-config
+  namespace: {{.Namespace}}
+  labels:
+    app: hostaliases-injector
+    nezha.fast-ml.io/config: "true"
+data:
+  config: {{json .ConfigData}}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: hostaliases-injector-webhook-svc
+  namespace: {{.Namespace}}
+  labels:
+    app: hostaliases-injector
+spec:
+  ports:
+  - port: 443
+    targetPort: 443
+  selector:
+    app: hostaliases-injector
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: hostaliases-injector-webhook-deployment
+  namespace: {{.Namespace}}
+  labels:
+    app: hostaliases-injector
+spec:
+  replicas: {{.Replicas}}
+  selector:
+    matchLabels:
+      app: hostaliases-injector
+  template:
+    metadata:
+      annotations:
+        prometheus.io/scrape: "true"
+        prometheus.io/port: "8080"
+      labels:
+        app: hostaliases-injector
+    spec:
+      serviceAccountName: hostaliases-injector
+      terminationGracePeriodSeconds: 45
+      containers:
+        - name: hostaliases-injector
+          image: {{.Image}}
+          imagePullPolicy: {{.ImagePullPolicy}}
+          ports:
+            - name: metrics
+              containerPort: 8080
+            - name: health
+              containerPort: 8081
+          livenessProbe:
+            httpGet:
+              path: /healthz
+              port: health
+          readinessProbe:
+            httpGet:
+              path: /readyz
+              port: health
+            periodSeconds: 2
+          args:
+{{- range .Args}}
+            - {{json .}}
+{{- end}}
+{{- range .Webhooks}}
+---
+apiVersion: admissionregistration.k8s.io/{{$.WebhookAPIVersion}}
+kind: {{.Kind}}
+metadata:
+  name: {{.Config}}
+  labels:
+    app: hostaliases-injector
+webhooks:
+{{- range .Webhooks}}
+  - name: {{.Name}}
+    clientConfig:
+      service:
+        name: hostaliases-injector-webhook-svc
+        namespace: {{$.Namespace}}
+        path: {{json .Path}}
+{{- if eq $.WebhookAPIVersion "v1"}}
+    admissionReviewVersions: ["v1", "v1beta1"]
+    sideEffects: None
+    timeoutSeconds: 5
+{{- end}}
+    failurePolicy: {{.FailurePolicy}}
+{{- if and .Mutating (eq $.WebhookAPIVersion "v1")}}
+    reinvocationPolicy: IfNeeded
+{{- end}}
+    rules:
+      - operations:  {{json .Operations}}
+        apiGroups:   [{{json .Group}}]
+        apiVersions: [{{json .Version}}]
+        resources:   [{{json .Resource}}]
+{{- if .Mutating}}
+    namespaceSelector:
+      matchLabels: {{json $.NamespaceSelector}}
+{{- end}}
+{{- if and .ObjectSelector (eq $.WebhookAPIVersion "v1")}}
+    objectSelector:
+      matchLabels: {{json .ObjectSelector}}
+{{- end}}
+{{- end}}
+{{- end}}
+`
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/fast-ml/nezha/pkg/admission"
+	"github.com/fast-ml/nezha/pkg/controller"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// resources maps the kinds reviewed by the webhooks to their resource.
+var resources = map[string]string{
+	"Deployment": "deployments",
+	"Job":        "jobs",
+	"Pod":        "pods",
+	"TFJob":      "tfjobs",
+	"ConfigMap":  "configmaps",
+	"CacheRoute": "cacheroutes",
+}
+
+type object struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+}
+
+func runMutate(args []string) error {
+	fs := flag.NewFlagSet("mutate", flag.ExitOnError)
+	file := fs.String("f", "", "manifest to mutate, - for stdin")
+	configFile := fs.String("config", "", "hostaliases config file, as in the config key of the hostaliases-config ConfigMap")
+	namespace := fs.String("namespace", "default", "namespace of the objects without one")
+	localityWeight := fs.Int("locality-weight", 0, "weight of the preferred node affinity to dataset nodes, as the webhook flag")
+	clusterCIDRs := fs.String("cluster-cidrs", "", "comma separated pod and service CIDRs, as the webhook flag")
+	dnsServer := fs.String("dns-server", "", "address of the Nezha nameserver, as the webhook flag")
+	clusterDomain := fs.String("cluster-domain", "cluster.local", "cluster domain, as the webhook flag")
+	nativeSidecars := fs.Bool("native-sidecars", false, "inject the sidecar of jobs as a native sidecar, as the webhook flag")
+	output := fs.String("o", "yaml", "output: yaml prints the mutated objects, patch the JSON patches")
+	fs.Parse(args)
+	if len(*file) == 0 {
+		return fmt.Errorf("-f is required")
+	}
+	if *output != "yaml" && *output != "patch" {
+		return fmt.Errorf("unknown output %s", *output)
+	}
+
+	var configs []controller.Config
+	if len(*configFile) > 0 {
+		conf, err := controller.FileToConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		configs = *conf
+	}
+	noProxy, err := controller.ParseCIDRs(*clusterCIDRs)
+	if err != nil {
+		return err
+	}
+	admitter := &admission.Admitter{
+		Configs:        func() []controller.Config { return configs },
+		LocalityWeight: int32(*localityWeight),
+		NoProxy:        noProxy,
+		DNSServer:      *dnsServer,
+		ClusterDomain:  *clusterDomain,
+		NativeSidecars: *nativeSidecars,
+	}
+
+	in := os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	// With -o patch, stdout only has the JSON patches, so that it can be
+	// passed to kubectl patch.
+	comments := io.Writer(os.Stdout)
+	if *output == "patch" {
+		comments = os.Stderr
+	}
+	denied := 0
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(in))
+	for printed := false; ; {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		if printed {
+			fmt.Fprintln(comments, "---")
+		}
+		printed = true
+		ok, err := mutateDocument(admitter, doc, *namespace, *output, comments)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			denied++
+		}
+	}
+	if denied > 0 {
+		return fmt.Errorf("%d objects denied", denied)
+	}
+	return nil
+}
+
+// mutateDocument prints the review of a YAML document, with its explanation
+// to comments, and tells whether it was admitted.
+func mutateDocument(admitter *admission.Admitter, doc []byte, namespace, output string, comments io.Writer) (bool, error) {
+	js, err := yaml.YAMLToJSON(doc)
+	if err != nil {
+		return false, err
+	}
+	obj := object{}
+	if err := json.Unmarshal(js, &obj); err != nil {
+		return false, err
+	}
+	if len(obj.Namespace) > 0 {
+		namespace = obj.Namespace
+	}
+	title := fmt.Sprintf("%s %s/%s", obj.Kind, namespace, obj.Name)
+	resource, ok := resources[obj.Kind]
+	if !ok {
+		fmt.Fprintf(comments, "# %s: not reviewed by Nezha\n", title)
+		return true, printObject(js, nil, output)
+	}
+
+	gv, err := schema.ParseGroupVersion(obj.APIVersion)
+	if err != nil {
+		return false, err
+	}
+	ar := v1beta1.AdmissionReview{
+		Request: &v1beta1.AdmissionRequest{
+			UID:       types.UID("nezhactl"),
+			Kind:      metav1.GroupVersionKind{Group: gv.Group, Version: gv.Version, Kind: obj.Kind},
+			Resource:  metav1.GroupVersionResource{Group: gv.Group, Version: gv.Version, Resource: resource},
+			Namespace: namespace,
+			Name:      obj.Name,
+			Operation: v1beta1.Create,
+			Object:    runtime.RawExtension{Raw: js},
+		},
+	}
+	response, err := admitter.Admit(ar)
+	if err != nil {
+		fmt.Fprintf(comments, "# %s: not reviewed: %v\n", title, err)
+		return true, printObject(js, nil, output)
+	}
+	switch {
+	case !response.Allowed:
+		fmt.Fprintf(comments, "# %s: denied: %s\n", title, response.Result.Message)
+	case len(response.Patch) > 0:
+		fmt.Fprintf(comments, "# %s: mutated\n", title)
+	default:
+		fmt.Fprintf(comments, "# %s: unchanged\n", title)
+	}
+	if resource == "deployments" || resource == "jobs" || resource == "pods" {
+		for _, m := range admitter.Explain(resource, obj.Labels) {
+			state := "skipped"
+			if m.Matched {
+				state = "matched"
+			}
+			fmt.Fprintf(comments, "#   config %s %s: %s\n", m.Config, state, m.Reason)
+		}
+	}
+	return response.Allowed, printObject(js, response.Patch, output)
+}
+
+func printObject(js, patch []byte, output string) error {
+	if output == "patch" {
+		if len(patch) == 0 {
+			patch = []byte("[]")
+		}
+		var out bytes.Buffer
+		if err := json.Indent(&out, patch, "", "  "); err != nil {
+			return err
+		}
+		fmt.Println(out.String())
+		return nil
+	}
+	if len(patch) > 0 {
+		var err error
+		if js, err = admission.ApplyPatch(js, patch); err != nil {
+			return err
+		}
+	}
+	y, err := yaml.JSONToYAML(js)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(y))
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/fast-ml/nezha/pkg/client"
+	"github.com/fast-ml/nezha/pkg/controller"
+)
+
+type command struct {
+	summary string
+	run     func(args []string) error
+}
+
+var commands = map[string]command{
+	"cache":     {"prefetch datasets and manage the objects of the caches", runCache},
+	"doctor":    {"explain why a pod or job is not accelerated", runDoctor},
+	"install":   {"render and apply the Nezha manifests from a values file", runInstall},
+	"mutate":    {"preview what the webhooks do to manifests", runMutate},
+	"uninstall": {"delete the objects created by install", runUninstall},
+}
+
+// stringList is a flag that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// clusterFlags are the flags of the commands talking to the cluster.
+type clusterFlags struct {
+	kubeConfig *string
+	kubeMaster *string
+}
+
+func addClusterFlags(fs *flag.FlagSet) clusterFlags {
+	return clusterFlags{
+		kubeConfig: fs.String("kubeconfig", "", "Absolute path to the kubeconfig"),
+		kubeMaster: fs.String("kubemaster", "", "Kubernetes Controller Master URL"),
+	}
+}
+
+func (f clusterFlags) nezhaClient() (*client.NezhaClient, error) {
+	return client.NewForConfig(controller.GetClusterConfig(*f.kubeMaster, *f.kubeConfig))
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: nezhactl <command> [flags]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun nezhactl <command> -h for the flags of a command\n")
+}
+
+func main() {
+	// the shared packages log with glog, keep it off files
+	flag.Set("logtostderr", "true")
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "nezhactl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fast-ml/nezha/pkg/controller"
+	"k8s.io/client-go/rest"
+)
+
+// adminPort is the name of the admin port of the proxy Service.
+const adminPort = "admin"
+
+// proxyAdmin calls the admin API of a Nezha proxy, directly or through
+// the proxy subresource of the API server.
+type proxyAdmin struct {
+	server string
+	client rest.Interface
+	base   string
+}
+
+// adminFlags are the flags of the commands calling a proxy admin API.
+type adminFlags struct {
+	cluster clusterFlags
+	server  *string
+	service *string
+}
+
+func addAdminFlags(fs *flag.FlagSet) adminFlags {
+	return adminFlags{
+		cluster: addClusterFlags(fs),
+		server:  fs.String("server", "", "URL of the proxy admin API, e.g. http://localhost:9090 with kubectl port-forward"),
+		service: fs.String("service", "", "namespace/name of the proxy Service, called through the API server on its admin port"),
+	}
+}
+
+func (f adminFlags) admin() (*proxyAdmin, error) {
+	switch {
+	case len(*f.server) > 0 && len(*f.service) > 0:
+		return nil, fmt.Errorf("-server and -service are exclusive")
+	case len(*f.server) > 0:
+		return &proxyAdmin{server: strings.TrimSuffix(*f.server, "/")}, nil
+	case len(*f.service) > 0:
+		parts := strings.Split(*f.service, "/")
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("-service must be namespace/name")
+		}
+		clientset := controller.GetClient(*f.cluster.kubeMaster, *f.cluster.kubeConfig)
+		return &proxyAdmin{
+			client: clientset.CoreV1().RESTClient(),
+			base:   fmt.Sprintf("/api/v1/namespaces/%s/services/%s:%s/proxy", parts[0], parts[1], adminPort),
+		}, nil
+	}
+	return nil, fmt.Errorf("-server or -service is required")
+}
+
+// podAdmin calls the admin API of a proxy pod on port.
+func podAdmin(client rest.Interface, namespace, name string, port int32) *proxyAdmin {
+	return &proxyAdmin{
+		client: client,
+		base:   fmt.Sprintf("/api/v1/namespaces/%s/pods/%s:%d/proxy", namespace, name, port),
+	}
+}
+
+// raw sends a request to path and returns the response body.
+func (a *proxyAdmin) raw(method, path string, query url.Values) ([]byte, error) {
+	if a.client != nil {
+		req := a.client.Verb(method).AbsPath(a.base + path).Timeout(30 * time.Second)
+		for k, values := range query {
+			for _, v := range values {
+				req.Param(k, v)
+			}
+		}
+		return req.DoRaw()
+	}
+	req, err := http.NewRequest(method, a.server+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// do sends a request to path and decodes the JSON response into out.
+func (a *proxyAdmin) do(method, path string, query url.Values, out interface{}) error {
+	body, err := a.raw(method, path, query)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
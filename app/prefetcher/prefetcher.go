@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/golang/glog"
+
+	"github.com/fast-ml/nezha/pkg/client"
+	"github.com/fast-ml/nezha/pkg/controller"
+)
+
+var (
+	kubeConfig string
+	kubeMaster string
+	namespace  string
+	tfJobs     bool
+)
+
+func main() {
+	flag.StringVar(&kubeConfig, "kubeconfig", "", "Absolute path to the kubeconfig")
+	flag.StringVar(&kubeMaster, "kubemaster", "", "Kubernetes Controller Master URL")
+	flag.StringVar(&namespace, "namespace", "", "Namespace to watch DatasetPrefetches in, all namespaces if empty")
+	flag.BoolVar(&tfJobs, "tfjobs", false, "release the Kubeflow TFJobs held for a prefetch, needs the kubeflow.org/v1 API")
+	flag.Parse()
+	flag.Set("logtostderr", "true")
+
+	nezhaClient, err := client.NewForConfig(controller.GetClusterConfig(kubeMaster, kubeConfig))
+	if err != nil {
+		glog.Fatal(err)
+	}
+	var tfJobClient client.TFJobsGetter
+	if tfJobs {
+		if tfJobClient, err = client.NewTFJobClientForConfig(controller.GetClusterConfig(kubeMaster, kubeConfig)); err != nil {
+			glog.Fatal(err)
+		}
+	}
+	ctrl := controller.NewPrefetchController(nezhaClient, controller.GetClient(kubeMaster, kubeConfig), tfJobClient, namespace)
+
+	glog.Infof("Starting prefetcher")
+	stop := make(chan struct{})
+	go ctrl.Run(stop)
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	<-signalChan
+
+	close(stop)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/fast-ml/nezha/pkg/controller"
+	"github.com/fast-ml/nezha/pkg/metrics"
+	"github.com/fast-ml/nezha/pkg/proxy"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var (
+	listenAddr      string
+	adminAddr       string
+	routesFile      string
+	parents         string
+	cacheDir        string
+	cacheSize       string
+	maxClients      int
+	forward         bool
+	forwardAllow    string
+	bumpCACert      string
+	bumpCAKey       string
+	nodeName        string
+	kubeConfig      string
+	kubeMaster      string
+	shutdownTimeout time.Duration
+)
+
+func main() {
+	flag.StringVar(&listenAddr, "listen-addr", ":80", "address serving the routes")
+	flag.StringVar(&adminAddr, "admin-addr", ":9090", "address serving the admin API, /metrics and /healthz, empty disables it")
+	flag.StringVar(&routesFile, "routes", "/etc/nezha/routes.yaml", "YAML file of the routes")
+	flag.StringVar(&parents, "parents", os.Getenv("NEZHA_PARENTS"), "comma separated hostname=IP of parent caches, NEZHA_PARENTS of a sidecar by default; their hostnames are the routes instead of -routes, served on 127.0.0.1:80 unless -listen-addr is set")
+	flag.StringVar(&cacheDir, "cache-dir", envOr("NEZHA_CACHE_DIR", "/var/cache/nezha"), "directory of the cached objects")
+	flag.StringVar(&cacheSize, "cache-size", "10Gi", "capacity of the cache, the least recently used objects are evicted beyond it")
+	flag.IntVar(&maxClients, "max-clients", 1000, "client addresses whose requests are counted apart in the metrics, 0 disables them")
+	flag.BoolVar(&forward, "forward", false, "serve as an HTTP proxy too: forward the requests to hostnames without route and relay CONNECT to port 443")
+	flag.StringVar(&forwardAllow, "forward-allow", "", "comma separated domains whose hostnames without route, and their subdomains, are forwarded to and tunnelled to with -forward, the others are denied")
+	flag.StringVar(&bumpCACert, "bump-ca-cert", "", "PEM file of the CA certificate signing the hostnames of the routes with bump, with -forward")
+	flag.StringVar(&bumpCAKey, "bump-ca-key", "", "PEM file of the RSA key of -bump-ca-cert")
+	flag.StringVar(&nodeName, "node-name", os.Getenv("NODE_NAME"), "node labelled with the datasets in the cache, NODE_NAME by default, empty disables the labels")
+	flag.StringVar(&kubeConfig, "kubeconfig", "", "Absolute path to the kubeconfig, with -node-name")
+	flag.StringVar(&kubeMaster, "kubemaster", "", "Kubernetes Controller Master URL, with -node-name")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "time to drain the requests in flight on SIGTERM")
+	flag.Parse()
+	flag.Set("logtostderr", "true")
+
+	size, err := resource.ParseQuantity(cacheSize)
+	if err != nil {
+		glog.Fatalf("invalid -cache-size: %v", err)
+	}
+	var routes []proxy.Route
+	if len(parents) > 0 {
+		if routes, err = proxy.ParentRoutes(parents); err != nil {
+			glog.Fatalf("invalid -parents: %v", err)
+		}
+		listenSet := false
+		flag.Visit(func(f *flag.Flag) { listenSet = listenSet || f.Name == "listen-addr" })
+		if !listenSet {
+			listenAddr = "127.0.0.1:80"
+		}
+		glog.Infof("caching %d hostnames of parents %s", len(routes), parents)
+	} else if routes, err = proxy.LoadRoutes(routesFile); err != nil {
+		glog.Fatal(err)
+	}
+	cache, err := proxy.NewCache(cacheDir, size.Value())
+	if err != nil {
+		glog.Fatal(err)
+	}
+	p := proxy.New(cache, routes, metrics.NewRegistry())
+	p.MaxClients = maxClients
+	p.Forward = forward
+	for _, domain := range strings.Split(forwardAllow, ",") {
+		if domain = strings.TrimSpace(domain); len(domain) > 0 {
+			p.ForwardAllow = append(p.ForwardAllow, domain)
+		}
+	}
+	if len(bumpCACert) > 0 || len(bumpCAKey) > 0 {
+		if !forward {
+			glog.Fatal("-bump-ca-cert and -bump-ca-key need -forward")
+		}
+		certPEM, err := ioutil.ReadFile(bumpCACert)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		keyPEM, err := ioutil.ReadFile(bumpCAKey)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if p.Bumper, err = proxy.NewBumper(certPEM, keyPEM); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	if len(nodeName) > 0 {
+		labeler := proxy.NewNodeLabeler(controller.GetClient(kubeMaster, kubeConfig), nodeName, cache)
+		go labeler.Run(30*time.Second, stop)
+	}
+
+	servers := []*http.Server{{Addr: listenAddr, Handler: p, ReadHeaderTimeout: 10 * time.Second}}
+	if len(adminAddr) > 0 {
+		servers = append(servers, &http.Server{Addr: adminAddr, Handler: p.AdminHandler(), ReadHeaderTimeout: 10 * time.Second})
+	}
+	errCh := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *http.Server) {
+			glog.Infof("serving on %s", s.Addr)
+			if err := s.ListenAndServe(); err != http.ErrServerClosed {
+				errCh <- fmt.Errorf("server %s failed: %v", s.Addr, err)
+			}
+		}(s)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errCh:
+		glog.Fatal(err)
+	case sig := <-signals:
+		glog.Infof("received %s, shutting down", sig)
+	}
+	close(stop)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				glog.Warningf("failed to drain server %s: %v", s.Addr, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+	glog.Infof("proxy stopped")
+	glog.Flush()
+}
+
+// envOr returns the value of the environment variable name, value if it is
+// empty.
+func envOr(name, value string) string {
+	if v := os.Getenv(name); len(v) > 0 {
+		return v
+	}
+	return value
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/fast-ml/nezha/pkg/certs"
+	"github.com/fast-ml/nezha/pkg/metrics"
+	"k8s.io/api/admission/v1beta1"
+)
+
+var (
+	registry = metrics.NewRegistry()
+
+	admissionRequests = registry.NewCounterVec("nezha_webhook_admission_requests_total",
+		"Admission requests by webhook, resource, operation and result.",
+		"webhook", "resource", "operation", "result")
+	admissionDuration = registry.NewHistogramVec("nezha_webhook_admission_duration_seconds",
+		"Time to review an admission request.", metrics.DefBuckets, "webhook")
+	configPatches = registry.NewCounterVec("nezha_webhook_config_patches_total",
+		"Objects patched with the host aliases of a config.", "config", "resource")
+)
+
+// Results of an admission request.
+const (
+	resultAllowed    = "allowed"
+	resultPatched    = "patched"
+	resultDenied     = "denied"
+	resultError      = "error"
+	resultBadRequest = "bad_request"
+)
+
+func responseResult(response *v1beta1.AdmissionResponse) string {
+	switch {
+	case !response.Allowed:
+		return resultDenied
+	case len(response.Patch) > 0:
+		return resultPatched
+	}
+	return resultAllowed
+}
+
+// registerMetrics adds the metrics read from the config store and the
+// serving certificate.
+func registerMetrics(reloader *certs.Reloader) {
+	registry.NewCounterFunc("nezha_webhook_config_reloads_total",
+		"Configs loaded successfully.", func() float64 {
+			reloads, _ := configStore.Stats()
+			return float64(reloads)
+		})
+	registry.NewCounterFunc("nezha_webhook_config_reload_failures_total",
+		"Configs rejected as invalid or unreadable.", func() float64 {
+			_, rejected := configStore.Stats()
+			return float64(rejected)
+		})
+	registry.NewGaugeFunc("nezha_webhook_config_generation",
+		"Generation of the config being served, 0 before the first load.", func() float64 {
+			return float64(configStore.Load().Generation)
+		})
+	registry.NewGaugeFunc("nezha_webhook_certificate_expiry_timestamp_seconds",
+		"Expiry of the serving certificate in seconds since the epoch, 0 if none is loaded.", func() float64 {
+			if leaf := reloader.Leaf(); leaf != nil {
+				return float64(leaf.NotAfter.Unix())
+			}
+			return 0
+		})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/fast-ml/nezha/pkg/certs"
+)
+
+// shuttingDown is set once a termination signal is received.
+var shuttingDown int32
+
+// checkReady tells why the webhook cannot review requests yet, nil once its
+// config and serving certificate are loaded.
+func checkReady(reloader *certs.Reloader) error {
+	switch {
+	case atomic.LoadInt32(&shuttingDown) != 0:
+		return fmt.Errorf("shutting down")
+	case reloader.Leaf() == nil:
+		return fmt.Errorf("no serving certificate")
+	case (len(configMap) > 0 || len(configFile) > 0) && !configStore.Loaded():
+		return fmt.Errorf("no valid config loaded")
+	case routeCtrl != nil && !routeCtrl.HasSynced():
+		return fmt.Errorf("cacheroutes not synced")
+	case prefetches != nil && !prefetches.HasSynced():
+		return fmt.Errorf("datasetprefetches not synced")
+	}
+	return nil
+}
+
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func readyzHandler(reloader *certs.Reloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkReady(reloader); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// plainServers returns the plain HTTP servers of /metrics and of /healthz
+// and /readyz, a single one when their addresses are the same.
+func plainServers(reloader *certs.Reloader) []*http.Server {
+	var servers []*http.Server
+	muxes := map[string]*http.ServeMux{}
+	mux := func(addr string) *http.ServeMux {
+		if m, ok := muxes[addr]; ok {
+			return m
+		}
+		m := http.NewServeMux()
+		muxes[addr] = m
+		servers = append(servers, &http.Server{Addr: addr, Handler: m, ReadHeaderTimeout: 10 * time.Second})
+		return m
+	}
+	if len(metricsAddr) > 0 {
+		mux(metricsAddr).Handle("/metrics", registry)
+	}
+	if len(healthAddr) > 0 {
+		m := mux(healthAddr)
+		m.HandleFunc("/healthz", serveHealthz)
+		m.HandleFunc("/readyz", readyzHandler(reloader))
+	}
+	return servers
+}
+
+// run serves until SIGTERM or SIGINT. It then fails readiness, gives the
+// Service shutdownDelay to stop sending requests, drains the requests in
+// flight and closes stop.
+func run(server *http.Server, plain []*http.Server, stop chan struct{}) {
+	errCh := make(chan error, len(plain)+1)
+	for _, s := range plain {
+		go func(s *http.Server) {
+			glog.Infof("serving %s over HTTP", s.Addr)
+			if err := s.ListenAndServe(); err != http.ErrServerClosed {
+				errCh <- fmt.Errorf("server %s failed: %v", s.Addr, err)
+			}
+		}(s)
+	}
+	go func() {
+		glog.Infof("serving webhooks on %s", server.Addr)
+		if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			errCh <- fmt.Errorf("server %s failed: %v", server.Addr, err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errCh:
+		glog.Fatal(err)
+	case sig := <-signals:
+		glog.Infof("received %s, shutting down in %v", sig, shutdownDelay)
+	}
+	atomic.StoreInt32(&shuttingDown, 1)
+	time.Sleep(shutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range append([]*http.Server{server}, plain...) {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				glog.Warningf("failed to drain server %s: %v", s.Addr, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+	close(stop)
+	glog.Infof("webhook stopped")
+	glog.Flush()
+}
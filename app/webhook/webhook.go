@@ -5,41 +5,111 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
 
+	"github.com/fast-ml/nezha/pkg/admission"
+	"github.com/fast-ml/nezha/pkg/certs"
+	"github.com/fast-ml/nezha/pkg/client"
 	"github.com/fast-ml/nezha/pkg/controller"
 	"k8s.io/api/admission/v1beta1"
-	batch "k8s.io/api/batch/v1"
-	extensions "k8s.io/api/extensions/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/tools/cache"
 )
 
 var (
-	configFile    string
-	useTLS        *bool
-	runtimeScheme = runtime.NewScheme()
-	codecs        = serializer.NewCodecFactory(runtimeScheme)
-	deserializer  = codecs.UniversalDeserializer()
-	hostAliasConf *[]controller.Config
+	configFile     string
+	configMap      string
+	cacheRoutes    bool
+	holdJobs       bool
+	localityWeight int
+	clusterCIDRs   string
+	dnsServer      string
+	clusterDomain  string
+	nativeSidecars string
+	kubeConfig     string
+	kubeMaster     string
+	// request handling
+	maxRequestBytes  int64
+	requestTimeout   time.Duration
+	denyOnErrorPaths string
+	denyOnError      map[string]bool
+	// servers
+	listenAddr      string
+	healthAddr      string
+	metricsAddr     string
+	shutdownDelay   time.Duration
+	shutdownTimeout time.Duration
+	useTLS          *bool
+	runtimeScheme   = runtime.NewScheme()
+	codecs          = serializer.NewCodecFactory(runtimeScheme)
+	deserializer    = codecs.UniversalDeserializer()
+	configStore     = controller.NewConfigStore()
+	admitter        = &admission.Admitter{
+		Configs: func() []controller.Config { return configStore.Load().Configs },
+		OnPatch: func(config, resource string) { configPatches.Inc(config, resource) },
+	}
+	routeCtrl  *controller.CacheRouteController
+	prefetches cache.SharedIndexInformer
 	// (https://github.com/kubernetes/kubernetes/issues/57982)
-	defaulter                  = runtime.ObjectDefaulter(runtimeScheme)
-	addHostAliasesPatch string = `[{"op": "add", "path": "/spec/template/spec/hostAliases", "value": %s }]`
+	defaulter = runtime.ObjectDefaulter(runtimeScheme)
 )
 
 // Config contains the server (the webhook) cert and key.
 type certConfig struct {
 	CertFile string
 	KeyFile  string
+
+	SelfManaged    bool
+	Secret         string
+	Service        string
+	WebhookConfigs string
+	RotateBefore   time.Duration
+
+	ClientAuth     bool
+	ClientCAFile   string
+	ClientSubjects string
 }
 
 func (c *certConfig) addFlags() {
 	flag.StringVar(&configFile, "config-file", "", "path to hostAliases configuration config file")
+	flag.StringVar(&configMap, "configmap", "", "namespace/name of the hostAliases configuration configmap, watched instead of the config file")
+	flag.BoolVar(&cacheRoutes, "cacheroutes", false, "watch CacheRoute resources for hostAliases configuration")
+	flag.BoolVar(&holdJobs, "hold-for-prefetch", false, "suspend jobs until the DatasetPrefetch they reference is complete")
+	flag.IntVar(&localityWeight, "locality-weight", 0, "weight of the preferred node affinity to nodes caching the workload's dataset, 0 disables it")
+	flag.StringVar(&dnsServer, "dns-server", "", "address of the Nezha nameserver the pods matching a DNS entry are pointed to, DNS entries are not injected when empty")
+	flag.StringVar(&clusterDomain, "cluster-domain", "cluster.local", "cluster domain kept in the DNS search domains of the pods pointed to -dns-server")
+	flag.StringVar(&nativeSidecars, "native-sidecars", "auto", "inject the sidecar of jobs as a native sidecar, an init container with restartPolicy Always: true, false for a regular container, or auto when the API server is Kubernetes 1.29 or later")
+	flag.StringVar(&clusterCIDRs, "cluster-cidrs", "", "comma separated pod and service CIDRs, added to the NO_PROXY of the config entries with a forward proxy, the pod CIDRs of the nodes and the kubernetes Service address when empty")
+	flag.Int64Var(&maxRequestBytes, "max-request-bytes", 3*1024*1024, "maximum size of an AdmissionReview request")
+	flag.DurationVar(&requestTimeout, "request-timeout", 4*time.Second, "time to review a request before answering according to -deny-on-error, keep it below the timeoutSeconds of the webhook configurations")
+	flag.StringVar(&denyOnErrorPaths, "deny-on-error", "/validate-configmap,/validate-cacheroute", "comma separated webhook paths that reject requests they fail to review, the other webhooks admit them unchanged")
+	flag.BoolVar(&c.SelfManaged, "self-managed-certs", false, "generate the CA and serving certificate into -cert-secret, rotate them and patch the caBundle of -webhook-configs, instead of loading -tls-cert-file")
+	flag.StringVar(&c.Secret, "cert-secret", "default/hostaliases-injector-webhook-certs", "namespace/name of the Secret holding the self-managed certificates")
+	flag.StringVar(&c.Service, "service", "hostaliases-injector-webhook-svc", "name of the webhook Service in the namespace of -cert-secret, the self-managed certificate is issued for")
+	flag.StringVar(&c.WebhookConfigs, "webhook-configs", "hostaliases-webhook-cfg-dp,hostaliases-webhook-cfg-job,hostaliases-webhook-cfg-pod,hostaliases-webhook-cfg-validate", "comma separated webhook configurations whose caBundle is patched with the self-managed CA")
+	flag.DurationVar(&c.RotateBefore, "cert-rotate-before", 30*24*time.Hour, "renew the self-managed serving certificate this long before it expires")
+	flag.BoolVar(&c.ClientAuth, "client-auth", false, "require a client certificate signed by -client-ca-file, so that only the API server can call the webhooks")
+	flag.StringVar(&c.ClientCAFile, "client-ca-file", "", "CA bundle verifying client certificates, the client-ca-file of the kube-system/extension-apiserver-authentication ConfigMap when empty")
+	flag.StringVar(&c.ClientSubjects, "client-allowed-subjects", "", "comma separated common names of the allowed client certificates, any verified certificate when empty")
+	flag.StringVar(&listenAddr, "listen-addr", ":443", "address of the HTTPS webhook server")
+	flag.StringVar(&healthAddr, "health-addr", ":8081", "address of the plain HTTP /healthz and /readyz endpoints, empty disables them")
+	flag.DurationVar(&shutdownDelay, "shutdown-delay", 5*time.Second, "time between failing readiness on SIGTERM and draining the servers, for the Service to stop sending requests")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "maximum time to drain the requests in flight on shutdown")
+	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "address of the plain HTTP /metrics endpoint, empty disables it")
+	flag.StringVar(&kubeConfig, "kubeconfig", "", "Absolute path to the kubeconfig")
+	flag.StringVar(&kubeMaster, "kubemaster", "", "Kubernetes Controller Master URL")
 	flag.StringVar(&c.CertFile, "tls-cert-file", c.CertFile, ""+
 		"File containing the default x509 Certificate for HTTPS. (CA cert, if any, concatenated "+
 		"after server cert).")
@@ -47,158 +117,224 @@ func (c *certConfig) addFlags() {
 		"File containing the default x509 private key matching --tls-cert-file.")
 }
 
-func toAdmissionResponse(err error) *v1beta1.AdmissionResponse {
+// supportsNativeSidecars tells whether the API server is Kubernetes 1.29 or
+// later, which runs init containers with restartPolicy Always as sidecars.
+func supportsNativeSidecars(client discovery.ServerVersionInterface) (bool, error) {
+	info, err := client.ServerVersion()
+	if err != nil {
+		return false, err
+	}
+	major, err := strconv.Atoi(strings.TrimSuffix(info.Major, "+"))
+	if err != nil {
+		return false, fmt.Errorf("invalid server version %s: %v", info.GitVersion, err)
+	}
+	minor, err := strconv.Atoi(strings.TrimSuffix(info.Minor, "+"))
+	if err != nil {
+		return false, fmt.Errorf("invalid server version %s: %v", info.GitVersion, err)
+	}
+	native := major > 1 || major == 1 && minor >= 29
+	glog.Infof("API server version %s, native sidecars %v", info.GitVersion, native)
+	return native, nil
+}
+
+// toAdmissionResponse answers a request that could not be reviewed. Unless
+// denyOnError is set, the object is admitted unchanged.
+func toAdmissionResponse(err error, denyOnError bool) *v1beta1.AdmissionResponse {
+	if !denyOnError {
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("admitted unchanged: %v", err),
+			},
+		}
+	}
 	return &v1beta1.AdmissionResponse{
+		Allowed: false,
 		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
 			Message: err.Error(),
+			Reason:  metav1.StatusReasonInternalError,
+			Code:    http.StatusInternalServerError,
 		},
 	}
 }
 
-func configTLS(config certConfig) *tls.Config {
-	sCert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+func configTLS(config certConfig, reloader *certs.Reloader) *tls.Config {
+	tlsConfig := &tls.Config{
+		// certificates are reloaded without a restart
+		GetCertificate: reloader.GetCertificate,
+	}
+	if !config.ClientAuth {
+		return tlsConfig
+	}
+	bundle, err := certs.LoadClientCA(controller.GetClient(kubeMaster, kubeConfig), config.ClientCAFile)
+	if err != nil {
+		glog.Fatalf("failed to load client CA: %v", err)
+	}
+	pool, err := certs.NewPool(bundle)
 	if err != nil {
-		glog.Fatal(err)
+		glog.Fatalf("failed to load client CA: %v", err)
 	}
-	return &tls.Config{
-		Certificates: []tls.Certificate{sCert},
-		// TODO: uses mutual tls after we agree on what cert the apiserver should use.
-		// ClientAuth:   tls.RequireAndVerifyClientCert,
+	var subjects []string
+	if len(config.ClientSubjects) > 0 {
+		subjects = strings.Split(config.ClientSubjects, ",")
 	}
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.ClientCAs = pool
+	tlsConfig.VerifyPeerCertificate = certs.VerifySubject(subjects)
+	return tlsConfig
 }
 
-func mutateDeployments(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	glog.V(2).Info("mutating deployments")
-	dpResource := metav1.GroupVersionResource{Group: "extensions", Version: "v1beta1", Resource: "deployments"}
-	if ar.Request.Resource != dpResource {
-		glog.Errorf("expect resource to be %s", dpResource)
-		return nil
-	}
+// reviewVersions are the AdmissionReview versions the webhook speaks. Both
+// share the same schema and are handled with the v1beta1 types.
+var reviewVersions = map[string]bool{
+	"admission.k8s.io/v1":      true,
+	"admission.k8s.io/v1beta1": true,
+}
 
-	raw := ar.Request.Object.Raw
-	dp := extensions.Deployment{}
-	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(raw, nil, &dp); err != nil {
-		glog.Error(err)
-		return toAdmissionResponse(err)
-	}
-	reviewResponse := v1beta1.AdmissionResponse{}
-	reviewResponse.Allowed = true
-	if labels := dp.ObjectMeta.GetLabels(); len(labels) > 0 {
-		glog.V(5).Infof("labels %v", labels)
-		for k, v := range labels {
-			aliases := controller.GetAliasesByKV(k, v, *hostAliasConf)
-			if len(aliases) > 0 {
-				spec := dp.Spec.Template.Spec
-				if len(spec.HostAliases) > 0 {
-					aliases = append(spec.HostAliases, aliases...)
-				}
-				glog.V(5).Infof("k: %v, v: %v, hosts %v", k, v, aliases)
-				js, err := json.Marshal(aliases)
-				if err == nil {
-					patch := fmt.Sprintf(addHostAliasesPatch, js)
-					glog.V(5).Infof("patch %s", patch)
-					reviewResponse.Patch = []byte(patch)
-					pt := v1beta1.PatchTypeJSONPatch
-					reviewResponse.PatchType = &pt
-				}
-			}
-		}
+// reviewVersion returns the version of an AdmissionReview, older API servers
+// may leave it empty.
+func reviewVersion(apiVersion string) string {
+	if len(apiVersion) == 0 {
+		return v1beta1.SchemeGroupVersion.String()
 	}
-	return &reviewResponse
+	return apiVersion
 }
 
-func mutateJobs(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	glog.V(2).Info("mutating jobs")
-	jobResource := metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
-	if ar.Request.Resource != jobResource {
-		glog.Errorf("expect resource to be %s", jobResource)
-		return nil
-	}
+// admitFunc reviews a request. An error means the request could not be
+// reviewed, it is answered according to the error policy of the webhook.
+type admitFunc func(v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error)
 
-	raw := ar.Request.Object.Raw
-	job := batch.Job{}
-	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(raw, nil, &job); err != nil {
-		glog.Error(err)
-		return toAdmissionResponse(err)
-	}
-	reviewResponse := v1beta1.AdmissionResponse{}
-	reviewResponse.Allowed = true
-	if labels := job.ObjectMeta.GetLabels(); len(labels) > 0 {
-		glog.V(5).Infof("labels %v", labels)
-		for k, v := range labels {
-			aliases := controller.GetAliasesByKV(k, v, *hostAliasConf)
-			if len(aliases) > 0 {
-				spec := job.Spec.Template.Spec
-				if len(spec.HostAliases) > 0 {
-					aliases = append(spec.HostAliases, aliases...)
-				}
-				glog.V(5).Infof("k: %v, v: %v, hosts %v", k, v, aliases)
-				js, err := json.Marshal(aliases)
-				if err == nil {
-					patch := fmt.Sprintf(addHostAliasesPatch, js)
-					glog.V(5).Infof("patch %s", patch)
-					reviewResponse.Patch = []byte(patch)
-					pt := v1beta1.PatchTypeJSONPatch
-					reviewResponse.PatchType = &pt
-				}
-			}
-		}
-	}
-	return &reviewResponse
+// webhooks are the admitFuncs served by path.
+var webhooks = map[string]admitFunc{
+	"/mutate-deployment":   admitter.MutateDeployments,
+	"/mutate-job":          admitter.MutateJobs,
+	"/mutate-pod":          admitter.MutatePods,
+	"/mutate-tfjob":        admitter.MutateTFJobs,
+	"/validate-configmap":  admitter.ValidateConfigMaps,
+	"/validate-cacheroute": admitter.ValidateCacheRoutes,
 }
 
-type admitFunc func(v1beta1.AdmissionReview) *v1beta1.AdmissionResponse
-
-func serveMutateDeployments(w http.ResponseWriter, r *http.Request) {
-	serve(w, r, mutateDeployments)
+func admitHandler(admit admitFunc, denyOnError bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serve(w, r, admit, denyOnError)
+	}
 }
 
-func serveMutateJobs(w http.ResponseWriter, r *http.Request) {
-	serve(w, r, mutateJobs)
+// review runs admit within the request timeout and turns its panics into
+// errors.
+func review(admit admitFunc, ar v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error) {
+	type result struct {
+		response *v1beta1.AdmissionResponse
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				glog.Errorf("panic reviewing %s %s/%s: %v\n%s", ar.Request.Kind.Kind, ar.Request.Namespace, ar.Request.Name, r, debug.Stack())
+				done <- result{err: fmt.Errorf("internal error: %v", r)}
+			}
+		}()
+		response, err := admit(ar)
+		done <- result{response, err}
+	}()
+	timer := time.NewTimer(requestTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.response, res.err
+	case <-timer.C:
+		return nil, fmt.Errorf("review timed out after %v", requestTimeout)
+	}
 }
 
-func serve(w http.ResponseWriter, r *http.Request, admit admitFunc) {
-	var body []byte
-	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
+func serve(w http.ResponseWriter, r *http.Request, admit admitFunc, denyOnError bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			glog.Errorf("panic serving %s: %v\n%s", r.URL.Path, err, debug.Stack())
+			http.Error(w, "internal error", http.StatusInternalServerError)
 		}
-	}
+	}()
 
+	if r.Method != http.MethodPost {
+		http.Error(w, "expect POST", http.StatusMethodNotAllowed)
+		admissionRequests.Inc(r.URL.Path, "", "", resultBadRequest)
+		return
+	}
 	// verify the content type is accurate
 	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
 		glog.Errorf("contentType=%s, expect application/json", contentType)
+		http.Error(w, fmt.Sprintf("unsupported content type %q, expect application/json", contentType), http.StatusUnsupportedMediaType)
+		admissionRequests.Inc(r.URL.Path, "", "", resultBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBytes+1))
+	if err != nil {
+		glog.Errorf("failed to read request: %v", err)
+		http.Error(w, fmt.Sprintf("failed to read request: %v", err), http.StatusBadRequest)
+		admissionRequests.Inc(r.URL.Path, "", "", resultBadRequest)
+		return
+	}
+	if int64(len(body)) > maxRequestBytes {
+		glog.Errorf("request larger than %d bytes", maxRequestBytes)
+		http.Error(w, fmt.Sprintf("request larger than %d bytes", maxRequestBytes), http.StatusRequestEntityTooLarge)
+		admissionRequests.Inc(r.URL.Path, "", "", resultBadRequest)
 		return
 	}
 
 	glog.V(2).Info(fmt.Sprintf("handling request: %s", string(body)))
-	var reviewResponse *v1beta1.AdmissionResponse
 	ar := v1beta1.AdmissionReview{}
 	deserializer := codecs.UniversalDeserializer()
 	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
-		glog.Error(err)
-		reviewResponse = toAdmissionResponse(err)
+		glog.Errorf("failed to decode AdmissionReview: %v", err)
+		http.Error(w, fmt.Sprintf("failed to decode AdmissionReview: %v", err), http.StatusBadRequest)
+		admissionRequests.Inc(r.URL.Path, "", "", resultBadRequest)
+		return
+	}
+	if !reviewVersions[reviewVersion(ar.APIVersion)] {
+		glog.Errorf("unsupported AdmissionReview version %s", ar.APIVersion)
+		http.Error(w, fmt.Sprintf("unsupported AdmissionReview version %s", ar.APIVersion), http.StatusBadRequest)
+		admissionRequests.Inc(r.URL.Path, "", "", resultBadRequest)
+		return
+	}
+	if ar.Request == nil {
+		http.Error(w, "AdmissionReview has no request", http.StatusBadRequest)
+		admissionRequests.Inc(r.URL.Path, "", "", resultBadRequest)
+		return
+	}
+
+	start := time.Now()
+	reviewResponse, err := review(admit, ar)
+	admissionDuration.Observe(time.Since(start).Seconds(), r.URL.Path)
+	if err == nil && reviewResponse == nil {
+		err = fmt.Errorf("no response")
+	}
+	result := resultError
+	if err != nil {
+		glog.Errorf("failed to review %s %s/%s: %v", ar.Request.Kind.Kind, ar.Request.Namespace, ar.Request.Name, err)
+		reviewResponse = toAdmissionResponse(err, denyOnError)
 	} else {
-		reviewResponse = admit(ar)
+		result = responseResult(reviewResponse)
 	}
+	admissionRequests.Inc(r.URL.Path, ar.Request.Resource.Resource, string(ar.Request.Operation), result)
 	glog.V(2).Info(fmt.Sprintf("sending response: %v", reviewResponse))
 
+	// answer in the version of the request, v1 requires apiVersion and kind
 	response := v1beta1.AdmissionReview{}
-	if reviewResponse != nil {
-		response.Response = reviewResponse
-		response.Response.UID = ar.Request.UID
-	}
-	// reset the Object and OldObject, they are not needed in a response.
-	ar.Request.Object = runtime.RawExtension{}
-	ar.Request.OldObject = runtime.RawExtension{}
+	response.APIVersion = reviewVersion(ar.APIVersion)
+	response.Kind = "AdmissionReview"
+	response.Response = reviewResponse
+	response.Response.UID = ar.Request.UID
 
 	resp, err := json.Marshal(response)
 	if err != nil {
 		glog.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	if _, err := w.Write(resp); err != nil {
 		glog.Error(err)
 	}
@@ -206,39 +342,118 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitFunc) {
 
 func main() {
 	var certConfig certConfig
-	var err error
 	certConfig.addFlags()
 	flag.Parse()
 	flag.Set("logtostderr", "true")
-	if len(configFile) == 0 {
+	if localityWeight < 0 || localityWeight > 100 {
+		glog.Fatalf("locality weight must be between 0 and 100")
+	}
+	denyOnError = map[string]bool{}
+	for _, path := range strings.Split(denyOnErrorPaths, ",") {
+		if path = strings.TrimSpace(path); len(path) == 0 {
+			continue
+		}
+		if _, ok := webhooks[path]; !ok {
+			glog.Fatalf("unknown webhook %s in -deny-on-error", path)
+		}
+		denyOnError[path] = true
+	}
+	if len(configFile) == 0 && len(configMap) == 0 && !cacheRoutes {
 		glog.Fatalf("hostAliases config file is empty")
 	}
-	hostAliasConf, err = controller.FileToConfig(configFile)
+	noProxy, err := controller.ParseCIDRs(clusterCIDRs)
 	if err != nil {
-		glog.Fatalf("failed to parse config file: %v", err)
+		glog.Fatalf("invalid -cluster-cidrs: %v", err)
+	}
+	if len(noProxy) == 0 {
+		if noProxy, err = controller.DetectClusterCIDRs(controller.GetClient(kubeMaster, kubeConfig)); err != nil {
+			glog.Errorf("NO_PROXY of the config entries lacks the cluster CIDRs, set -cluster-cidrs: %v", err)
+		} else {
+			glog.Infof("detected cluster CIDRs %s", strings.Join(noProxy, ","))
+		}
+	}
+	admitter.LocalityWeight = int32(localityWeight)
+	admitter.NoProxy = noProxy
+	admitter.DNSServer = dnsServer
+	admitter.ClusterDomain = clusterDomain
+	switch nativeSidecars {
+	case "true", "false":
+		admitter.NativeSidecars = nativeSidecars == "true"
+	case "auto":
+		native, err := supportsNativeSidecars(controller.GetClient(kubeMaster, kubeConfig).Discovery())
+		if err != nil {
+			glog.Warningf("injecting regular sidecars into jobs: %v", err)
+		}
+		admitter.NativeSidecars = native
+	default:
+		glog.Fatalf("invalid -native-sidecars %s", nativeSidecars)
+	}
+	stop := make(chan struct{})
+	if cacheRoutes || holdJobs {
+		nezhaClient, err := client.NewForConfig(controller.GetClusterConfig(kubeMaster, kubeConfig))
+		if err != nil {
+			glog.Fatalf("failed to create nezha client: %v", err)
+		}
+		if cacheRoutes {
+			routeCtrl = controller.NewCacheRouteController(nezhaClient, controller.GetClient(kubeMaster, kubeConfig))
+			admitter.Routes = routeCtrl
+			go routeCtrl.Run(stop)
+		}
+		if holdJobs {
+			prefetches = controller.NewDatasetPrefetchInformer(nezhaClient, "")
+			admitter.Prefetches = prefetches.GetStore()
+			go prefetches.Run(stop)
+		}
 	}
 
-	tickChan := time.NewTicker(time.Second * 10).C
-	go func() {
-		for {
-			select {
-			case <-tickChan:
-				newConfig, err := controller.FileToConfig(configFile)
-				if err == nil {
-					hostAliasConf = newConfig
-				} else {
-					glog.Warningf("invalid config: %v", err)
-				}
-			}
+	switch {
+	case len(configMap) > 0:
+		parts := strings.SplitN(configMap, "/", 2)
+		if len(parts) != 2 {
+			glog.Fatalf("configmap must be namespace/name")
 		}
-	}()
+		informer := controller.NewConfigMapInformer(controller.GetClient(kubeMaster, kubeConfig), parts[0], parts[1], configStore)
+		go informer.Run(stop)
+		if !cache.WaitForCacheSync(stop, informer.HasSynced) || !configStore.Loaded() {
+			glog.Warningf("no valid config in configmap %s yet", configMap)
+		}
+	case len(configFile) > 0:
+		if err := controller.LoadConfigFile(configFile, configStore); err != nil {
+			glog.Fatalf("failed to parse config file: %v", err)
+		}
+		go controller.WatchConfigFile(configFile, 10*time.Second, configStore, stop)
+	}
+
+	reloader := certs.NewReloader()
+	if certConfig.SelfManaged {
+		parts := strings.SplitN(certConfig.Secret, "/", 2)
+		if len(parts) != 2 {
+			glog.Fatalf("cert-secret must be namespace/name")
+		}
+		manager := certs.NewSecretManager(controller.GetClient(kubeMaster, kubeConfig), parts[0], parts[1], certConfig.Service,
+			strings.Split(certConfig.WebhookConfigs, ","), certConfig.RotateBefore, reloader)
+		if err := manager.Sync(); err != nil {
+			glog.Fatalf("failed to set up self-managed certificates: %v", err)
+		}
+		go manager.Run(time.Minute, stop)
+	} else {
+		if err := reloader.LoadFiles(certConfig.CertFile, certConfig.KeyFile); err != nil {
+			glog.Fatalf("failed to load serving certificate: %v", err)
+		}
+		go reloader.WatchFiles(certConfig.CertFile, certConfig.KeyFile, 10*time.Second, stop)
+	}
 
-	http.HandleFunc("/mutate-deployment", serveMutateDeployments)
-	http.HandleFunc("/mutate-job", serveMutateJobs)
+	registerMetrics(reloader)
+	for path, admit := range webhooks {
+		http.HandleFunc(path, admitHandler(admit, denyOnError[path]))
+	}
 	server := &http.Server{
-		Addr:      ":443",
-		TLSConfig: configTLS(certConfig),
+		Addr:              listenAddr,
+		TLSConfig:         configTLS(certConfig, reloader),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       requestTimeout + 10*time.Second,
+		WriteTimeout:      requestTimeout + 10*time.Second,
+		IdleTimeout:       90 * time.Second,
 	}
-	glog.Infof("starting server")
-	server.ListenAndServeTLS("", "")
+	run(server, plainServers(reloader), stop)
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServe(t *testing.T) {
+	maxRequestBytes = 1 << 20
+	requestTimeout = 100 * time.Millisecond
+	release := make(chan struct{})
+	defer close(release)
+
+	review := `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"42","resource":{"resource":"pods"},"operation":"CREATE"}}`
+	allow := func(v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error) {
+		return &v1beta1.AdmissionResponse{Allowed: true}, nil
+	}
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		admit       admitFunc
+		denyOnError bool
+		wantCode    int
+		wantAllowed bool
+		wantResult  string
+	}{
+		{name: "allowed", body: review, admit: allow, wantCode: http.StatusOK, wantAllowed: true, wantResult: resultAllowed},
+		{
+			name: "patched",
+			body: review,
+			admit: func(v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error) {
+				return &v1beta1.AdmissionResponse{Allowed: true, Patch: []byte("[]")}, nil
+			},
+			wantCode:    http.StatusOK,
+			wantAllowed: true,
+			wantResult:  resultPatched,
+		},
+		{
+			name: "error admits unchanged",
+			body: review,
+			admit: func(v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error) {
+				return nil, fmt.Errorf("config not loaded")
+			},
+			wantCode:    http.StatusOK,
+			wantAllowed: true,
+			wantResult:  resultError,
+		},
+		{
+			name: "error denies",
+			body: review,
+			admit: func(v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error) {
+				return nil, fmt.Errorf("config not loaded")
+			},
+			denyOnError: true,
+			wantCode:    http.StatusOK,
+			wantResult:  resultError,
+		},
+		{
+			name: "panic",
+			body: review,
+			admit: func(v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error) {
+				panic("nil map")
+			},
+			denyOnError: true,
+			wantCode:    http.StatusOK,
+			wantResult:  resultError,
+		},
+		{
+			name: "timeout",
+			body: review,
+			admit: func(v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error) {
+				<-release
+				return &v1beta1.AdmissionResponse{Allowed: true}, nil
+			},
+			wantCode:    http.StatusOK,
+			wantAllowed: true,
+			wantResult:  resultError,
+		},
+		{
+			name: "no response",
+			body: review,
+			admit: func(v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error) {
+				return nil, nil
+			},
+			denyOnError: true,
+			wantCode:    http.StatusOK,
+			wantResult:  resultError,
+		},
+		{name: "get", method: "GET", admit: allow, wantCode: http.StatusMethodNotAllowed, wantResult: resultBadRequest},
+		{name: "content type", contentType: "text/plain", body: review, admit: allow, wantCode: http.StatusUnsupportedMediaType, wantResult: resultBadRequest},
+		{name: "too large", body: strings.Repeat(" ", 1<<20+1), admit: allow, wantCode: http.StatusRequestEntityTooLarge, wantResult: resultBadRequest},
+		{name: "not json", body: "{", admit: allow, wantCode: http.StatusBadRequest, wantResult: resultBadRequest},
+		{
+			name:       "unsupported version",
+			body:       strings.Replace(review, "admission.k8s.io/v1", "admission.k8s.io/v2", 1),
+			admit:      allow,
+			wantCode:   http.StatusBadRequest,
+			wantResult: resultBadRequest,
+		},
+		{
+			name:       "no request",
+			body:       `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview"}`,
+			admit:      allow,
+			wantCode:   http.StatusBadRequest,
+			wantResult: resultBadRequest,
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method, contentType := test.method, test.contentType
+			if len(method) == 0 {
+				method = "POST"
+			}
+			if len(contentType) == 0 {
+				contentType = "application/json; charset=utf-8"
+			}
+			// a path per test, to tell its requests apart in the metrics
+			path := fmt.Sprintf("/test-%d", i)
+			req := httptest.NewRequest(method, path, strings.NewReader(test.body))
+			req.Header.Set("Content-Type", contentType)
+			w := httptest.NewRecorder()
+			admitHandler(test.admit, test.denyOnError).ServeHTTP(w, req)
+			if w.Code != test.wantCode {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if w.Code == http.StatusOK {
+				var response v1beta1.AdmissionReview
+				if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+					t.Fatal(err)
+				}
+				if response.APIVersion != "admission.k8s.io/v1" || response.Kind != "AdmissionReview" {
+					t.Errorf("answered as %s %s", response.APIVersion, response.Kind)
+				}
+				if response.Response.UID != "42" || response.Response.Allowed != test.wantAllowed {
+					t.Errorf("response %+v, want uid 42 and allowed %v", response.Response, test.wantAllowed)
+				}
+				if !test.wantAllowed && response.Response.Result.Code != http.StatusInternalServerError {
+					t.Errorf("denied with %+v", response.Response.Result)
+				}
+			}
+			resource, operation := "", ""
+			if test.wantResult != resultBadRequest {
+				resource, operation = "pods", "CREATE"
+			}
+			want := fmt.Sprintf(`nezha_webhook_admission_requests_total{webhook="%s",resource="%s",operation="%s",result="%s"} 1`,
+				path, resource, operation, test.wantResult)
+			metrics := httptest.NewRecorder()
+			registry.ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+			if !strings.Contains(metrics.Body.String(), want+"\n") {
+				t.Errorf("metrics miss %s", want)
+			}
+		})
+	}
+}
+
+func TestToAdmissionResponse(t *testing.T) {
+	err := fmt.Errorf("boom")
+	if r := toAdmissionResponse(err, false); !r.Allowed || r.Result.Message != "admitted unchanged: boom" {
+		t.Errorf("admitted %+v", r)
+	}
+	want := &metav1.Status{Status: metav1.StatusFailure, Message: "boom", Reason: metav1.StatusReasonInternalError, Code: http.StatusInternalServerError}
+	if r := toAdmissionResponse(err, true); r.Allowed || *r.Result != *want {
+		t.Errorf("denied %+v", r)
+	}
+}
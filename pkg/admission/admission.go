@@ -0,0 +1,297 @@
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+
+	"github.com/fast-ml/nezha/pkg/apis/nezha/v1alpha1"
+	"github.com/fast-ml/nezha/pkg/controller"
+	"k8s.io/api/admission/v1beta1"
+	batch "k8s.io/api/batch/v1"
+	coreV1 "k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/tools/cache"
+)
+
+var deserializer = serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
+
+// RouteSource provides the configs of the CacheRoutes, see
+// controller.CacheRouteController.
+type RouteSource interface {
+	Configs(resource string) []controller.Config
+	RecordInjection(name string)
+}
+
+// Admitter reviews the admission requests of the Nezha webhooks. It is
+// shared by the webhook server and nezhactl.
+type Admitter struct {
+	// Configs returns the current hostaliases config.
+	Configs func() []controller.Config
+	// Routes provides CacheRoute configs when set.
+	Routes RouteSource
+	// Prefetches holds the DatasetPrefetches jobs are held for when set.
+	Prefetches cache.Store
+	// LocalityWeight of the preferred affinity to dataset nodes, 0 disables
+	// locality hints.
+	LocalityWeight int32
+	// NoProxy lists the cluster CIDRs and other destinations reached
+	// without the forward proxy of a config entry.
+	NoProxy []string
+	// DNSServer is the address of the Nezha nameserver the pods matching a
+	// DNS entry are pointed to. DNS entries are not injected without it.
+	DNSServer string
+	// ClusterDomain is kept in the search domains of those pods.
+	ClusterDomain string
+	// NativeSidecars injects the sidecar of jobs as an init container with
+	// restartPolicy Always, which needs Kubernetes 1.29. Otherwise it is a
+	// regular container and the job runs until the sidecar exits.
+	NativeSidecars bool
+	// OnPatch is called when the host aliases of config are set on an
+	// object of resource.
+	OnPatch func(config, resource string)
+}
+
+func (a *Admitter) patched(config, resource string) {
+	if a.OnPatch != nil {
+		a.OnPatch(config, resource)
+	}
+}
+
+// Admit reviews ar with the webhook of its resource.
+func (a *Admitter) Admit(ar v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error) {
+	switch ar.Request.Resource.Resource {
+	case "deployments":
+		return a.MutateDeployments(ar)
+	case "jobs":
+		return a.MutateJobs(ar)
+	case "pods":
+		return a.MutatePods(ar)
+	case "tfjobs":
+		return a.MutateTFJobs(ar)
+	case "configmaps":
+		return a.ValidateConfigMaps(ar)
+	case "cacheroutes":
+		return a.ValidateCacheRoutes(ar)
+	}
+	return nil, fmt.Errorf("no webhook for resource %s", ar.Request.Resource)
+}
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+func setPatch(reviewResponse *v1beta1.AdmissionResponse, patches []patchOperation) {
+	if len(patches) == 0 {
+		return
+	}
+	js, err := json.Marshal(patches)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	glog.V(5).Infof("patch %s", js)
+	reviewResponse.Patch = js
+	pt := v1beta1.PatchTypeJSONPatch
+	reviewResponse.PatchType = &pt
+}
+
+// denyResponse rejects an object that failed validation.
+func denyResponse(err error) *v1beta1.AdmissionResponse {
+	return &v1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: err.Error(),
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		},
+	}
+}
+
+func (a *Admitter) MutateDeployments(ar v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error) {
+	glog.V(2).Info("mutating deployments")
+	dpResource := metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	legacyResource := metav1.GroupVersionResource{Group: "extensions", Version: "v1beta1", Resource: "deployments"}
+	if ar.Request.Resource != dpResource && ar.Request.Resource != legacyResource {
+		return nil, fmt.Errorf("expect resource to be %s or %s", dpResource, legacyResource)
+	}
+
+	dp := extensions.Deployment{}
+	if _, _, err := deserializer.Decode(ar.Request.Object.Raw, nil, &dp); err != nil {
+		return nil, err
+	}
+	reviewResponse := v1beta1.AdmissionResponse{}
+	reviewResponse.Allowed = true
+	patches := a.injectionPatches(dpResource.Resource, ar.Request.Namespace, dp.ObjectMeta, &dp.Spec.Template)
+	patches = append(patches, a.localityHints("/spec/template/spec", dp.ObjectMeta, dp.Spec.Template.ObjectMeta, &dp.Spec.Template.Spec)...)
+	setPatch(&reviewResponse, patches)
+	return &reviewResponse, nil
+}
+
+func (a *Admitter) MutateJobs(ar v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error) {
+	glog.V(2).Info("mutating jobs")
+	jobResource := metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+	if ar.Request.Resource != jobResource {
+		return nil, fmt.Errorf("expect resource to be %s", jobResource)
+	}
+
+	job := batch.Job{}
+	if _, _, err := deserializer.Decode(ar.Request.Object.Raw, nil, &job); err != nil {
+		return nil, err
+	}
+	reviewResponse := v1beta1.AdmissionResponse{}
+	reviewResponse.Allowed = true
+	// the pod template of a job is immutable
+	if ar.Request.Operation != v1beta1.Create {
+		return &reviewResponse, nil
+	}
+	patches := a.injectionPatches(jobResource.Resource, ar.Request.Namespace, job.ObjectMeta, &job.Spec.Template)
+	patches = append(patches, a.holdForPrefetch(ar.Request.Namespace, &job)...)
+	patches = append(patches, a.localityHints("/spec/template/spec", job.ObjectMeta, job.Spec.Template.ObjectMeta, &job.Spec.Template.Spec)...)
+	setPatch(&reviewResponse, patches)
+	return &reviewResponse, nil
+}
+
+// tfJob is the part of a Kubeflow TFJob the webhook reads.
+type tfJob struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              struct {
+		RunPolicy *struct{} `json:"runPolicy,omitempty"`
+	} `json:"spec"`
+}
+
+// MutateTFJobs holds Kubeflow TFJobs for their DatasetPrefetch with the
+// runPolicy.suspend of the training operator 1.7.
+func (a *Admitter) MutateTFJobs(ar v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error) {
+	glog.V(2).Info("mutating tfjobs")
+	tfJobResource := metav1.GroupVersionResource{Group: "kubeflow.org", Version: "v1", Resource: "tfjobs"}
+	if ar.Request.Resource != tfJobResource {
+		return nil, fmt.Errorf("expect resource to be %s", tfJobResource)
+	}
+
+	job := tfJob{}
+	if err := json.Unmarshal(ar.Request.Object.Raw, &job); err != nil {
+		return nil, err
+	}
+	reviewResponse := v1beta1.AdmissionResponse{}
+	reviewResponse.Allowed = true
+	if ar.Request.Operation != v1beta1.Create {
+		return &reviewResponse, nil
+	}
+	name := a.heldBy(ar.Request.Namespace, "tfjob", job.ObjectMeta)
+	if len(name) == 0 {
+		return &reviewResponse, nil
+	}
+	var patches []patchOperation
+	if job.Spec.RunPolicy == nil {
+		patches = append(patches, patchOperation{Op: "add", Path: "/spec/runPolicy", Value: map[string]bool{"suspend": true}})
+	} else {
+		patches = append(patches, patchOperation{Op: "add", Path: "/spec/runPolicy/suspend", Value: true})
+	}
+	patches = append(patches, metadataPatches("labels", job.GetLabels(), map[string]string{controller.HeldByLabel: name})...)
+	setPatch(&reviewResponse, patches)
+	return &reviewResponse, nil
+}
+
+func (a *Admitter) MutatePods(ar v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error) {
+	glog.V(2).Info("mutating pods")
+	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+	if ar.Request.Resource != podResource {
+		return nil, fmt.Errorf("expect resource to be %s", podResource)
+	}
+
+	pod := coreV1.Pod{}
+	if _, _, err := deserializer.Decode(ar.Request.Object.Raw, nil, &pod); err != nil {
+		return nil, err
+	}
+	reviewResponse := v1beta1.AdmissionResponse{}
+	reviewResponse.Allowed = true
+	labels := pod.ObjectMeta.GetLabels()
+	glog.V(5).Infof("labels %v", labels)
+	// bare pods naming a dataset get the locality hint as well, pods of
+	// mutated deployments and jobs already have it
+	locality := a.localityHints("/spec", pod.ObjectMeta, pod.ObjectMeta, &pod.Spec)
+	name, conf := a.lookupPodConfig(labels)
+	if conf == nil {
+		setPatch(&reviewResponse, locality)
+		return &reviewResponse, nil
+	}
+	// pods of mutated deployments and jobs already have their aliases, env
+	// and DNS config
+	var patches []patchOperation
+	desired := conf.HostAliases()
+	if len(desired) > 0 && !controller.HasAliases(pod.Spec.HostAliases, desired) {
+		aliases := controller.ReplaceAliases(pod.Spec.HostAliases, nil, desired)
+		glog.V(5).Infof("hosts %v", aliases)
+		patches = append(patches, patchOperation{Op: "add", Path: "/spec/hostAliases", Value: aliases})
+	}
+	patches = append(patches, envPatches("/spec", &pod.Spec, nil, a.configEnv(conf))...)
+	_, dnsPatches := a.dnsPatches("/spec", ar.Request.Namespace, &pod.Spec, "", conf)
+	patches = append(patches, dnsPatches...)
+	volumes := newVolumeList("/spec", pod.Spec.Volumes)
+	if containerIndex(pod.Spec.Containers, controller.SidecarName) < 0 && containerIndex(pod.Spec.InitContainers, controller.SidecarName) < 0 {
+		_, sidecarPatches := sidecarPatches("/spec", &pod.Spec, volumes, "", conf, false)
+		patches = append(patches, sidecarPatches...)
+	}
+	var missing []controller.DatasetVolume
+	for _, v := range conf.Volumes {
+		if volumeIndex(pod.Spec.Volumes, v.Name) < 0 {
+			missing = append(missing, v)
+		}
+	}
+	_, mountPatches := volumePatches("/spec", &pod.Spec, volumes, nil, missing)
+	patches = append(patches, mountPatches...)
+	patches = append(patches, volumes.patches()...)
+	if len(patches) > 0 {
+		a.patched(name, podResource.Resource)
+	}
+	setPatch(&reviewResponse, append(patches, locality...))
+	return &reviewResponse, nil
+}
+
+func (a *Admitter) ValidateConfigMaps(ar v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error) {
+	glog.V(2).Info("validating configmaps")
+	cmResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "configmaps"}
+	if ar.Request.Resource != cmResource {
+		return nil, fmt.Errorf("expect resource to be %s", cmResource)
+	}
+
+	cm := coreV1.ConfigMap{}
+	if _, _, err := deserializer.Decode(ar.Request.Object.Raw, nil, &cm); err != nil {
+		return nil, err
+	}
+	if cm.ObjectMeta.GetLabels()[controller.ConfigLabel] != "true" {
+		return &v1beta1.AdmissionResponse{Allowed: true}, nil
+	}
+	if _, err := controller.ConfigMapToConfig(&cm); err != nil {
+		glog.V(2).Infof("rejecting configmap %s/%s: %v", ar.Request.Namespace, cm.Name, err)
+		return denyResponse(fmt.Errorf("invalid hostaliases config: %v", err)), nil
+	}
+	return &v1beta1.AdmissionResponse{Allowed: true}, nil
+}
+
+func (a *Admitter) ValidateCacheRoutes(ar v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, error) {
+	glog.V(2).Info("validating cacheroutes")
+	routeResource := metav1.GroupVersionResource{Group: v1alpha1.GroupName, Version: "v1alpha1", Resource: "cacheroutes"}
+	if ar.Request.Resource != routeResource {
+		return nil, fmt.Errorf("expect resource to be %s", routeResource)
+	}
+
+	route := v1alpha1.CacheRoute{}
+	if err := json.Unmarshal(ar.Request.Object.Raw, &route); err != nil {
+		return nil, err
+	}
+	if errs := controller.ValidateCacheRoute(&route); len(errs) > 0 {
+		glog.V(2).Infof("rejecting cacheroute %s: %v", route.Name, errs)
+		return denyResponse(errs.ToAggregate()), nil
+	}
+	return &v1beta1.AdmissionResponse{Allowed: true}, nil
+}
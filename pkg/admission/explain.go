@@ -0,0 +1,70 @@
+package admission
+
+import (
+	"fmt"
+
+	"github.com/fast-ml/nezha/pkg/controller"
+)
+
+// Match tells whether a config entry applies to an object, and why.
+type Match struct {
+	Config  string
+	Matched bool
+	Reason  string
+}
+
+// Explain returns, for every config entry and CacheRoute, whether it
+// applies to an object of resource with labels.
+func (a *Admitter) Explain(resource string, labels map[string]string) []Match {
+	var selected string
+	if resource == "pods" {
+		if conf := controller.GetPodConfig(labels, a.Configs()); conf != nil && conf.Injects() {
+			selected = conf.Name
+		} else if a.Routes != nil {
+			if conf := controller.GetPodConfig(labels, a.Routes.Configs(resource)); conf != nil {
+				selected = controller.CacheRouteConfigPrefix + conf.Name
+			}
+		}
+	} else {
+		selected, _ = a.matchConfig(resource, labels)
+	}
+
+	var matches []Match
+	for _, conf := range a.Configs() {
+		matches = append(matches, explain(resource, labels, conf.Name, conf, selected))
+	}
+	if a.Routes != nil {
+		for _, conf := range a.Routes.Configs(resource) {
+			name := controller.CacheRouteConfigPrefix + conf.Name
+			matches = append(matches, explain(resource, labels, name, conf, selected))
+		}
+	}
+	return matches
+}
+
+func explain(resource string, labels map[string]string, name string, conf controller.Config, selected string) Match {
+	m := Match{Config: name}
+	key := conf.App
+	if len(key) == 0 {
+		if resource != "pods" {
+			m.Reason = "no app key, only pods are matched by their app label"
+			return m
+		}
+		key = "app"
+	}
+	v, ok := labels[key]
+	switch {
+	case !ok:
+		m.Reason = fmt.Sprintf("no label %s", key)
+	case v != conf.Label:
+		m.Reason = fmt.Sprintf("label %s is %q, not %q", key, v, conf.Label)
+	case !conf.Injects():
+		m.Reason = "nothing to inject"
+	case name != selected:
+		m.Reason = fmt.Sprintf("label %s=%s matches, but %s is used", key, v, selected)
+	default:
+		m.Matched = true
+		m.Reason = fmt.Sprintf("label %s=%s", key, v)
+	}
+	return m
+}
@@ -0,0 +1,119 @@
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ApplyPatch applies the add, replace and remove operations of a JSON patch
+// to a JSON document, which is all the webhooks emit.
+func ApplyPatch(doc, patch []byte) ([]byte, error) {
+	var obj interface{}
+	if err := json.Unmarshal(doc, &obj); err != nil {
+		return nil, err
+	}
+	var ops []patchOperation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, err
+	}
+	for _, op := range ops {
+		var err error
+		if obj, err = applyOperation(obj, op); err != nil {
+			return nil, fmt.Errorf("%s %s: %v", op.Op, op.Path, err)
+		}
+	}
+	return json.Marshal(obj)
+}
+
+func applyOperation(obj interface{}, op patchOperation) (interface{}, error) {
+	if op.Op != "add" && op.Op != "replace" && op.Op != "remove" {
+		return nil, fmt.Errorf("unsupported operation")
+	}
+	if len(op.Path) == 0 || op.Path[0] != '/' {
+		return nil, fmt.Errorf("invalid path")
+	}
+	var tokens []string
+	for _, t := range strings.Split(op.Path[1:], "/") {
+		tokens = append(tokens, strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1))
+	}
+	// round trip the value so that it is made of maps and slices
+	var value interface{}
+	if op.Op != "remove" {
+		js, err := json.Marshal(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(js, &value); err != nil {
+			return nil, err
+		}
+	}
+	return setPath(obj, tokens, op.Op, value)
+}
+
+// setPath returns obj with the operation applied at the path tokens.
+func setPath(obj interface{}, tokens []string, op string, value interface{}) (interface{}, error) {
+	token, last := tokens[0], len(tokens) == 1
+	switch node := obj.(type) {
+	case map[string]interface{}:
+		child, exists := node[token]
+		if last {
+			if op == "remove" {
+				if !exists {
+					return nil, fmt.Errorf("no member %q", token)
+				}
+				delete(node, token)
+			} else {
+				if op == "replace" && !exists {
+					return nil, fmt.Errorf("no member %q", token)
+				}
+				node[token] = value
+			}
+			return node, nil
+		}
+		if !exists {
+			return nil, fmt.Errorf("no member %q", token)
+		}
+		child, err := setPath(child, tokens[1:], op, value)
+		if err != nil {
+			return nil, err
+		}
+		node[token] = child
+		return node, nil
+	case []interface{}:
+		i := len(node)
+		if token != "-" {
+			n, err := strconv.Atoi(token)
+			if err != nil || n < 0 || n > len(node) {
+				return nil, fmt.Errorf("invalid index %q", token)
+			}
+			i = n
+		}
+		if last {
+			switch {
+			case op == "add":
+				node = append(node, nil)
+				copy(node[i+1:], node[i:])
+				node[i] = value
+			case i == len(node):
+				return nil, fmt.Errorf("invalid index %q", token)
+			case op == "replace":
+				node[i] = value
+			default:
+				node = append(node[:i], node[i+1:]...)
+			}
+			return node, nil
+		}
+		if i == len(node) {
+			return nil, fmt.Errorf("invalid index %q", token)
+		}
+		child, err := setPath(node[i], tokens[1:], op, value)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = child
+		return node, nil
+	}
+	return nil, fmt.Errorf("cannot traverse %q", token)
+}
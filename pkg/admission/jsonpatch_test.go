@@ -0,0 +1,86 @@
+package admission
+
+import "testing"
+
+func TestApplyPatch(t *testing.T) {
+	doc := `{"metadata":{"labels":{"app":"web"}},"spec":{"volumes":[{"name":"a"},{"name":"b"}]}}`
+	tests := []struct {
+		name    string
+		patch   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "add member",
+			patch: `[{"op":"add","path":"/metadata/annotations","value":{"nezha.fast-ml.io/env":"[]"}}]`,
+			want:  `{"metadata":{"annotations":{"nezha.fast-ml.io/env":"[]"},"labels":{"app":"web"}},"spec":{"volumes":[{"name":"a"},{"name":"b"}]}}`,
+		},
+		{
+			name:  "escaped path",
+			patch: `[{"op":"add","path":"/metadata/labels/nezha.fast-ml.io~1hash","value":"1"}]`,
+			want:  `{"metadata":{"labels":{"app":"web","nezha.fast-ml.io/hash":"1"}},"spec":{"volumes":[{"name":"a"},{"name":"b"}]}}`,
+		},
+		{
+			name:  "insert and append",
+			patch: `[{"op":"add","path":"/spec/volumes/0","value":{"name":"first"}},{"op":"add","path":"/spec/volumes/-","value":{"name":"last"}}]`,
+			want:  `{"metadata":{"labels":{"app":"web"}},"spec":{"volumes":[{"name":"first"},{"name":"a"},{"name":"b"},{"name":"last"}]}}`,
+		},
+		{
+			name:  "replace and remove",
+			patch: `[{"op":"replace","path":"/spec/volumes/1/name","value":"c"},{"op":"remove","path":"/spec/volumes/0"},{"op":"remove","path":"/metadata/labels"}]`,
+			want:  `{"metadata":{},"spec":{"volumes":[{"name":"c"}]}}`,
+		},
+		{
+			name:    "replace missing member",
+			patch:   `[{"op":"replace","path":"/metadata/name","value":"web"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "remove past the end",
+			patch:   `[{"op":"remove","path":"/spec/volumes/2"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid index",
+			patch:   `[{"op":"add","path":"/spec/volumes/x","value":{}}]`,
+			wantErr: true,
+		},
+		{
+			name:    "missing parent",
+			patch:   `[{"op":"add","path":"/status/phase","value":"Running"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "through a scalar",
+			patch:   `[{"op":"add","path":"/metadata/labels/app/x","value":"y"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "unsupported operation",
+			patch:   `[{"op":"move","path":"/metadata/labels"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "relative path",
+			patch:   `[{"op":"add","path":"metadata","value":{}}]`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ApplyPatch([]byte(doc), []byte(test.patch))
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("ApplyPatch() = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyPatch() failed: %v", err)
+			}
+			if string(got) != test.want {
+				t.Errorf("ApplyPatch() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
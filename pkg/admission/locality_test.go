@@ -0,0 +1,45 @@
+package admission
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fast-ml/nezha/pkg/controller"
+	coreV1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLocalityHints(t *testing.T) {
+	annotated := func(dataset string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: "train", Annotations: map[string]string{controller.DatasetAnnotation: dataset}}
+	}
+	tests := []struct {
+		name        string
+		weight      int32
+		meta        metav1.ObjectMeta
+		podMeta     metav1.ObjectMeta
+		wantDataset string
+	}{
+		{name: "disabled", meta: annotated("cifar")},
+		{name: "no dataset", weight: 50},
+		{name: "workload dataset", weight: 50, meta: annotated("cifar"), wantDataset: "cifar"},
+		{name: "pod dataset wins", weight: 50, meta: annotated("cifar"), podMeta: annotated("imagenet"), wantDataset: "imagenet"},
+		{name: "invalid dataset", weight: 50, meta: annotated("cifar 10")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &Admitter{LocalityWeight: test.weight}
+			patches := a.localityHints("/spec/template/spec", test.meta, test.podMeta, &coreV1.PodSpec{})
+			if len(test.wantDataset) == 0 {
+				if len(patches) > 0 {
+					t.Errorf("patches %+v, want none", patches)
+				}
+				return
+			}
+			want, _ := controller.PreferDatasetNodes(nil, test.wantDataset, test.weight)
+			if len(patches) != 1 || patches[0].Path != "/spec/template/spec/affinity" || !reflect.DeepEqual(patches[0].Value, want) {
+				t.Errorf("patches %+v, want the affinity of %s", patches, test.wantDataset)
+			}
+		})
+	}
+}
@@ -0,0 +1,586 @@
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/fast-ml/nezha/pkg/apis/nezha/v1alpha1"
+	"github.com/fast-ml/nezha/pkg/controller"
+	batch "k8s.io/api/batch/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// lookupConfig returns the config for label k=v, taken from the config file
+// first and from CacheRoutes otherwise, and the name it is recorded under.
+func (a *Admitter) lookupConfig(resource, k, v string) (string, *controller.Config) {
+	if conf := controller.GetConfigByKV(k, v, a.Configs()); conf != nil && conf.Injects() {
+		return conf.Name, conf
+	}
+	if a.Routes != nil {
+		if conf := controller.GetConfigByKV(k, v, a.Routes.Configs(resource)); conf != nil {
+			return controller.CacheRouteConfigPrefix + conf.Name, conf
+		}
+	}
+	return "", nil
+}
+
+// metadataPatches adds values to the labels or annotations of an object.
+func metadataPatches(field string, existing, values map[string]string) []patchOperation {
+	if len(existing) == 0 {
+		return []patchOperation{{Op: "add", Path: "/metadata/" + field, Value: values}}
+	}
+	var patches []patchOperation
+	for k, v := range values {
+		patches = append(patches, patchOperation{Op: "add", Path: "/metadata/" + field + "/" + escapePath(k), Value: v})
+	}
+	return patches
+}
+
+// escapePath escapes a key for use in a JSON patch path.
+func escapePath(k string) string {
+	return strings.Replace(strings.Replace(k, "~", "~0", -1), "/", "~1", -1)
+}
+
+// matchConfig returns the config of the first label, in key order, that
+// matches one.
+func (a *Admitter) matchConfig(resource string, labels map[string]string) (string, *controller.Config) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if name, conf := a.lookupConfig(resource, k, labels[k]); conf != nil {
+			glog.V(5).Infof("k: %v, v: %v matches config %s", k, labels[k], name)
+			return name, conf
+		}
+	}
+	return "", nil
+}
+
+// injectionPatches brings the Nezha-owned aliases, env and DNS config of a
+// workload's pod template in line with its config. What was injected before
+// is tracked in the workload's annotations, so it is replaced rather than
+// duplicated when the workload is updated, and user aliases and env are
+// kept.
+func (a *Admitter) injectionPatches(resource, namespace string, meta metav1.ObjectMeta, template *coreV1.PodTemplateSpec) []patchOperation {
+	glog.V(5).Infof("labels %v", meta.GetLabels())
+	name, conf := a.matchConfig(resource, meta.GetLabels())
+	var desired []coreV1.HostAlias
+	var desiredEnv []controller.EnvVar
+	var desiredVolumes []controller.DatasetVolume
+	if conf != nil {
+		desired, desiredEnv, desiredVolumes = conf.HostAliases(), a.configEnv(conf), conf.Volumes
+	}
+	annotations := meta.GetAnnotations()
+	owned := controller.OwnedAliases(annotations)
+	ownedEnv := controller.OwnedEnv(annotations)
+	ownedDNS := annotations[controller.DNSAnnotation]
+	ownedSidecar := annotations[controller.SidecarAnnotation]
+	ownedVolumes := controller.OwnedVolumes(annotations)
+	if conf == nil && len(owned) == 0 && len(ownedEnv) == 0 && len(ownedDNS) == 0 && len(ownedSidecar) == 0 && len(ownedVolumes) == 0 {
+		return nil
+	}
+
+	var patches []patchOperation
+	current := template.Spec.HostAliases
+	aliases := controller.ReplaceAliases(current, owned, desired)
+	if !reflect.DeepEqual(aliases, current) {
+		glog.V(5).Infof("hosts %v", aliases)
+		if len(aliases) > 0 {
+			patches = append(patches, patchOperation{Op: "add", Path: "/spec/template/spec/hostAliases", Value: aliases})
+		} else {
+			patches = append(patches, patchOperation{Op: "remove", Path: "/spec/template/spec/hostAliases"})
+		}
+	}
+	patches = append(patches, envPatches("/spec/template/spec", &template.Spec, ownedEnv, desiredEnv)...)
+	nameserver, dnsPatches := a.dnsPatches("/spec/template/spec", namespace, &template.Spec, ownedDNS, conf)
+	patches = append(patches, dnsPatches...)
+	// a regular container keeps a job from completing
+	native := a.NativeSidecars && resource == "jobs"
+	volumes := newVolumeList("/spec/template/spec", template.Spec.Volumes)
+	sidecar, sidecarPatches := sidecarPatches("/spec/template/spec", &template.Spec, volumes, ownedSidecar, conf, native)
+	patches = append(patches, sidecarPatches...)
+	desiredVolumes, mountPatches := volumePatches("/spec/template/spec", &template.Spec, volumes, ownedVolumes, desiredVolumes)
+	patches = append(patches, mountPatches...)
+	patches = append(patches, volumes.patches()...)
+	if conf != nil && len(patches) > 0 {
+		a.patched(name, resource)
+		// count a workload once, when the route is first injected into it
+		if annotations[controller.InjectedConfigAnnotation] != name && strings.HasPrefix(name, controller.CacheRouteConfigPrefix) && a.Routes != nil {
+			a.Routes.RecordInjection(strings.TrimPrefix(name, controller.CacheRouteConfigPrefix))
+		}
+	}
+
+	if conf == nil {
+		return append(patches, removeAnnotationPatches(annotations,
+			controller.InjectedConfigAnnotation, controller.InjectedAliasesAnnotation, controller.InjectedEnvAnnotation,
+			controller.DNSAnnotation, controller.SidecarAnnotation, controller.InjectedVolumesAnnotation,
+			controller.InjectedHashAnnotation)...)
+	}
+	values := map[string]string{}
+	if annotations[controller.InjectedConfigAnnotation] != name {
+		values[controller.InjectedConfigAnnotation] = name
+	}
+	if hash := conf.Hash(); annotations[controller.InjectedHashAnnotation] != hash {
+		values[controller.InjectedHashAnnotation] = hash
+	}
+	if len(desired) > 0 {
+		js, err := json.Marshal(desired)
+		if err != nil {
+			glog.Error(err)
+			return patches
+		}
+		if annotations[controller.InjectedAliasesAnnotation] != string(js) {
+			values[controller.InjectedAliasesAnnotation] = string(js)
+		}
+	} else {
+		patches = append(patches, removeAnnotationPatches(annotations, controller.InjectedAliasesAnnotation)...)
+	}
+	if len(desiredEnv) > 0 {
+		envJS, err := json.Marshal(desiredEnv)
+		if err != nil {
+			glog.Error(err)
+			return patches
+		}
+		if annotations[controller.InjectedEnvAnnotation] != string(envJS) {
+			values[controller.InjectedEnvAnnotation] = string(envJS)
+		}
+	} else {
+		patches = append(patches, removeAnnotationPatches(annotations, controller.InjectedEnvAnnotation)...)
+	}
+	if len(nameserver) > 0 {
+		if ownedDNS != nameserver {
+			values[controller.DNSAnnotation] = nameserver
+		}
+	} else {
+		patches = append(patches, removeAnnotationPatches(annotations, controller.DNSAnnotation)...)
+	}
+	if len(sidecar) > 0 {
+		if ownedSidecar != sidecar {
+			values[controller.SidecarAnnotation] = sidecar
+		}
+	} else {
+		patches = append(patches, removeAnnotationPatches(annotations, controller.SidecarAnnotation)...)
+	}
+	if len(desiredVolumes) > 0 {
+		volumesJS, err := json.Marshal(desiredVolumes)
+		if err != nil {
+			glog.Error(err)
+			return patches
+		}
+		if annotations[controller.InjectedVolumesAnnotation] != string(volumesJS) {
+			values[controller.InjectedVolumesAnnotation] = string(volumesJS)
+		}
+	} else {
+		patches = append(patches, removeAnnotationPatches(annotations, controller.InjectedVolumesAnnotation)...)
+	}
+	if len(values) == 0 {
+		return patches
+	}
+	return append(patches, metadataPatches("annotations", annotations, values)...)
+}
+
+// configEnv returns the env of a config entry, followed by the variables of
+// its forward proxy that the entry does not set.
+func (a *Admitter) configEnv(conf *controller.Config) []controller.EnvVar {
+	if conf.Proxy == nil {
+		return conf.Env
+	}
+	env := append([]controller.EnvVar{}, conf.Env...)
+	set := make(map[string]bool)
+	for _, e := range conf.Env {
+		set[e.Name] = true
+	}
+	for _, e := range conf.Proxy.ProxyEnv(a.NoProxy) {
+		if !set[e.Name] {
+			env = append(env, e)
+		}
+	}
+	return env
+}
+
+// dnsPatches points the pod spec at path to the Nezha nameserver when conf
+// is a DNS entry, and reverts to the cluster DNS when owned, the nameserver
+// set before, is no longer wanted. It returns the nameserver now set.
+func (a *Admitter) dnsPatches(path, namespace string, spec *coreV1.PodSpec, owned string, conf *controller.Config) (string, []patchOperation) {
+	if conf != nil && conf.DNS {
+		if len(a.DNSServer) == 0 {
+			glog.Warningf("config %s is a DNS entry but the webhook has no DNS server", conf.Name)
+			return owned, nil
+		}
+		if len(owned) == 0 && spec.DNSPolicy == coreV1.DNSNone {
+			glog.V(2).Infof("keeping the DNS config set by the user in %s", path)
+			return "", nil
+		}
+		var patches []patchOperation
+		if spec.DNSPolicy != coreV1.DNSNone {
+			patches = append(patches, patchOperation{Op: "add", Path: path + "/dnsPolicy", Value: coreV1.DNSNone})
+		}
+		dnsConfig := controller.PodDNSConfig(a.DNSServer, namespace, a.ClusterDomain)
+		if !reflect.DeepEqual(spec.DNSConfig, dnsConfig) {
+			patches = append(patches, patchOperation{Op: "add", Path: path + "/dnsConfig", Value: dnsConfig})
+		}
+		return a.DNSServer, patches
+	}
+	if len(owned) == 0 || spec.DNSPolicy != coreV1.DNSNone {
+		return "", nil
+	}
+	patches := []patchOperation{{Op: "add", Path: path + "/dnsPolicy", Value: coreV1.DNSClusterFirst}}
+	if spec.DNSConfig != nil {
+		patches = append(patches, patchOperation{Op: "remove", Path: path + "/dnsConfig"})
+	}
+	return "", patches
+}
+
+// nativeSidecar is an init container that keeps running along the
+// containers of the pod, which the vendored API does not know yet.
+type nativeSidecar struct {
+	coreV1.Container
+	RestartPolicy string `json:"restartPolicy"`
+}
+
+// sidecarPatches injects the cache sidecar of conf into the pod spec at
+// path, replaces it when owned, the hash of the sidecar injected before,
+// changed and removes it when it is no longer wanted. Its volumes are set on
+// volumes. With native, the sidecar is an init container with restartPolicy
+// Always, which needs Kubernetes 1.29, otherwise a regular container. It
+// returns the hash of the sidecar now injected.
+func sidecarPatches(path string, spec *coreV1.PodSpec, volumes *volumeList, owned string, conf *controller.Config, native bool) (string, []patchOperation) {
+	var desired string
+	if conf != nil && conf.Sidecar != nil {
+		desired = conf.Sidecar.Hash(conf.Aliases)
+	}
+	field, containers := "containers", spec.Containers
+	otherField, others := "initContainers", spec.InitContainers
+	if native {
+		field, containers, otherField, others = otherField, others, field, containers
+	}
+	index := containerIndex(containers, controller.SidecarName)
+	// a sidecar injected the other way before is moved
+	other := containerIndex(others, controller.SidecarName)
+	if desired == owned && (len(desired) > 0) == (index >= 0) && other < 0 {
+		return desired, nil
+	}
+
+	var patches []patchOperation
+	if other >= 0 && len(owned) > 0 {
+		patches = append(patches, patchOperation{Op: "remove", Path: fmt.Sprintf("%s/%s/%d", path, otherField, other)})
+	}
+	if len(desired) == 0 {
+		if len(owned) == 0 {
+			return "", nil
+		}
+		if index >= 0 {
+			patches = append(patches, patchOperation{Op: "remove", Path: fmt.Sprintf("%s/%s/%d", path, field, index)})
+		}
+		volumes.remove(controller.SidecarName, controller.SidecarConfigVolume)
+		return "", patches
+	}
+
+	container, err := conf.Sidecar.Container(conf.Aliases)
+	if err != nil {
+		glog.Errorf("invalid sidecar of config %s: %v", conf.Name, err)
+		return owned, nil
+	}
+	var value interface{} = container
+	if native {
+		value = nativeSidecar{Container: container, RestartPolicy: "Always"}
+	}
+	patches = append(patches, listPatch(fmt.Sprintf("%s/%s", path, field), len(containers), index, value))
+	if len(conf.Sidecar.ConfigMap) == 0 {
+		volumes.remove(controller.SidecarConfigVolume)
+	}
+	for _, volume := range conf.Sidecar.Volumes() {
+		volumes.set(volume["name"].(string), volume)
+	}
+	return desired, patches
+}
+
+// volumePatches brings the dataset volumes of the pod spec at path in line
+// with desired on volumes and returns the injected volumes and the patches of
+// their mounts. The owned volumes, injected before, are removed or replaced
+// when they changed, and the other volumes and mounts are kept: a desired
+// volume named as one of them is skipped.
+func volumePatches(path string, spec *coreV1.PodSpec, volumes *volumeList, owned, desired []controller.DatasetVolume) ([]controller.DatasetVolume, []patchOperation) {
+	ours := make(map[string]bool)
+	for _, v := range owned {
+		ours[v.Name] = true
+	}
+	var injected []controller.DatasetVolume
+	for _, v := range desired {
+		if !ours[v.Name] && volumeIndex(spec.Volumes, v.Name) >= 0 {
+			glog.Warningf("not injecting dataset volume %s into %s: a volume of that name is not Nezha's", v.Name, path)
+			continue
+		}
+		injected = append(injected, v)
+	}
+	desired = injected
+	if len(owned) == 0 && len(desired) == 0 {
+		return nil, nil
+	}
+	changed := !reflect.DeepEqual(owned, desired)
+	wanted := make(map[string]bool)
+	for _, v := range desired {
+		wanted[v.Name] = true
+	}
+	for _, v := range owned {
+		if !wanted[v.Name] {
+			volumes.remove(v.Name)
+		}
+	}
+	for _, v := range desired {
+		if !changed && volumeIndex(spec.Volumes, v.Name) >= 0 {
+			continue
+		}
+		volumes.set(v.Name, v.Volume())
+	}
+
+	var patches []patchOperation
+	for _, c := range []struct {
+		field      string
+		init       bool
+		containers []coreV1.Container
+	}{
+		{"initContainers", true, spec.InitContainers},
+		{"containers", false, spec.Containers},
+	} {
+		for i, container := range c.containers {
+			mounts := controller.MergeVolumeMounts(container.VolumeMounts, container.Name, c.init, owned, desired)
+			if reflect.DeepEqual(mounts, container.VolumeMounts) {
+				continue
+			}
+			p := fmt.Sprintf("%s/%s/%d/volumeMounts", path, c.field, i)
+			if len(mounts) > 0 {
+				patches = append(patches, patchOperation{Op: "add", Path: p, Value: mounts})
+			} else {
+				patches = append(patches, patchOperation{Op: "remove", Path: p})
+			}
+		}
+	}
+	return desired, patches
+}
+
+// volumeList collects the volumes removed from and set on a pod spec by the
+// sidecar and the dataset volumes, so that every patch of the volumes is
+// computed from the same list.
+type volumeList struct {
+	path    string
+	names   []string
+	removed map[string]bool
+	values  []volumeValue
+}
+
+type volumeValue struct {
+	name  string
+	value interface{}
+}
+
+func newVolumeList(path string, volumes []coreV1.Volume) *volumeList {
+	l := &volumeList{path: path + "/volumes", removed: make(map[string]bool)}
+	for _, v := range volumes {
+		l.names = append(l.names, v.Name)
+	}
+	return l
+}
+
+// remove removes the named volumes, if present.
+func (l *volumeList) remove(names ...string) {
+	for _, name := range names {
+		if indexOf(l.names, name) >= 0 {
+			l.removed[name] = true
+		}
+	}
+}
+
+// set replaces the named volume with value, or appends it.
+func (l *volumeList) set(name string, value interface{}) {
+	delete(l.removed, name)
+	l.values = append(l.values, volumeValue{name, value})
+}
+
+// patches returns the removals, in descending index order, followed by the
+// replacements and additions.
+func (l *volumeList) patches() []patchOperation {
+	var patches []patchOperation
+	var names []string
+	for i := len(l.names) - 1; i >= 0; i-- {
+		if l.removed[l.names[i]] {
+			patches = append(patches, patchOperation{Op: "remove", Path: fmt.Sprintf("%s/%d", l.path, i)})
+		}
+	}
+	for _, name := range l.names {
+		if !l.removed[name] {
+			names = append(names, name)
+		}
+	}
+	for _, v := range l.values {
+		i := indexOf(names, v.name)
+		patches = append(patches, listPatch(l.path, len(names), i, v.value))
+		if i < 0 {
+			names = append(names, v.name)
+		}
+	}
+	return patches
+}
+
+func indexOf(list []string, s string) int {
+	for i := range list {
+		if list[i] == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// listPatch replaces the element at index of the list at path of length n,
+// or appends value when index is negative.
+func listPatch(path string, n, index int, value interface{}) patchOperation {
+	switch {
+	case index >= 0:
+		return patchOperation{Op: "replace", Path: fmt.Sprintf("%s/%d", path, index), Value: value}
+	case n == 0:
+		return patchOperation{Op: "add", Path: path, Value: []interface{}{value}}
+	default:
+		return patchOperation{Op: "add", Path: path + "/-", Value: value}
+	}
+}
+
+func volumeIndex(volumes []coreV1.Volume, name string) int {
+	for i := range volumes {
+		if volumes[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func containerIndex(containers []coreV1.Container, name string) int {
+	for i := range containers {
+		if containers[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// envPatches merges env into the containers and init containers of the pod
+// spec at path, see controller.MergeEnv.
+func envPatches(path string, spec *coreV1.PodSpec, owned, desired []controller.EnvVar) []patchOperation {
+	if len(owned) == 0 && len(desired) == 0 {
+		return nil
+	}
+	var patches []patchOperation
+	for _, c := range []struct {
+		field      string
+		containers []coreV1.Container
+	}{
+		{"initContainers", spec.InitContainers},
+		{"containers", spec.Containers},
+	} {
+		for i, container := range c.containers {
+			if container.Name == controller.SidecarName {
+				continue
+			}
+			env := controller.MergeEnv(container.Env, owned, desired)
+			if reflect.DeepEqual(env, container.Env) {
+				continue
+			}
+			p := fmt.Sprintf("%s/%s/%d/env", path, c.field, i)
+			if len(env) > 0 {
+				patches = append(patches, patchOperation{Op: "add", Path: p, Value: env})
+			} else {
+				patches = append(patches, patchOperation{Op: "remove", Path: p})
+			}
+		}
+	}
+	return patches
+}
+
+func removeAnnotationPatches(annotations map[string]string, keys ...string) []patchOperation {
+	var patches []patchOperation
+	for _, k := range keys {
+		if _, ok := annotations[k]; ok {
+			patches = append(patches, patchOperation{Op: "remove", Path: "/metadata/annotations/" + escapePath(k)})
+		}
+	}
+	return patches
+}
+
+// holdForPrefetch suspends a job whose dataset annotation names a
+// DatasetPrefetch that holds jobs and is not finished yet.
+func (a *Admitter) holdForPrefetch(namespace string, job *batch.Job) []patchOperation {
+	name := a.heldBy(namespace, "job", job.ObjectMeta)
+	if len(name) == 0 {
+		return nil
+	}
+	patches := []patchOperation{{Op: "add", Path: "/spec/suspend", Value: true}}
+	return append(patches, metadataPatches("labels", job.ObjectMeta.GetLabels(), map[string]string{controller.HeldByLabel: name})...)
+}
+
+// heldBy returns the DatasetPrefetch the object of kind with meta is held
+// for, if any: the one it names in the DatasetAnnotation, when it holds jobs
+// and is not complete. A failed prefetch holds jobs until it is updated or
+// deleted.
+func (a *Admitter) heldBy(namespace, kind string, meta metav1.ObjectMeta) string {
+	name := meta.GetAnnotations()[controller.DatasetAnnotation]
+	if a.Prefetches == nil || len(name) == 0 {
+		return ""
+	}
+	obj, exists, err := a.Prefetches.GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		glog.Warningf("%s %s/%s references unknown prefetch %s", kind, namespace, meta.Name, name)
+		return ""
+	}
+	p := obj.(*v1alpha1.DatasetPrefetch)
+	if !p.Spec.HoldJobs || (p.Status.ObservedGeneration == p.Generation && p.Status.Phase == v1alpha1.PrefetchComplete) {
+		return ""
+	}
+	glog.V(2).Infof("holding %s %s/%s until prefetch %s completes", kind, namespace, meta.Name, name)
+	return name
+}
+
+// localityHints prefers nodes whose cache already holds the dataset named
+// by the pod spec at path, whose metadata is podMeta, or by its workload.
+func (a *Admitter) localityHints(path string, meta, podMeta metav1.ObjectMeta, spec *coreV1.PodSpec) []patchOperation {
+	if a.LocalityWeight <= 0 {
+		return nil
+	}
+	dataset := podMeta.GetAnnotations()[controller.DatasetAnnotation]
+	if len(dataset) == 0 {
+		dataset = meta.GetAnnotations()[controller.DatasetAnnotation]
+	}
+	if len(dataset) == 0 {
+		return nil
+	}
+	affinity, err := controller.PreferDatasetNodes(spec.Affinity, dataset, a.LocalityWeight)
+	if err != nil {
+		glog.Warningf("no locality hint for %s/%s: %v", meta.Namespace, meta.Name, err)
+		return nil
+	}
+	if affinity == nil {
+		return nil
+	}
+	return []patchOperation{{Op: "add", Path: path + "/affinity", Value: affinity}}
+}
+
+// lookupPodConfig returns the config for a pod's labels, taken from the
+// config file first and from CacheRoutes otherwise. Pods do not count as
+// workloads in the status of a CacheRoute.
+func (a *Admitter) lookupPodConfig(labels map[string]string) (string, *controller.Config) {
+	if conf := controller.GetPodConfig(labels, a.Configs()); conf != nil && conf.Injects() {
+		return conf.Name, conf
+	}
+	if a.Routes != nil {
+		if conf := controller.GetPodConfig(labels, a.Routes.Configs("pods")); conf != nil {
+			return controller.CacheRouteConfigPrefix + conf.Name, conf
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,297 @@
+package admission
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/fast-ml/nezha/pkg/controller"
+	"k8s.io/api/admission/v1beta1"
+	coreV1 "k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func newDeployment(volumes ...string) *extensions.Deployment {
+	dp := &extensions.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "extensions/v1beta1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Labels: map[string]string{"app": "web"}},
+	}
+	dp.Spec.Template.Spec.Containers = []coreV1.Container{{Name: "app", Image: "app"}}
+	for _, v := range volumes {
+		dp.Spec.Template.Spec.Volumes = append(dp.Spec.Template.Spec.Volumes, coreV1.Volume{Name: v})
+	}
+	return dp
+}
+
+// mutateDeployment applies the patch of the deployment webhook to dp and
+// returns the result and the number of operations.
+func mutateDeployment(t *testing.T, configs []controller.Config, dp *extensions.Deployment) (*extensions.Deployment, int) {
+	raw, err := json.Marshal(dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Admitter{Configs: func() []controller.Config { return configs }}
+	response, err := a.MutateDeployments(v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+		Resource:  metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		Namespace: "default",
+		Operation: v1beta1.Update,
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Patch) == 0 {
+		return dp, 0
+	}
+	var ops []patchOperation
+	if err := json.Unmarshal(response.Patch, &ops); err != nil {
+		t.Fatal(err)
+	}
+	patched, err := ApplyPatch(raw, response.Patch)
+	if err != nil {
+		t.Fatalf("patch %s: %v", response.Patch, err)
+	}
+	result := &extensions.Deployment{}
+	if err := json.Unmarshal(patched, result); err != nil {
+		t.Fatal(err)
+	}
+	return result, len(ops)
+}
+
+func volumeNames(spec *coreV1.PodSpec) []string {
+	var names []string
+	for _, v := range spec.Volumes {
+		names = append(names, v.Name)
+	}
+	return names
+}
+
+func containerNames(containers []coreV1.Container) []string {
+	var names []string
+	for _, c := range containers {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func mountNames(c coreV1.Container) []string {
+	var names []string
+	for _, m := range c.VolumeMounts {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+func TestVolumePatches(t *testing.T) {
+	aliases := []coreV1.HostAlias{{IP: "10.0.0.1", Hostnames: []string{"s3.example.com"}}}
+	withConfigMap := controller.Config{
+		Name: "a", App: "app", Label: "web", Aliases: aliases,
+		Sidecar: &controller.Sidecar{Image: "nginx", ConfigMap: "nginx-conf"},
+		Volumes: []controller.DatasetVolume{{Name: "data", MountPath: "/data", PersistentVolumeClaim: "data"}},
+	}
+	withoutConfigMap := controller.Config{
+		Name: "b", App: "app", Label: "web", Aliases: aliases,
+		Sidecar: &controller.Sidecar{Image: "nginx"},
+		Volumes: []controller.DatasetVolume{{Name: "models", MountPath: "/models", HostPath: "/mnt/models"}},
+	}
+	volumesOnly := controller.Config{
+		Name: "c", App: "app", Label: "web",
+		Volumes: []controller.DatasetVolume{{Name: "data", MountPath: "/data", ReadOnly: true, PersistentVolumeClaim: "data"}},
+	}
+
+	tests := []struct {
+		name           string
+		volumes        []string
+		steps          [][]controller.Config
+		wantVolumes    []string
+		wantContainers []string
+		wantMounts     []string
+	}{
+		{
+			name:           "add sidecar and volumes without volumes",
+			steps:          [][]controller.Config{{withConfigMap}},
+			wantVolumes:    []string{controller.SidecarName, controller.SidecarConfigVolume, "data"},
+			wantContainers: []string{"app", controller.SidecarName},
+			wantMounts:     []string{"data"},
+		},
+		{
+			name:           "add next to user volumes",
+			volumes:        []string{"scratch"},
+			steps:          [][]controller.Config{{withConfigMap}},
+			wantVolumes:    []string{"scratch", controller.SidecarName, controller.SidecarConfigVolume, "data"},
+			wantContainers: []string{"app", controller.SidecarName},
+			wantMounts:     []string{"data"},
+		},
+		{
+			name:           "remove sidecar and volumes",
+			steps:          [][]controller.Config{{withConfigMap}, nil},
+			wantContainers: []string{"app"},
+		},
+		{
+			name:           "remove keeps user volumes",
+			volumes:        []string{"scratch"},
+			steps:          [][]controller.Config{{withConfigMap}, nil},
+			wantVolumes:    []string{"scratch"},
+			wantContainers: []string{"app"},
+		},
+		{
+			name:           "switch to a sidecar without ConfigMap",
+			volumes:        []string{"scratch"},
+			steps:          [][]controller.Config{{withConfigMap}, {withoutConfigMap}},
+			wantVolumes:    []string{"scratch", controller.SidecarName, "models"},
+			wantContainers: []string{"app", controller.SidecarName},
+			wantMounts:     []string{"models"},
+		},
+		{
+			name:           "switch to a sidecar with ConfigMap",
+			steps:          [][]controller.Config{{withoutConfigMap}, {withConfigMap}},
+			wantVolumes:    []string{controller.SidecarName, controller.SidecarConfigVolume, "data"},
+			wantContainers: []string{"app", controller.SidecarName},
+			wantMounts:     []string{"data"},
+		},
+		{
+			name:           "switch to volumes only",
+			steps:          [][]controller.Config{{withConfigMap}, {volumesOnly}},
+			wantVolumes:    []string{"data"},
+			wantContainers: []string{"app"},
+			wantMounts:     []string{"data"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dp := newDeployment(test.volumes...)
+			for _, configs := range test.steps {
+				dp, _ = mutateDeployment(t, configs, dp)
+			}
+			spec := &dp.Spec.Template.Spec
+			if got := volumeNames(spec); !reflect.DeepEqual(got, test.wantVolumes) {
+				t.Errorf("volumes %v, want %v", got, test.wantVolumes)
+			}
+			if got := containerNames(spec.Containers); !reflect.DeepEqual(got, test.wantContainers) {
+				t.Errorf("containers %v, want %v", got, test.wantContainers)
+			}
+			if got := mountNames(spec.Containers[0]); !reflect.DeepEqual(got, test.wantMounts) {
+				t.Errorf("mounts %v, want %v", got, test.wantMounts)
+			}
+			if _, n := mutateDeployment(t, test.steps[len(test.steps)-1], dp); n != 0 {
+				t.Errorf("%d operations on the mutated deployment, want none", n)
+			}
+		})
+	}
+}
+
+func TestVolumePatchesKeepUserVolumes(t *testing.T) {
+	volumesOnly := controller.Config{
+		Name: "c", App: "app", Label: "web",
+		Volumes: []controller.DatasetVolume{
+			{Name: "data", MountPath: "/data", PersistentVolumeClaim: "data"},
+			{Name: "models", MountPath: "/models", HostPath: "/mnt/models"},
+		},
+	}
+	dp := newDeployment("data")
+	dp.Spec.Template.Spec.Containers[0].VolumeMounts = []coreV1.VolumeMount{{Name: "data", MountPath: "/scratch"}}
+	for i, configs := range [][]controller.Config{{volumesOnly}, {volumesOnly}, nil} {
+		dp, _ = mutateDeployment(t, configs, dp)
+		spec := &dp.Spec.Template.Spec
+		want := []string{"data", "models"}
+		if configs == nil {
+			want = []string{"data"}
+		}
+		if got := volumeNames(spec); !reflect.DeepEqual(got, want) {
+			t.Errorf("step %d: volumes %v, want %v", i, got, want)
+		}
+		if got := mountNames(spec.Containers[0]); !reflect.DeepEqual(got, want) {
+			t.Errorf("step %d: mounts %v, want %v", i, got, want)
+		}
+		if spec.Volumes[0].PersistentVolumeClaim != nil {
+			t.Errorf("step %d: user volume replaced by %+v", i, spec.Volumes[0])
+		}
+		if m := spec.Containers[0].VolumeMounts[0]; m.MountPath != "/scratch" {
+			t.Errorf("step %d: user mount replaced by %+v", i, m)
+		}
+	}
+}
+
+func TestVolumeListPatches(t *testing.T) {
+	volumes := []coreV1.Volume{{Name: controller.SidecarName}, {Name: controller.SidecarConfigVolume}, {Name: "data"}}
+	l := newVolumeList("/spec", volumes)
+	l.remove(controller.SidecarName, controller.SidecarConfigVolume)
+	l.remove("data", "missing")
+	want := []patchOperation{
+		{Op: "remove", Path: "/spec/volumes/2"},
+		{Op: "remove", Path: "/spec/volumes/1"},
+		{Op: "remove", Path: "/spec/volumes/0"},
+	}
+	if got := l.patches(); !reflect.DeepEqual(got, want) {
+		t.Errorf("patches %v, want %v", got, want)
+	}
+
+	l = newVolumeList("/spec", nil)
+	l.set("a", "A")
+	l.set("b", "B")
+	want = []patchOperation{
+		{Op: "add", Path: "/spec/volumes", Value: []interface{}{"A"}},
+		{Op: "add", Path: "/spec/volumes/-", Value: "B"},
+	}
+	if got := l.patches(); !reflect.DeepEqual(got, want) {
+		t.Errorf("patches %v, want %v", got, want)
+	}
+}
+
+func TestSidecarPatchesNative(t *testing.T) {
+	conf := &controller.Config{
+		Name:    "a",
+		Aliases: []coreV1.HostAlias{{IP: "10.0.0.1", Hostnames: []string{"s3.example.com"}}},
+		Sidecar: &controller.Sidecar{Image: "nginx"},
+	}
+	hash := conf.Sidecar.Hash(conf.Aliases)
+	sidecar := coreV1.Container{Name: controller.SidecarName}
+	tests := []struct {
+		name      string
+		spec      coreV1.PodSpec
+		owned     string
+		native    bool
+		wantPaths []string
+	}{
+		{
+			name:      "native",
+			native:    true,
+			wantPaths: []string{"/spec/initContainers"},
+		},
+		{
+			name:      "regular",
+			spec:      coreV1.PodSpec{Containers: []coreV1.Container{{Name: "app"}}},
+			wantPaths: []string{"/spec/containers/-"},
+		},
+		{
+			name:   "unchanged",
+			spec:   coreV1.PodSpec{InitContainers: []coreV1.Container{sidecar}},
+			owned:  hash,
+			native: true,
+		},
+		{
+			name:      "native to regular",
+			spec:      coreV1.PodSpec{InitContainers: []coreV1.Container{sidecar}, Containers: []coreV1.Container{{Name: "app"}}},
+			owned:     hash,
+			wantPaths: []string{"/spec/initContainers/0", "/spec/containers/-"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			volumes := newVolumeList("/spec", test.spec.Volumes)
+			got, patches := sidecarPatches("/spec", &test.spec, volumes, test.owned, conf, test.native)
+			if got != hash {
+				t.Errorf("hash %s, want %s", got, hash)
+			}
+			var paths []string
+			for _, p := range patches {
+				paths = append(paths, p.Path)
+			}
+			if !reflect.DeepEqual(paths, test.wantPaths) {
+				t.Errorf("paths %v, want %v", paths, test.wantPaths)
+			}
+		})
+	}
+}
@@ -0,0 +1,4 @@
+// Package v1alpha1 contains the nezha.fast-ml.io v1alpha1 API types.
+// +k8s:deepcopy-gen=package
+// +groupName=nezha.fast-ml.io
+package v1alpha1
@@ -0,0 +1,134 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// CacheRoute redirects a set of storage hostnames to a cache for the
+// workloads matched by its selectors.
+type CacheRoute struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CacheRouteSpec   `json:"spec"`
+	Status CacheRouteStatus `json:"status,omitempty"`
+}
+
+type CacheRouteSpec struct {
+	// Hostnames are the remote storage endpoints served by the cache.
+	Hostnames []string `json:"hostnames"`
+	// Target is where the hostnames are redirected to.
+	Target CacheTarget `json:"target"`
+	// Selectors match the labels of deployments, jobs and pods. A workload
+	// matching any of them gets the route injected.
+	Selectors []RouteSelector `json:"selectors"`
+	// Policies controls when the route is injected.
+	Policies RoutePolicies `json:"policies,omitempty"`
+}
+
+// CacheTarget is either a fixed IP or a Service whose cluster IP is used.
+type CacheTarget struct {
+	IP      string            `json:"ip,omitempty"`
+	Service *ServiceReference `json:"service,omitempty"`
+}
+
+type ServiceReference struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// RouteSelector matches workloads carrying the label Key=Value.
+type RouteSelector struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type RoutePolicies struct {
+	// Paused stops injection without deleting the route.
+	Paused bool `json:"paused,omitempty"`
+	// Resources limits the route to the given workload resources
+	// ("deployments", "jobs", "pods"). Empty means all.
+	Resources []string `json:"resources,omitempty"`
+}
+
+type CacheRouteStatus struct {
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// InjectedWorkloads is the number of workloads the route was injected into.
+	InjectedWorkloads int64 `json:"injectedWorkloads,omitempty"`
+	// ResolvedIP is the address the hostnames currently point to.
+	ResolvedIP string `json:"resolvedIP,omitempty"`
+	// LastValidationError is empty when the route is valid.
+	LastValidationError string       `json:"lastValidationError,omitempty"`
+	LastUpdateTime      *metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+type CacheRouteList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []CacheRoute `json:"items"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// DatasetPrefetch warms a cache with a dataset before the jobs using it run.
+type DatasetPrefetch struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DatasetPrefetchSpec   `json:"spec"`
+	Status DatasetPrefetchStatus `json:"status,omitempty"`
+}
+
+type DatasetPrefetchSpec struct {
+	// URLs are objects fetched as is.
+	URLs []string `json:"urls,omitempty"`
+	// Prefixes are bucket URLs with a key prefix, e.g.
+	// http://bucket.s3.amazonaws.com/train/. They are expanded with the
+	// S3/GCS XML listing API.
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Target is the cache the objects are fetched through.
+	Target CacheTarget `json:"target"`
+	// Port of the cache, 80 by default.
+	Port int32 `json:"port,omitempty"`
+	// Parallelism is the number of concurrent fetches, 4 by default.
+	Parallelism int32 `json:"parallelism,omitempty"`
+	// HoldJobs suspends jobs referencing the dataset until the prefetch
+	// is complete.
+	HoldJobs bool `json:"holdJobs,omitempty"`
+}
+
+type PrefetchPhase string
+
+const (
+	PrefetchPending  PrefetchPhase = "Pending"
+	PrefetchRunning  PrefetchPhase = "Running"
+	PrefetchComplete PrefetchPhase = "Complete"
+	PrefetchFailed   PrefetchPhase = "Failed"
+)
+
+type DatasetPrefetchStatus struct {
+	ObservedGeneration int64         `json:"observedGeneration,omitempty"`
+	Phase              PrefetchPhase `json:"phase,omitempty"`
+	ObjectsTotal       int64         `json:"objectsTotal,omitempty"`
+	ObjectsFetched     int64         `json:"objectsFetched,omitempty"`
+	BytesFetched       int64         `json:"bytesFetched,omitempty"`
+	Failures           int64         `json:"failures,omitempty"`
+	// Message describes the last failure.
+	Message        string       `json:"message,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+type DatasetPrefetchList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []DatasetPrefetch `json:"items"`
+}
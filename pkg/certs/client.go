@@ -0,0 +1,68 @@
+package certs
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The client CA of the cluster, used by the API server to authenticate to
+// aggregated API servers and webhooks.
+const (
+	ClientCANamespace = "kube-system"
+	ClientCAConfigMap = "extension-apiserver-authentication"
+	ClientCAKey       = "client-ca-file"
+)
+
+// NewPool returns a pool with the PEM encoded certificates of bundle.
+func NewPool(bundle []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificate found in CA bundle")
+	}
+	return pool, nil
+}
+
+// LoadClientCA returns the CA bundle in file, or the client CA of the
+// cluster when file is empty.
+func LoadClientCA(clientset kubernetes.Interface, file string) ([]byte, error) {
+	if len(file) > 0 {
+		return ioutil.ReadFile(file)
+	}
+	cm, err := clientset.CoreV1().ConfigMaps(ClientCANamespace).Get(ClientCAConfigMap, metaV1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	bundle, ok := cm.Data[ClientCAKey]
+	if !ok {
+		return nil, fmt.Errorf("configmap %s/%s has no %s", ClientCANamespace, ClientCAConfigMap, ClientCAKey)
+	}
+	return []byte(bundle), nil
+}
+
+// VerifySubject returns a tls.Config.VerifyPeerCertificate that accepts
+// client certificates whose common name is in allowed. All verified
+// certificates are accepted when allowed is empty.
+func VerifySubject(allowed []string) func([][]byte, [][]*x509.Certificate) error {
+	names := map[string]bool{}
+	for _, name := range allowed {
+		names[name] = true
+	}
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(names) == 0 {
+			return nil
+		}
+		for _, chain := range verifiedChains {
+			if len(chain) > 0 && names[chain[0].Subject.CommonName] {
+				return nil
+			}
+		}
+		if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+			return fmt.Errorf("no verified client certificate")
+		}
+		return fmt.Errorf("client %q is not allowed", verifiedChains[0][0].Subject.CommonName)
+	}
+}
@@ -0,0 +1,90 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Reloader serves the current serving certificate to a tls.Config through
+// GetCertificate, so that it can be replaced without a restart.
+type Reloader struct {
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func NewReloader() *Reloader {
+	return &Reloader{}
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.cert == nil {
+		return nil, fmt.Errorf("no serving certificate loaded")
+	}
+	return r.cert, nil
+}
+
+// Leaf returns the current serving certificate, nil if none is loaded.
+func (r *Reloader) Leaf() *x509.Certificate {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.cert == nil {
+		return nil
+	}
+	return r.cert.Leaf
+}
+
+// Set replaces the serving certificate unless it is unchanged.
+func (r *Reloader) Set(certPEM, keyPEM []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if bytes.Equal(certPEM, r.certPEM) && bytes.Equal(keyPEM, r.keyPEM) {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	r.cert, r.certPEM, r.keyPEM = &cert, certPEM, keyPEM
+	glog.Infof("loaded serving certificate %s valid until %s", cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// LoadFiles sets the serving certificate from certFile and keyFile.
+func (r *Reloader) LoadFiles(certFile, keyFile string) error {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	return r.Set(certPEM, keyPEM)
+}
+
+// WatchFiles reloads certFile and keyFile every period until stopCh is
+// closed, e.g. when the mounted Secret is updated.
+func (r *Reloader) WatchFiles(certFile, keyFile string, period time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := r.LoadFiles(certFile, keyFile); err != nil {
+			glog.Warningf("failed to reload serving certificate, keeping the current one: %v", err)
+		}
+	}, period, stopCh)
+}
@@ -0,0 +1,285 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/cert"
+)
+
+// Keys of the certificate Secret. cert.pem and key.pem are the ones mounted
+// by the webhook Deployment.
+const (
+	CACertKey         = "ca.pem"
+	CAKeyKey          = "ca-key.pem"
+	PreviousCACertKey = "ca-previous.pem"
+	CertKey           = "cert.pem"
+	KeyKey            = "key.pem"
+)
+
+// SecretManager keeps a CA and a serving certificate for a webhook service
+// in a Secret. It renews them before they expire, loads them into a Reloader
+// and patches the caBundle of the webhook configurations.
+type SecretManager struct {
+	clientset      kubernetes.Interface
+	namespace      string
+	name           string
+	service        string
+	webhookConfigs []string
+	rotateBefore   time.Duration
+	reloader       *Reloader
+
+	// admissionregistration version served by the cluster
+	apiVersion string
+}
+
+// NewSecretManager manages the Secret namespace/name for the Service
+// service in the same namespace.
+func NewSecretManager(clientset kubernetes.Interface, namespace, name, service string, webhookConfigs []string, rotateBefore time.Duration, reloader *Reloader) *SecretManager {
+	return &SecretManager{
+		clientset:      clientset,
+		namespace:      namespace,
+		name:           name,
+		service:        service,
+		webhookConfigs: webhookConfigs,
+		rotateBefore:   rotateBefore,
+		reloader:       reloader,
+	}
+}
+
+func (m *SecretManager) dnsNames() []string {
+	return []string{
+		m.service,
+		m.service + "." + m.namespace,
+		m.service + "." + m.namespace + ".svc",
+	}
+}
+
+// Run syncs every period until stopCh is closed. Other replicas pick up the
+// certificates rotated by one of them on their next sync.
+func (m *SecretManager) Run(period time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := m.Sync(); err != nil {
+			glog.Errorf("failed to sync certificates in secret %s/%s: %v", m.namespace, m.name, err)
+		}
+	}, period, stopCh)
+}
+
+// Sync renews the certificates of the Secret if needed, updates the caBundle
+// of the webhook configurations and then loads them.
+func (m *SecretManager) Sync() error {
+	secret, err := m.clientset.CoreV1().Secrets(m.namespace).Get(m.name, metaV1.GetOptions{})
+	if errors.IsNotFound(err) {
+		secret = &coreV1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Namespace: m.namespace, Name: m.name},
+		}
+	} else if err != nil {
+		return err
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+
+	if reason := m.needsRotation(secret.Data); len(reason) > 0 {
+		glog.Infof("renewing certificates in secret %s/%s: %s", m.namespace, m.name, reason)
+		if err := m.rotate(secret.Data); err != nil {
+			return err
+		}
+		// the API server must trust a new CA, along with the previous one,
+		// before any replica serves a certificate signed by it
+		if err := m.patchCABundles(caBundle(secret.Data)); err != nil {
+			return err
+		}
+		if len(secret.ResourceVersion) == 0 {
+			secret, err = m.clientset.CoreV1().Secrets(m.namespace).Create(secret)
+		} else {
+			secret, err = m.clientset.CoreV1().Secrets(m.namespace).Update(secret)
+		}
+		if errors.IsAlreadyExists(err) || errors.IsConflict(err) {
+			// another replica rotated first: serve its certificates and
+			// restore the caBundle it patched
+			glog.Infof("secret %s/%s was written by another replica, loading it", m.namespace, m.name)
+			secret, err = m.clientset.CoreV1().Secrets(m.namespace).Get(m.name, metaV1.GetOptions{})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := m.patchCABundles(caBundle(secret.Data)); err != nil {
+		return err
+	}
+	return m.reloader.Set(secret.Data[CertKey], secret.Data[KeyKey])
+}
+
+// needsRotation tells why the certificates in data must be renewed, empty if
+// they are fine.
+func (m *SecretManager) needsRotation(data map[string][]byte) string {
+	caCert, _, err := parseCA(data)
+	if err != nil {
+		return err.Error()
+	}
+	certs, err := cert.ParseCertsPEM(data[CertKey])
+	if err != nil {
+		return fmt.Sprintf("invalid serving certificate: %v", err)
+	}
+	if _, err := cert.ParsePrivateKeyPEM(data[KeyKey]); err != nil {
+		return fmt.Sprintf("invalid serving key: %v", err)
+	}
+	leaf := certs[0]
+	if time.Now().Add(m.rotateBefore).After(leaf.NotAfter) {
+		return fmt.Sprintf("serving certificate expires at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	if err := leaf.CheckSignatureFrom(caCert); err != nil {
+		return "serving certificate is not signed by the CA"
+	}
+	for _, name := range m.dnsNames() {
+		if err := leaf.VerifyHostname(name); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// rotate issues a new serving certificate, and a new CA too when the current
+// one would expire before it. The previous CA is kept in the bundle so that
+// the API server trusts the old certificate until every replica reloaded.
+func (m *SecretManager) rotate(data map[string][]byte) error {
+	caCert, caKey, err := parseCA(data)
+	// a serving certificate is valid for a year
+	if err != nil || time.Now().Add(365*24*time.Hour+m.rotateBefore).After(caCert.NotAfter) {
+		if caKey, err = cert.NewPrivateKey(); err != nil {
+			return err
+		}
+		if caCert, err = cert.NewSelfSignedCACert(cert.Config{CommonName: m.service + "-ca"}, caKey); err != nil {
+			return err
+		}
+		if len(data[CACertKey]) > 0 {
+			data[PreviousCACertKey] = data[CACertKey]
+		}
+		data[CACertKey] = cert.EncodeCertPEM(caCert)
+		data[CAKeyKey] = cert.EncodePrivateKeyPEM(caKey)
+	}
+
+	key, err := cert.NewPrivateKey()
+	if err != nil {
+		return err
+	}
+	names := m.dnsNames()
+	serving, err := cert.NewSignedCert(cert.Config{
+		CommonName: names[len(names)-1],
+		AltNames:   cert.AltNames{DNSNames: names},
+		Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, key, caCert, caKey)
+	if err != nil {
+		return err
+	}
+	data[CertKey] = cert.EncodeCertPEM(serving)
+	data[KeyKey] = cert.EncodePrivateKeyPEM(key)
+	return nil
+}
+
+func parseCA(data map[string][]byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certs, err := cert.ParseCertsPEM(data[CACertKey])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CA certificate: %v", err)
+	}
+	key, err := cert.ParsePrivateKeyPEM(data[CAKeyKey])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CA key: %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("CA key is not an RSA key")
+	}
+	return certs[0], rsaKey, nil
+}
+
+// caBundle returns the CA and the previous CA while it is still valid.
+func caBundle(data map[string][]byte) []byte {
+	bundle := append([]byte{}, data[CACertKey]...)
+	if certs, err := cert.ParseCertsPEM(data[PreviousCACertKey]); err == nil && time.Now().Before(certs[0].NotAfter) {
+		bundle = append(bundle, data[PreviousCACertKey]...)
+	}
+	return bundle
+}
+
+type webhookConfiguration struct {
+	Webhooks []struct {
+		ClientConfig struct {
+			CABundle []byte `json:"caBundle"`
+		} `json:"clientConfig"`
+	} `json:"webhooks"`
+}
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// patchCABundles sets bundle as caBundle of all the webhooks of the
+// mutating and validating configurations named m.webhookConfigs.
+func (m *SecretManager) patchCABundles(bundle []byte) error {
+	if len(m.apiVersion) == 0 {
+		_, err := m.clientset.Discovery().ServerResourcesForGroupVersion("admissionregistration.k8s.io/v1")
+		switch {
+		case err == nil:
+			m.apiVersion = "v1"
+		case errors.IsNotFound(err):
+			m.apiVersion = "v1beta1"
+		default:
+			return err
+		}
+	}
+	restClient := m.clientset.CoreV1().RESTClient()
+	for _, resource := range []string{"mutatingwebhookconfigurations", "validatingwebhookconfigurations"} {
+		for _, name := range m.webhookConfigs {
+			path := fmt.Sprintf("/apis/admissionregistration.k8s.io/%s/%s/%s", m.apiVersion, resource, name)
+			raw, err := restClient.Get().AbsPath(path).DoRaw()
+			if errors.IsNotFound(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			config := webhookConfiguration{}
+			if err := json.Unmarshal(raw, &config); err != nil {
+				return err
+			}
+			patches := []patchOperation{}
+			for i, webhook := range config.Webhooks {
+				if !bytes.Equal(webhook.ClientConfig.CABundle, bundle) {
+					patches = append(patches, patchOperation{
+						Op:    "add",
+						Path:  fmt.Sprintf("/webhooks/%d/clientConfig/caBundle", i),
+						Value: bundle,
+					})
+				}
+			}
+			if len(patches) == 0 {
+				continue
+			}
+			data, err := json.Marshal(patches)
+			if err != nil {
+				return err
+			}
+			if _, err := restClient.Patch(types.JSONPatchType).AbsPath(path).Body(data).DoRaw(); err != nil {
+				return err
+			}
+			glog.Infof("updated caBundle of %s %s", resource, name)
+		}
+	}
+	return nil
+}
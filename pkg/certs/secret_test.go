@@ -0,0 +1,291 @@
+package certs
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/cert"
+)
+
+// newCA returns a CA certificate and key valid until notAfter.
+func newCA(t *testing.T, notAfter time.Time) ([]byte, []byte) {
+	key, err := cert.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "old-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pemEncode(t, der), cert.EncodePrivateKeyPEM(key)
+}
+
+func pemEncode(t *testing.T, der []byte) []byte {
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.EncodeCertPEM(c)
+}
+
+// newServing returns a serving certificate of m signed by the CA.
+func newServing(t *testing.T, m *SecretManager, caPEM, caKeyPEM []byte) ([]byte, []byte) {
+	caCert, caKey, err := parseCA(map[string][]byte{CACertKey: caPEM, CAKeyKey: caKeyPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := cert.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := m.dnsNames()
+	serving, err := cert.NewSignedCert(cert.Config{
+		CommonName: names[len(names)-1],
+		AltNames:   cert.AltNames{DNSNames: names},
+		Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, key, caCert, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.EncodeCertPEM(serving), cert.EncodePrivateKeyPEM(key)
+}
+
+// fakeAPIServer serves the Secret and a mutating webhook configuration, and
+// records the caBundle patches along with the certificate served by reloader
+// when they arrive.
+type fakeAPIServer struct {
+	t        *testing.T
+	reloader *Reloader
+
+	lock   sync.Mutex
+	secret *coreV1.Secret
+	// raced is written by another replica before the next write, which
+	// then fails.
+	raced    *coreV1.Secret
+	bundle   []byte
+	patches  [][]byte
+	servedAt []*x509.Certificate
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	const secretPath = "/api/v1/namespaces/default/secrets/certs"
+	const webhookPath = "/apis/admissionregistration.k8s.io/v1/mutatingwebhookconfigurations/cfg"
+	switch {
+	case r.URL.Path == secretPath && r.Method == "GET":
+		if s.secret == nil {
+			notFound(w)
+			return
+		}
+		json.NewEncoder(w).Encode(s.secret)
+	case s.raced != nil && r.Method == "POST":
+		s.secret, s.raced = s.raced, nil
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"AlreadyExists","code":409}`))
+	case s.raced != nil && r.Method == "PUT":
+		s.secret, s.raced = s.raced, nil
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"Conflict","code":409}`))
+	case (r.URL.Path == secretPath && r.Method == "PUT") || (r.URL.Path == "/api/v1/namespaces/default/secrets" && r.Method == "POST"):
+		secret := &coreV1.Secret{}
+		if err := json.NewDecoder(r.Body).Decode(secret); err != nil {
+			s.t.Fatal(err)
+		}
+		secret.ResourceVersion = "2"
+		s.secret = secret
+		json.NewEncoder(w).Encode(secret)
+	case r.URL.Path == "/apis/admissionregistration.k8s.io/v1":
+		w.Write([]byte(`{"kind":"APIResourceList","apiVersion":"v1","groupVersion":"admissionregistration.k8s.io/v1","resources":[]}`))
+	case r.URL.Path == webhookPath && r.Method == "GET":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"webhooks": []interface{}{map[string]interface{}{"clientConfig": map[string]interface{}{"caBundle": s.bundle}}},
+		})
+	case r.URL.Path == webhookPath && r.Method == "PATCH":
+		body, _ := ioutil.ReadAll(r.Body)
+		var ops []struct {
+			Value []byte `json:"value"`
+		}
+		if err := json.Unmarshal(body, &ops); err != nil {
+			s.t.Fatal(err)
+		}
+		s.bundle = ops[0].Value
+		s.patches = append(s.patches, s.bundle)
+		s.servedAt = append(s.servedAt, s.reloader.Leaf())
+		w.Write([]byte(`{}`))
+	default:
+		notFound(w)
+	}
+}
+
+func notFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+}
+
+func newTestManager(t *testing.T) (*SecretManager, *fakeAPIServer, func()) {
+	reloader := NewReloader()
+	fake := &fakeAPIServer{t: t, reloader: reloader}
+	srv := httptest.NewServer(fake)
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewSecretManager(clientset, "default", "certs", "webhook", []string{"cfg"}, 30*24*time.Hour, reloader)
+	return m, fake, srv.Close
+}
+
+func TestSecretManagerCreates(t *testing.T) {
+	m, fake, stop := newTestManager(t)
+	defer stop()
+	if err := m.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if fake.secret == nil || len(fake.secret.Data[CertKey]) == 0 {
+		t.Fatalf("secret not created")
+	}
+	if reason := m.needsRotation(fake.secret.Data); len(reason) > 0 {
+		t.Errorf("created certificates need rotation: %s", reason)
+	}
+	if len(fake.patches) == 0 || string(fake.bundle) != string(fake.secret.Data[CACertKey]) {
+		t.Errorf("caBundle %q, want the CA", fake.bundle)
+	}
+	if m.reloader.Leaf() == nil {
+		t.Errorf("no certificate served")
+	}
+	// nothing changes on the next sync
+	patches := len(fake.patches)
+	if err := m.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.patches) != patches {
+		t.Errorf("caBundle patched again")
+	}
+}
+
+func TestSecretManagerRotatesCA(t *testing.T) {
+	m, fake, stop := newTestManager(t)
+	defer stop()
+	// the CA expires before a new serving certificate would
+	caPEM, caKeyPEM := newCA(t, time.Now().Add(90*24*time.Hour))
+	certPEM, keyPEM := newServing(t, m, caPEM, caKeyPEM)
+	// a serving certificate about to expire forces the rotation
+	fake.secret = &coreV1.Secret{Data: map[string][]byte{CACertKey: caPEM, CAKeyKey: caKeyPEM, CertKey: []byte("expired"), KeyKey: keyPEM}}
+	fake.secret.Namespace, fake.secret.Name, fake.secret.ResourceVersion = "default", "certs", "1"
+	fake.bundle = caPEM
+	if err := m.reloader.Set(certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	old := m.reloader.Leaf()
+
+	if err := m.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	data := fake.secret.Data
+	if string(data[CACertKey]) == string(caPEM) {
+		t.Fatalf("CA not rotated")
+	}
+	if string(data[PreviousCACertKey]) != string(caPEM) {
+		t.Errorf("previous CA not kept")
+	}
+	if len(fake.patches) == 0 {
+		t.Fatalf("caBundle not patched")
+	}
+	bundle, err := cert.ParseCertsPEM(fake.patches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle) != 2 {
+		t.Errorf("caBundle has %d certificates, want the new and the previous CA", len(bundle))
+	}
+	if served := fake.servedAt[0]; served == nil || !served.Equal(old) {
+		t.Errorf("the new certificate was served before the caBundle was patched")
+	}
+	caCert, _, err := parseCA(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.reloader.Leaf().CheckSignatureFrom(caCert); err != nil {
+		t.Errorf("served certificate is not signed by the new CA: %v", err)
+	}
+}
+
+func TestSecretManagerLosesRace(t *testing.T) {
+	for _, existing := range []bool{false, true} {
+		m, fake, stop := newTestManager(t)
+		// another replica writes its certificates after this one read the
+		// Secret
+		caPEM, caKeyPEM := newCA(t, time.Now().Add(2*365*24*time.Hour))
+		certPEM, keyPEM := newServing(t, m, caPEM, caKeyPEM)
+		fake.raced = &coreV1.Secret{Data: map[string][]byte{CACertKey: caPEM, CAKeyKey: caKeyPEM, CertKey: certPEM, KeyKey: keyPEM}}
+		fake.raced.Namespace, fake.raced.Name, fake.raced.ResourceVersion = "default", "certs", "2"
+		if existing {
+			fake.secret = &coreV1.Secret{Data: map[string][]byte{CertKey: []byte("expired")}}
+			fake.secret.Namespace, fake.secret.Name, fake.secret.ResourceVersion = "default", "certs", "1"
+		}
+
+		if err := m.Sync(); err != nil {
+			t.Fatalf("existing %v: %v", existing, err)
+		}
+		if string(fake.bundle) != string(caPEM) {
+			t.Errorf("existing %v: caBundle is not the CA of the other replica", existing)
+		}
+		served := m.reloader.Leaf()
+		winner, err := cert.ParseCertsPEM(certPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if served == nil || !served.Equal(winner[0]) {
+			t.Errorf("existing %v: not serving the certificate of the other replica", existing)
+		}
+		stop()
+	}
+}
+
+func TestCABundle(t *testing.T) {
+	caPEM, _ := newCA(t, time.Now().Add(time.Hour))
+	expiredPEM, _ := newCA(t, time.Now().Add(-time.Minute))
+	newPEM, _ := newCA(t, time.Now().Add(24*time.Hour))
+	tests := []struct {
+		name     string
+		previous []byte
+		want     int
+	}{
+		{"no previous CA", nil, 1},
+		{"valid previous CA", caPEM, 2},
+		{"expired previous CA", expiredPEM, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bundle, err := cert.ParseCertsPEM(caBundle(map[string][]byte{CACertKey: newPEM, PreviousCACertKey: test.previous}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(bundle) != test.want {
+				t.Errorf("%d certificates, want %d", len(bundle), test.want)
+			}
+		})
+	}
+}
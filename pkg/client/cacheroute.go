@@ -0,0 +1,65 @@
+package client
+
+import (
+	"github.com/fast-ml/nezha/pkg/apis/nezha/v1alpha1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+)
+
+type CacheRoutesGetter interface {
+	CacheRoutes() CacheRouteInterface
+}
+
+type CacheRouteInterface interface {
+	Get(name string, options metav1.GetOptions) (*v1alpha1.CacheRoute, error)
+	List(opts metav1.ListOptions) (*v1alpha1.CacheRouteList, error)
+	Watch(opts metav1.ListOptions) (watch.Interface, error)
+	UpdateStatus(route *v1alpha1.CacheRoute) (*v1alpha1.CacheRoute, error)
+}
+
+type cacheRoutes struct {
+	client rest.Interface
+}
+
+func (c *cacheRoutes) Get(name string, options metav1.GetOptions) (*v1alpha1.CacheRoute, error) {
+	result := &v1alpha1.CacheRoute{}
+	err := c.client.Get().
+		Resource("cacheroutes").
+		Name(name).
+		VersionedParams(&options, ParameterCodec).
+		Do().
+		Into(result)
+	return result, err
+}
+
+func (c *cacheRoutes) List(opts metav1.ListOptions) (*v1alpha1.CacheRouteList, error) {
+	result := &v1alpha1.CacheRouteList{}
+	err := c.client.Get().
+		Resource("cacheroutes").
+		VersionedParams(&opts, ParameterCodec).
+		Do().
+		Into(result)
+	return result, err
+}
+
+func (c *cacheRoutes) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	opts.Watch = true
+	return c.client.Get().
+		Resource("cacheroutes").
+		VersionedParams(&opts, ParameterCodec).
+		Watch()
+}
+
+func (c *cacheRoutes) UpdateStatus(route *v1alpha1.CacheRoute) (*v1alpha1.CacheRoute, error) {
+	result := &v1alpha1.CacheRoute{}
+	err := c.client.Put().
+		Resource("cacheroutes").
+		Name(route.Name).
+		SubResource("status").
+		Body(route).
+		Do().
+		Into(result)
+	return result, err
+}
@@ -0,0 +1,65 @@
+// Package client is a small typed client for the nezha.fast-ml.io API group.
+package client
+
+import (
+	"github.com/fast-ml/nezha/pkg/apis/nezha/v1alpha1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/rest"
+)
+
+var (
+	Scheme         = runtime.NewScheme()
+	Codecs         = serializer.NewCodecFactory(Scheme)
+	ParameterCodec = runtime.NewParameterCodec(Scheme)
+)
+
+func init() {
+	metav1.AddToGroupVersion(Scheme, schema.GroupVersion{Version: "v1"})
+	v1alpha1.AddToScheme(Scheme)
+}
+
+type Interface interface {
+	RESTClient() rest.Interface
+	CacheRoutesGetter
+	DatasetPrefetchesGetter
+}
+
+// NezhaClient talks to the nezha.fast-ml.io/v1alpha1 API.
+type NezhaClient struct {
+	restClient rest.Interface
+}
+
+func NewForConfig(c *rest.Config) (*NezhaClient, error) {
+	config := *c
+	gv := v1alpha1.SchemeGroupVersion
+	config.GroupVersion = &gv
+	config.APIPath = "/apis"
+	config.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: Codecs}
+	if config.UserAgent == "" {
+		config.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+	restClient, err := rest.RESTClientFor(&config)
+	if err != nil {
+		return nil, err
+	}
+	return &NezhaClient{restClient: restClient}, nil
+}
+
+func (c *NezhaClient) RESTClient() rest.Interface {
+	if c == nil {
+		return nil
+	}
+	return c.restClient
+}
+
+func (c *NezhaClient) CacheRoutes() CacheRouteInterface {
+	return &cacheRoutes{client: c.restClient}
+}
+
+func (c *NezhaClient) DatasetPrefetches(namespace string) DatasetPrefetchInterface {
+	return &datasetPrefetches{client: c.restClient, ns: namespace}
+}
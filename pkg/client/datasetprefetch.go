@@ -0,0 +1,82 @@
+package client
+
+import (
+	"github.com/fast-ml/nezha/pkg/apis/nezha/v1alpha1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+)
+
+type DatasetPrefetchesGetter interface {
+	DatasetPrefetches(namespace string) DatasetPrefetchInterface
+}
+
+type DatasetPrefetchInterface interface {
+	Get(name string, options metav1.GetOptions) (*v1alpha1.DatasetPrefetch, error)
+	List(opts metav1.ListOptions) (*v1alpha1.DatasetPrefetchList, error)
+	Watch(opts metav1.ListOptions) (watch.Interface, error)
+	Create(prefetch *v1alpha1.DatasetPrefetch) (*v1alpha1.DatasetPrefetch, error)
+	UpdateStatus(prefetch *v1alpha1.DatasetPrefetch) (*v1alpha1.DatasetPrefetch, error)
+}
+
+type datasetPrefetches struct {
+	client rest.Interface
+	ns     string
+}
+
+func (c *datasetPrefetches) Get(name string, options metav1.GetOptions) (*v1alpha1.DatasetPrefetch, error) {
+	result := &v1alpha1.DatasetPrefetch{}
+	err := c.client.Get().
+		Namespace(c.ns).
+		Resource("datasetprefetches").
+		Name(name).
+		VersionedParams(&options, ParameterCodec).
+		Do().
+		Into(result)
+	return result, err
+}
+
+func (c *datasetPrefetches) List(opts metav1.ListOptions) (*v1alpha1.DatasetPrefetchList, error) {
+	result := &v1alpha1.DatasetPrefetchList{}
+	err := c.client.Get().
+		Namespace(c.ns).
+		Resource("datasetprefetches").
+		VersionedParams(&opts, ParameterCodec).
+		Do().
+		Into(result)
+	return result, err
+}
+
+func (c *datasetPrefetches) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	opts.Watch = true
+	return c.client.Get().
+		Namespace(c.ns).
+		Resource("datasetprefetches").
+		VersionedParams(&opts, ParameterCodec).
+		Watch()
+}
+
+func (c *datasetPrefetches) Create(prefetch *v1alpha1.DatasetPrefetch) (*v1alpha1.DatasetPrefetch, error) {
+	result := &v1alpha1.DatasetPrefetch{}
+	err := c.client.Post().
+		Namespace(c.ns).
+		Resource("datasetprefetches").
+		Body(prefetch).
+		Do().
+		Into(result)
+	return result, err
+}
+
+func (c *datasetPrefetches) UpdateStatus(prefetch *v1alpha1.DatasetPrefetch) (*v1alpha1.DatasetPrefetch, error) {
+	result := &v1alpha1.DatasetPrefetch{}
+	err := c.client.Put().
+		Namespace(c.ns).
+		Resource("datasetprefetches").
+		Name(prefetch.Name).
+		SubResource("status").
+		Body(prefetch).
+		Do().
+		Into(result)
+	return result, err
+}
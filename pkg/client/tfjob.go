@@ -0,0 +1,90 @@
+package client
+
+import (
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+// TFJobGroupVersion is the API of the TFJobs of the Kubeflow training
+// operator.
+var TFJobGroupVersion = schema.GroupVersion{Group: "kubeflow.org", Version: "v1"}
+
+// TFJob is the part of a Kubeflow TFJob Nezha reads.
+type TFJob struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+}
+
+type tfJobList struct {
+	Items []TFJob `json:"items"`
+}
+
+type TFJobsGetter interface {
+	TFJobs(namespace string) TFJobInterface
+}
+
+type TFJobInterface interface {
+	List(labelSelector string) ([]TFJob, error)
+	Patch(name string, pt types.PatchType, data []byte) error
+}
+
+// TFJobClient talks to the kubeflow.org/v1 API.
+type TFJobClient struct {
+	restClient rest.Interface
+}
+
+func NewTFJobClientForConfig(c *rest.Config) (*TFJobClient, error) {
+	config := *c
+	gv := TFJobGroupVersion
+	config.GroupVersion = &gv
+	config.APIPath = "/apis"
+	config.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: Codecs}
+	if config.UserAgent == "" {
+		config.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+	restClient, err := rest.RESTClientFor(&config)
+	if err != nil {
+		return nil, err
+	}
+	return &TFJobClient{restClient: restClient}, nil
+}
+
+func (c *TFJobClient) TFJobs(namespace string) TFJobInterface {
+	return &tfJobs{client: c.restClient, ns: namespace}
+}
+
+type tfJobs struct {
+	client rest.Interface
+	ns     string
+}
+
+func (c *tfJobs) List(labelSelector string) ([]TFJob, error) {
+	data, err := c.client.Get().
+		Namespace(c.ns).
+		Resource("tfjobs").
+		Param("labelSelector", labelSelector).
+		Do().
+		Raw()
+	if err != nil {
+		return nil, err
+	}
+	list := tfJobList{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (c *tfJobs) Patch(name string, pt types.PatchType, data []byte) error {
+	return c.client.Patch(pt).
+		Namespace(c.ns).
+		Resource("tfjobs").
+		Name(name).
+		Body(data).
+		Do().
+		Error()
+}
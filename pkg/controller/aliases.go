@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"encoding/json"
+	"strings"
+
+	coreV1 "k8s.io/api/core/v1"
+)
+
+const (
+	// InjectedConfigAnnotation names the config whose aliases were injected
+	// into a workload. Configs from CacheRoutes are prefixed with
+	// CacheRouteConfigPrefix.
+	InjectedConfigAnnotation = "nezha.fast-ml.io/hostaliases-config"
+	// InjectedAliasesAnnotation holds the JSON encoded aliases owned by Nezha.
+	InjectedAliasesAnnotation = "nezha.fast-ml.io/hostaliases"
+	// DriftAnnotation marks a workload whose injected state differs from its
+	// config.
+	DriftAnnotation = "nezha.fast-ml.io/hostaliases-drift"
+	// InjectedHashAnnotation holds the Hash of the config entry injected into
+	// a workload, so that any change of the entry is detected.
+	InjectedHashAnnotation = "nezha.fast-ml.io/injected-hash"
+	// RolloutAnnotation is set on the pod template of a drifted deployment to
+	// the hash of its config entry. The update rolls it out and lets the
+	// webhook inject the current entry.
+	RolloutAnnotation = "nezha.fast-ml.io/rollout"
+
+	CacheRouteConfigPrefix = "cacheroute/"
+)
+
+// OwnedAliases returns the aliases recorded as injected by Nezha.
+func OwnedAliases(annotations map[string]string) []coreV1.HostAlias {
+	var aliases []coreV1.HostAlias
+	if data, ok := annotations[InjectedAliasesAnnotation]; ok {
+		if err := json.Unmarshal([]byte(data), &aliases); err != nil {
+			return nil
+		}
+	}
+	return aliases
+}
+
+// ReplaceAliases removes the hostnames of owned and desired from current
+// and appends desired, leaving the other aliases untouched.
+func ReplaceAliases(current, owned, desired []coreV1.HostAlias) []coreV1.HostAlias {
+	drop := make(map[string]bool)
+	for _, aliases := range [][]coreV1.HostAlias{owned, desired} {
+		for _, alias := range aliases {
+			for _, hostname := range alias.Hostnames {
+				drop[alias.IP+"/"+hostname] = true
+			}
+		}
+	}
+	var result []coreV1.HostAlias
+	for _, alias := range current {
+		var hostnames []string
+		for _, hostname := range alias.Hostnames {
+			if !drop[alias.IP+"/"+hostname] {
+				hostnames = append(hostnames, hostname)
+			}
+		}
+		if len(hostnames) > 0 {
+			result = append(result, coreV1.HostAlias{IP: alias.IP, Hostnames: hostnames})
+		}
+	}
+	return append(result, desired...)
+}
+
+// SameAliases tells whether a and b map the same hostnames to the same IPs.
+func SameAliases(a, b []coreV1.HostAlias) bool {
+	return HasAliases(a, b) && HasAliases(b, a)
+}
+
+func GetConfigByName(name string, config []Config) *Config {
+	if strings.HasPrefix(name, CacheRouteConfigPrefix) {
+		return nil
+	}
+	for i := range config {
+		if config[i].Name == name {
+			return &config[i]
+		}
+	}
+	return nil
+}
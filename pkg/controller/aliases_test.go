@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+)
+
+func TestReplaceAliases(t *testing.T) {
+	cache := coreV1.HostAlias{IP: "10.96.0.10", Hostnames: []string{"download.tensorflow.org"}}
+	tests := []struct {
+		name    string
+		current []coreV1.HostAlias
+		owned   []coreV1.HostAlias
+		desired []coreV1.HostAlias
+		want    []coreV1.HostAlias
+	}{
+		{
+			name:    "inject",
+			current: []coreV1.HostAlias{{IP: "10.0.0.1", Hostnames: []string{"db"}}},
+			desired: []coreV1.HostAlias{cache},
+			want:    []coreV1.HostAlias{{IP: "10.0.0.1", Hostnames: []string{"db"}}, cache},
+		},
+		{
+			name:    "already injected",
+			current: []coreV1.HostAlias{cache},
+			owned:   []coreV1.HostAlias{cache},
+			desired: []coreV1.HostAlias{cache},
+			want:    []coreV1.HostAlias{cache},
+		},
+		{
+			name:    "new ip",
+			current: []coreV1.HostAlias{cache},
+			owned:   []coreV1.HostAlias{cache},
+			desired: []coreV1.HostAlias{{IP: "10.96.0.11", Hostnames: cache.Hostnames}},
+			want:    []coreV1.HostAlias{{IP: "10.96.0.11", Hostnames: cache.Hostnames}},
+		},
+		{
+			name:    "remove owned hostnames only",
+			current: []coreV1.HostAlias{{IP: "10.96.0.10", Hostnames: []string{"db", "download.tensorflow.org"}}},
+			owned:   []coreV1.HostAlias{cache},
+			want:    []coreV1.HostAlias{{IP: "10.96.0.10", Hostnames: []string{"db"}}},
+		},
+		{
+			name:    "desired hostnames set by the user are not duplicated",
+			current: []coreV1.HostAlias{{IP: "10.96.0.10", Hostnames: []string{"download.tensorflow.org", "db"}}},
+			desired: []coreV1.HostAlias{cache},
+			want:    []coreV1.HostAlias{{IP: "10.96.0.10", Hostnames: []string{"db"}}, cache},
+		},
+		{
+			name:    "user alias to another ip is kept",
+			current: []coreV1.HostAlias{{IP: "10.0.0.1", Hostnames: cache.Hostnames}},
+			owned:   []coreV1.HostAlias{cache},
+			want:    []coreV1.HostAlias{{IP: "10.0.0.1", Hostnames: cache.Hostnames}},
+		},
+		{
+			name:    "nothing left",
+			current: []coreV1.HostAlias{cache},
+			owned:   []coreV1.HostAlias{cache},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ReplaceAliases(test.current, test.owned, test.desired); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ReplaceAliases() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
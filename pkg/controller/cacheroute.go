@@ -0,0 +1,283 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/fast-ml/nezha/pkg/apis/nezha/v1alpha1"
+	"github.com/fast-ml/nezha/pkg/client"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	cacheRouteResyncPeriod = 30 * time.Second
+	cacheRouteStatusPeriod = 30 * time.Second
+)
+
+type routeEntry struct {
+	configs   []Config
+	resources []string
+}
+
+// CacheRouteController keeps the CacheRoutes of the cluster in memory and
+// reports back how often each of them was injected.
+type CacheRouteController struct {
+	client     client.Interface
+	kubeClient kubernetes.Interface
+	informer   cache.SharedIndexInformer
+
+	lock     sync.RWMutex
+	routes   map[string]routeEntry
+	errors   map[string]string
+	resolved map[string]string
+	injected map[string]int64
+}
+
+func NewCacheRouteController(nezhaClient client.Interface, kubeClient kubernetes.Interface) *CacheRouteController {
+	c := &CacheRouteController{
+		client:     nezhaClient,
+		kubeClient: kubeClient,
+		routes:     make(map[string]routeEntry),
+		errors:     make(map[string]string),
+		resolved:   make(map[string]string),
+		injected:   make(map[string]int64),
+	}
+
+	lw := &cache.ListWatch{
+		ListFunc: func(options metaV1.ListOptions) (runtime.Object, error) {
+			return nezhaClient.CacheRoutes().List(options)
+		},
+		WatchFunc: func(options metaV1.ListOptions) (watch.Interface, error) {
+			return nezhaClient.CacheRoutes().Watch(options)
+		},
+	}
+	c.informer = cache.NewSharedIndexInformer(lw, &v1alpha1.CacheRoute{}, cacheRouteResyncPeriod, cache.Indexers{})
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.syncRoute(obj.(*v1alpha1.CacheRoute))
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			c.syncRoute(cur.(*v1alpha1.CacheRoute))
+		},
+		DeleteFunc: func(obj interface{}) {
+			route, ok := obj.(*v1alpha1.CacheRoute)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					return
+				}
+				if route, ok = tombstone.Obj.(*v1alpha1.CacheRoute); !ok {
+					return
+				}
+			}
+			c.removeRoute(route.Name)
+		},
+	})
+	return c
+}
+
+func (c *CacheRouteController) Run(stopCh <-chan struct{}) {
+	glog.Infof("cacheroute controller starting")
+	go c.informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
+		glog.Errorf("cacheroute informer initial sync failed")
+		return
+	}
+	go wait.Until(c.updateStatuses, cacheRouteStatusPeriod, stopCh)
+}
+
+func (c *CacheRouteController) HasSynced() bool {
+	return c.informer.HasSynced()
+}
+
+// Configs returns the host aliases configs of all active routes that apply
+// to the given resource.
+func (c *CacheRouteController) Configs(resource string) []Config {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	var configs []Config
+	for _, entry := range c.routes {
+		if len(entry.resources) > 0 && !containsString(entry.resources, resource) {
+			continue
+		}
+		configs = append(configs, entry.configs...)
+	}
+	return configs
+}
+
+// RecordInjection counts one more workload the named route was injected into.
+func (c *CacheRouteController) RecordInjection(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.injected[name]++
+}
+
+func (c *CacheRouteController) syncRoute(route *v1alpha1.CacheRoute) {
+	ip, err := ResolveTarget(c.kubeClient, route.Spec.Target)
+	if err == nil {
+		err = validateRoute(route, ip)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.routes, route.Name)
+	c.resolved[route.Name] = ip
+	if err != nil {
+		glog.Warningf("invalid cacheroute %s: %v", route.Name, err)
+		c.errors[route.Name] = err.Error()
+		return
+	}
+	delete(c.errors, route.Name)
+	if route.Spec.Policies.Paused {
+		glog.V(3).Infof("cacheroute %s is paused", route.Name)
+		return
+	}
+	c.routes[route.Name] = routeEntry{
+		configs:   RouteToConfig(route, ip),
+		resources: route.Spec.Policies.Resources,
+	}
+	glog.V(5).Infof("cacheroute %s: %+v", route.Name, c.routes[route.Name])
+}
+
+func (c *CacheRouteController) removeRoute(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.routes, name)
+	delete(c.errors, name)
+	delete(c.resolved, name)
+	delete(c.injected, name)
+}
+
+// ResolveTarget returns the IP of a cache target.
+func ResolveTarget(kubeClient kubernetes.Interface, target v1alpha1.CacheTarget) (string, error) {
+	if target.Service == nil {
+		return target.IP, nil
+	}
+	svc, err := kubeClient.CoreV1().Services(target.Service.Namespace).Get(target.Service.Name, metaV1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve target service %s/%s: %v", target.Service.Namespace, target.Service.Name, err)
+	}
+	if len(svc.Spec.ClusterIP) == 0 || svc.Spec.ClusterIP == coreV1.ClusterIPNone {
+		return "", fmt.Errorf("target service %s/%s has no cluster IP", target.Service.Namespace, target.Service.Name)
+	}
+	return svc.Spec.ClusterIP, nil
+}
+
+func (c *CacheRouteController) updateStatuses() {
+	for _, obj := range c.informer.GetStore().List() {
+		route := obj.(*v1alpha1.CacheRoute)
+		c.lock.RLock()
+		lastErr := c.errors[route.Name]
+		ip := c.resolved[route.Name]
+		delta := c.injected[route.Name]
+		c.lock.RUnlock()
+
+		status := route.Status
+		if delta == 0 && status.ObservedGeneration == route.Generation &&
+			status.LastValidationError == lastErr && status.ResolvedIP == ip {
+			continue
+		}
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			latest, err := c.client.CacheRoutes().Get(route.Name, metaV1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			now := metaV1.Now()
+			latest.Status.ObservedGeneration = latest.Generation
+			latest.Status.InjectedWorkloads += delta
+			latest.Status.LastValidationError = lastErr
+			latest.Status.ResolvedIP = ip
+			latest.Status.LastUpdateTime = &now
+			_, err = c.client.CacheRoutes().UpdateStatus(latest)
+			return err
+		})
+		if err != nil {
+			glog.Warningf("failed to update status of cacheroute %s: %v", route.Name, err)
+			continue
+		}
+		c.lock.Lock()
+		c.injected[route.Name] -= delta
+		c.lock.Unlock()
+	}
+}
+
+// RouteToConfig converts a CacheRoute to one host aliases config per selector.
+func RouteToConfig(route *v1alpha1.CacheRoute, ip string) []Config {
+	aliases := []coreV1.HostAlias{{IP: ip, Hostnames: route.Spec.Hostnames}}
+	configs := make([]Config, 0, len(route.Spec.Selectors))
+	for _, sel := range route.Spec.Selectors {
+		configs = append(configs, Config{
+			Name:    route.Name,
+			App:     sel.Key,
+			Label:   sel.Value,
+			Aliases: aliases,
+		})
+	}
+	return configs
+}
+
+func validateRoute(route *v1alpha1.CacheRoute, ip string) error {
+	allErrs := ValidateCacheRoute(route)
+	if route.Spec.Target.Service != nil {
+		allErrs = append(allErrs, validateIP(field.NewPath("status", "resolvedIP"), ip)...)
+	}
+	if len(allErrs) > 0 {
+		return allErrs.ToAggregate()
+	}
+	return nil
+}
+
+// ValidateCacheRoute checks the spec of a route. The IP of a service
+// target is only known once it is resolved and is not checked here.
+func ValidateCacheRoute(route *v1alpha1.CacheRoute) field.ErrorList {
+	var allErrs field.ErrorList
+	spec := field.NewPath("spec")
+	if len(route.Spec.Hostnames) == 0 {
+		allErrs = append(allErrs, field.Required(spec.Child("hostnames"), ""))
+	}
+	for i, hostname := range route.Spec.Hostnames {
+		allErrs = append(allErrs, validateHostname(spec.Child("hostnames").Index(i), hostname)...)
+	}
+	if len(route.Spec.Selectors) == 0 {
+		allErrs = append(allErrs, field.Required(spec.Child("selectors"), ""))
+	}
+	for i, sel := range route.Spec.Selectors {
+		p := spec.Child("selectors").Index(i)
+		for _, msg := range validation.IsQualifiedName(sel.Key) {
+			allErrs = append(allErrs, field.Invalid(p.Child("key"), sel.Key, msg))
+		}
+		for _, msg := range validation.IsValidLabelValue(sel.Value) {
+			allErrs = append(allErrs, field.Invalid(p.Child("value"), sel.Value, msg))
+		}
+	}
+	target := route.Spec.Target
+	switch {
+	case len(target.IP) > 0 && target.Service != nil:
+		allErrs = append(allErrs, field.Invalid(spec.Child("target"), target, "ip and service are mutually exclusive"))
+	case target.Service == nil:
+		allErrs = append(allErrs, validateIP(spec.Child("target", "ip"), target.IP)...)
+	}
+	return allErrs
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
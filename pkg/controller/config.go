@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ConfigLabel marks ConfigMaps holding a hostaliases config, so that they
+// are checked by the validating webhook. Only labeled ConfigMaps are sent to
+// the webhook, so the label is required for validation.
+const ConfigLabel = "nezha.fast-ml.io/config"
+
+// ConfigSnapshot is an immutable version of the hostaliases config.
+type ConfigSnapshot struct {
+	Configs []Config
+	// Version identifies the source content, e.g. the ConfigMap
+	// resourceVersion or the hash of the config file.
+	Version string
+	// Generation is incremented on every successful reload.
+	Generation int64
+	LoadedAt   time.Time
+}
+
+// ConfigStore holds the current ConfigSnapshot. Readers never see a
+// partially loaded config.
+type ConfigStore struct {
+	current atomic.Value
+
+	lock         sync.Mutex
+	reloads      int64
+	rejected     int64
+	lastRejected string
+	listeners    []func(*ConfigSnapshot)
+}
+
+func NewConfigStore() *ConfigStore {
+	s := &ConfigStore{}
+	s.current.Store(&ConfigSnapshot{})
+	return s
+}
+
+// Load returns the current snapshot. Its configs must not be modified.
+func (s *ConfigStore) Load() *ConfigSnapshot {
+	return s.current.Load().(*ConfigSnapshot)
+}
+
+// Loaded tells whether a config was loaded successfully.
+func (s *ConfigStore) Loaded() bool {
+	return s.Load().Generation > 0
+}
+
+// Stats returns the number of successful and rejected reloads.
+func (s *ConfigStore) Stats() (reloads, rejected int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.reloads, s.rejected
+}
+
+// OnUpdate registers f to be called with each new snapshot.
+func (s *ConfigStore) OnUpdate(f func(*ConfigSnapshot)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.listeners = append(s.listeners, f)
+}
+
+// Update swaps in configs parsed from source at version, unless err is set
+// in which case the current snapshot is kept.
+func (s *ConfigStore) Update(source, version string, configs []Config, err error) {
+	s.lock.Lock()
+	if err != nil {
+		if len(version) > 0 && version == s.lastRejected {
+			s.lock.Unlock()
+			return
+		}
+		s.lastRejected = version
+		s.rejected++
+		s.lock.Unlock()
+		glog.Warningf("rejected config %s version %s, keeping generation %d: %v", source, version, s.Load().Generation, err)
+		return
+	}
+	prev := s.Load()
+	if prev.Generation > 0 && prev.Version == version {
+		s.lock.Unlock()
+		return
+	}
+	snapshot := &ConfigSnapshot{
+		Configs:    configs,
+		Version:    version,
+		Generation: prev.Generation + 1,
+		LoadedAt:   time.Now(),
+	}
+	s.current.Store(snapshot)
+	s.reloads++
+	listeners := s.listeners
+	s.lock.Unlock()
+
+	glog.Infof("loaded config %s version %s as generation %d with %d entries", source, version, snapshot.Generation, len(configs))
+	for _, f := range listeners {
+		f(snapshot)
+	}
+}
+
+// NewConfigMapInformer returns an informer keeping store in sync with the
+// "config" key of the ConfigMap namespace/name.
+func NewConfigMapInformer(clientset kubernetes.Interface, namespace, name string, store *ConfigStore) cache.SharedIndexInformer {
+	watchlist := cache.NewListWatchFromClient(clientset.CoreV1().RESTClient(), "configmaps", namespace, fields.OneTermEqualSelector("metadata.name", name))
+	informer := cache.NewSharedIndexInformer(watchlist, &coreV1.ConfigMap{}, resyncPeriod, cache.Indexers{})
+	update := func(obj interface{}) {
+		cm := obj.(*coreV1.ConfigMap)
+		if cm.Labels[ConfigLabel] != "true" {
+			glog.Warningf("configmap %s/%s is not labeled %s=true, its changes are not validated at admission", namespace, name, ConfigLabel)
+		}
+		conf, err := ConfigMapToConfig(cm)
+		var configs []Config
+		if err == nil {
+			configs = *conf
+		}
+		store.Update("configmap "+namespace+"/"+name, cm.ResourceVersion, configs, err)
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: update,
+		UpdateFunc: func(old, cur interface{}) {
+			update(cur)
+		},
+	})
+	return informer
+}
+
+// LoadConfigFile updates store from filePath if its content changed.
+func LoadConfigFile(filePath string, store *ConfigStore) error {
+	source := "file " + filePath
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		err = fmt.Errorf("failed to open %s: %v", filePath, err)
+		store.Update(source, "", nil, err)
+		return err
+	}
+	sum := sha256.Sum256(data)
+	version := hex.EncodeToString(sum[:8])
+	if snapshot := store.Load(); snapshot.Generation > 0 && snapshot.Version == version {
+		return nil
+	}
+	conf, err := BytesToConfig(data)
+	var configs []Config
+	if err == nil {
+		configs = *conf
+	}
+	store.Update(source, version, configs, err)
+	return err
+}
+
+// WatchConfigFile reloads store from filePath every period until stopCh is
+// closed.
+func WatchConfigFile(filePath string, period time.Duration, store *ConfigStore, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		LoadConfigFile(filePath, store)
+	}, period, stopCh)
+}
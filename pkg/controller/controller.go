@@ -1,25 +1,33 @@
 package controller
 
 import (
-	"os"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/golang/glog"
 
 	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 )
 
-var (
-	IntializerConfigmapName string
-	InitializerName         string
-	IntializerNamespace     string
+const (
+	// MissingAliasesAnnotation marks pods that match a config but were
+	// created without its host aliases, e.g. while the webhook was down.
+	MissingAliasesAnnotation = "nezha.fast-ml.io/missing-hostaliases"
+
+	resyncPeriod = 30 * time.Second
+	maxRetries   = 5
 )
 
 type Config struct {
@@ -27,103 +35,207 @@ type Config struct {
 	App     string             `yaml:"app"`
 	Label   string             `yaml:"label"`
 	Aliases []coreV1.HostAlias `yaml:"hostAliases"`
+	// Env is set in the containers of the matched pods, unless they set
+	// the variables themselves.
+	Env []EnvVar `yaml:"env,omitempty"`
+	// Proxy sets the HTTP(S)_PROXY and NO_PROXY env of the matched pods to
+	// a forward proxy.
+	Proxy *ForwardProxy `yaml:"proxy,omitempty"`
+	// DNS serves the hostnames from the Nezha nameserver, which the
+	// matched pods are pointed to, instead of injecting host aliases.
+	// Only DNS entries can have wildcard hostnames.
+	DNS bool `yaml:"dns,omitempty"`
+	// Sidecar injects a cache agent into the matched pods, which the
+	// hostnames are aliased to instead.
+	Sidecar *Sidecar `yaml:"sidecar,omitempty"`
+	// Volumes are mounted into the matched pods, for datasets already on
+	// a volume.
+	Volumes []DatasetVolume `yaml:"volumes,omitempty"`
+}
+
+// Injects tells whether the entry has anything to inject.
+func (c *Config) Injects() bool {
+	return len(c.Aliases) > 0 || len(c.Env) > 0 || c.Proxy != nil || len(c.Volumes) > 0
+}
+
+// HostAliases returns the aliases injected into the matched pods, none for
+// DNS entries and the loopback address of the sidecar for sidecar entries.
+func (c *Config) HostAliases() []coreV1.HostAlias {
+	if c.DNS {
+		return nil
+	}
+	if c.Sidecar != nil {
+		return sidecarAliases(c.Aliases)
+	}
+	return c.Aliases
+}
+
+// Hash identifies everything the entry injects, in the
+// InjectedHashAnnotation.
+func (c *Config) Hash() string {
+	js, _ := json.Marshal(c)
+	sum := sha256.Sum256(js)
+	return hex.EncodeToString(sum[:8])
+}
+
+type Options struct {
+	// Recreate deletes controller-owned pods that missed their host
+	// aliases so that they are recreated through the webhook.
+	Recreate bool
+	// RolloutQPS and RolloutBurst limit how fast workloads are
+	// reconciled after a config change.
+	RolloutQPS   float64
+	RolloutBurst int
+	// DNSConfigMap is the namespace/name of the ConfigMap the Corefile of
+	// the DNS entries is written to, none if empty.
+	DNSConfigMap string
 }
 
+// Controller watches the hostaliases ConfigMap and the pods of the cluster,
+// flags the pods that missed the webhook and reconciles the injected
+// workloads when the config changes.
 type Controller struct {
-	clientset     *kubernetes.Clientset
-	podController cache.Controller
-	config        *[]Config
+	clientset         kubernetes.Interface
+	configMapInformer cache.SharedIndexInformer
+	podInformer       cache.SharedIndexInformer
+	queue             workqueue.RateLimitingInterface
+	workloadQueue     workqueue.RateLimitingInterface
+	recreate          bool
+	store             *ConfigStore
+	dnsConfigMap      string
 }
 
-func NewHostAliasesInitializer(clientset *kubernetes.Clientset, conf *[]Config) *Controller {
+// NewHostAliasesController creates a controller driven by the "config" key
+// of the ConfigMap namespace/name.
+func NewHostAliasesController(clientset kubernetes.Interface, namespace, name string, opts Options) *Controller {
 	c := &Controller{
-		config:    conf,
-		clientset: clientset,
+		clientset:     clientset,
+		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "pods"),
+		workloadQueue: newWorkloadQueue(opts.RolloutQPS, opts.RolloutBurst),
+		recreate:      opts.Recreate,
+		store:         NewConfigStore(),
+		dnsConfigMap:  opts.DNSConfigMap,
 	}
 
+	c.store.OnUpdate(c.configUpdated)
+	c.configMapInformer = NewConfigMapInformer(clientset, namespace, name, c.store)
+
 	restClient := clientset.CoreV1().RESTClient()
-	watchlist := cache.NewListWatchFromClient(restClient, "pods", coreV1.NamespaceAll, fields.Everything())
-
-	// Wrap the returned watchlist to workaround the inability to include
-	// the `IncludeUninitialized` list option when setting up watch clients.
-	includeUninitializedWatchlist := &cache.ListWatch{
-		ListFunc: func(options metaV1.ListOptions) (runtime.Object, error) {
-			options.IncludeUninitialized = true
-			return watchlist.List(options)
-		},
-		WatchFunc: func(options metaV1.ListOptions) (watch.Interface, error) {
-			options.IncludeUninitialized = true
-			return watchlist.Watch(options)
+	podWatchlist := cache.NewListWatchFromClient(restClient, "pods", coreV1.NamespaceAll, fields.Everything())
+	c.podInformer = cache.NewSharedIndexInformer(podWatchlist, &coreV1.Pod{}, resyncPeriod, cache.Indexers{})
+	c.podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(old, cur interface{}) {
+			c.enqueue(cur)
 		},
+	})
+
+	return c
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
 	}
+	c.queue.Add(key)
+}
 
-	resyncPeriod := 30 * time.Second
-
-	_, podController := cache.NewInformer(
-		includeUninitializedWatchlist,
-		&coreV1.Pod{},
-		resyncPeriod,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				err := c.addPod(obj.(*coreV1.Pod))
-				if err != nil {
-					glog.Warningf("failed to initialized: %v", err)
-					return
-				}
-			},
-		},
-	)
-	c.podController = podController
+func (c *Controller) configUpdated(*ConfigSnapshot) {
+	// check all pods and injected workloads again against the new config
+	for _, obj := range c.podInformer.GetStore().List() {
+		c.enqueue(obj)
+	}
+	c.enqueueWorkloads()
+	c.syncDNS()
+}
 
-	return c
+func (c *Controller) getConfig() []Config {
+	return c.store.Load().Configs
 }
 
-func (c *Controller) Run(ctx <-chan struct{}) {
-	glog.Infof("pod controller starting")
-	go c.podController.Run(ctx)
-	glog.Infof("Waiting for pod informer initial sync")
-	wait.Poll(time.Second, 5*time.Minute, func() (bool, error) {
-		return c.podController.HasSynced(), nil
-	})
-	if !c.podController.HasSynced() {
-		glog.Errorf("pod informer controller initial sync timeout")
-		os.Exit(1)
+func (c *Controller) Run(workers int, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+	defer c.workloadQueue.ShutDown()
+
+	glog.Infof("hostaliases controller starting")
+	go c.configMapInformer.Run(stopCh)
+	go c.podInformer.Run(stopCh)
+	glog.Infof("Waiting for informer initial sync")
+	if !cache.WaitForCacheSync(stopCh, c.configMapInformer.HasSynced, c.podInformer.HasSynced) {
+		glog.Errorf("informer initial sync failed")
+		return
 	}
+	for i := 0; i < workers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+		go wait.Until(c.runWorkloadWorker, time.Second, stopCh)
+	}
+	// the Corefile is also written on config updates, this recreates it
+	// if it was deleted or edited
+	go wait.Until(c.syncDNS, time.Minute, stopCh)
+	<-stopCh
+	glog.Infof("hostaliases controller stopping")
 }
 
-func (c *Controller) addPod(pod *coreV1.Pod) error {
-	if pod != nil && pod.ObjectMeta.GetInitializers() != nil {
-		pendingInitializers := pod.ObjectMeta.GetInitializers().Pending
-
-		if InitializerName == pendingInitializers[0].Name {
-			glog.V(3).Infof("Initializing: %s", pod.Name)
-
-			initializedPod := pod.DeepCopy()
-			// Remove self from the list of pending Initializers while preserving ordering.
-			if len(pendingInitializers) == 1 {
-				initializedPod.ObjectMeta.Initializers = nil
-			} else {
-				initializedPod.ObjectMeta.Initializers.Pending = append(pendingInitializers[:0], pendingInitializers[1:]...)
-
-			}
-			if labels := initializedPod.ObjectMeta.GetLabels(); len(labels) > 0 {
-				glog.V(5).Infof("labels %+v", labels)
-				app, ok := labels["app"]
-				if ok {
-					aliases := GetAliases(app, *c.config)
-					if len(aliases) > 0 {
-						pod.Spec.HostAliases = append(pod.Spec.HostAliases, aliases...)
-					}
-				}
-			}
-			_, err := c.clientset.CoreV1().Pods(pod.Namespace).Update(initializedPod)
-			if err != nil {
-				glog.Warning("failed to update pod %s/%s: %v", pod.Namespace, pod.Name, err)
-				return err
-			}
-			glog.V(3).Infof("Initialized: %s", pod.Name)
-		}
+func (c *Controller) runWorker() {
+	for c.processNextItem() {
+	}
+}
+
+func (c *Controller) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.syncPod(key.(string))
+	if err == nil {
+		c.queue.Forget(key)
+		return true
+	}
+	if c.queue.NumRequeues(key) < maxRetries {
+		glog.V(2).Infof("error syncing pod %v, retrying: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	utilruntime.HandleError(fmt.Errorf("dropping pod %q out of the queue: %v", key, err))
+	return true
+}
+
+func (c *Controller) syncPod(key string) error {
+	obj, exists, err := c.podInformer.GetIndexer().GetByKey(key)
+	if err != nil || !exists {
+		return err
+	}
+	pod := obj.(*coreV1.Pod)
+	if pod.DeletionTimestamp != nil || pod.Status.Phase == coreV1.PodSucceeded || pod.Status.Phase == coreV1.PodFailed {
+		return nil
+	}
+	aliases := GetPodAliases(pod.GetLabels(), c.getConfig())
+	if len(aliases) == 0 || HasAliases(pod.Spec.HostAliases, aliases) {
+		return nil
 	}
 
-	return nil
+	if c.recreate && metaV1.GetControllerOf(pod) != nil {
+		glog.Infof("deleting pod %s without host aliases so it gets recreated", key)
+		err := c.clientset.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metaV1.DeleteOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if _, ok := pod.GetAnnotations()[MissingAliasesAnnotation]; ok {
+		return nil
+	}
+	glog.Warningf("pod %s matches a config but has no host aliases", key)
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:"true"}}}`, MissingAliasesAnnotation)
+	_, err = c.clientset.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.MergePatchType, []byte(patch))
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
 }
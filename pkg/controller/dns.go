@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// DNSAnnotation records the nameserver Nezha set in the dnsConfig of a
+	// workload's pod template, so that it is reverted when the workload no
+	// longer matches a DNS entry.
+	DNSAnnotation = "nezha.fast-ml.io/dns"
+	// CorefileKey is the key of the Corefile in the DNS ConfigMap.
+	CorefileKey = "Corefile"
+)
+
+// IsWildcard tells whether hostname is a wildcard, *.example.com, which
+// only DNS entries can serve.
+func IsWildcard(hostname string) bool {
+	return strings.HasPrefix(hostname, "*.")
+}
+
+// PodDNSConfig points a pod in namespace to the Nezha nameserver, keeping
+// the search domains of the cluster.
+func PodDNSConfig(nameserver, namespace, clusterDomain string) *coreV1.PodDNSConfig {
+	ndots := "5"
+	return &coreV1.PodDNSConfig{
+		Nameservers: []string{nameserver},
+		Searches: []string{
+			namespace + ".svc." + clusterDomain,
+			"svc." + clusterDomain,
+			clusterDomain,
+		},
+		Options: []coreV1.PodDNSConfigOption{{Name: "ndots", Value: &ndots}},
+	}
+}
+
+// Corefile renders the CoreDNS config serving the hostnames of the DNS
+// entries of configs and forwarding the other queries to the cluster DNS.
+// Wildcards answer A queries with the IP of their alias and AAAA queries
+// with no record, so that clients do not bypass the cache over IPv6.
+func Corefile(configs []Config) string {
+	var hosts []string
+	wildcards := map[string][]string{}
+	for _, conf := range configs {
+		if !conf.DNS {
+			continue
+		}
+		for _, alias := range conf.Aliases {
+			var names []string
+			for _, hostname := range alias.Hostnames {
+				if IsWildcard(hostname) {
+					wildcards[alias.IP] = append(wildcards[alias.IP], hostname)
+				} else {
+					names = append(names, hostname)
+				}
+			}
+			if len(names) > 0 {
+				hosts = append(hosts, alias.IP+" "+strings.Join(names, " "))
+			}
+		}
+	}
+	ips := make([]string, 0, len(wildcards))
+	for ip := range wildcards {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	var b bytes.Buffer
+	b.WriteString(".:53 {\n    errors\n    health :8080\n    ready :8181\n    reload 10s\n")
+	if len(hosts) > 0 {
+		b.WriteString("    hosts {\n")
+		for _, h := range hosts {
+			fmt.Fprintf(&b, "        %s\n", h)
+		}
+		b.WriteString("        ttl 30\n        fallthrough\n    }\n")
+	}
+	for _, ip := range ips {
+		var matches []string
+		for _, hostname := range wildcards[ip] {
+			domain := regexp.QuoteMeta(strings.TrimPrefix(hostname, "*.") + ".")
+			matches = append(matches, fmt.Sprintf("        match \"^.+\\.%s$\"\n", domain))
+		}
+		fmt.Fprintf(&b, "    template IN A {\n%s        answer \"{{ .Name }} 30 IN A %s\"\n        fallthrough\n    }\n", strings.Join(matches, ""), ip)
+		fmt.Fprintf(&b, "    template IN AAAA {\n%s        rcode NOERROR\n        fallthrough\n    }\n", strings.Join(matches, ""))
+	}
+	b.WriteString("    forward . /etc/resolv.conf\n    cache 30\n}\n")
+	return b.String()
+}
+
+// syncDNS writes the Corefile of the current config to the DNS ConfigMap.
+func (c *Controller) syncDNS() {
+	if len(c.dnsConfigMap) == 0 || !c.store.Loaded() {
+		return
+	}
+	parts := strings.SplitN(c.dnsConfigMap, "/", 2)
+	corefile := Corefile(c.getConfig())
+	cms := c.clientset.CoreV1().ConfigMaps(parts[0])
+	cm, err := cms.Get(parts[1], metaV1.GetOptions{})
+	if errors.IsNotFound(err) {
+		cm = &coreV1.ConfigMap{
+			ObjectMeta: metaV1.ObjectMeta{Namespace: parts[0], Name: parts[1]},
+			Data:       map[string]string{CorefileKey: corefile},
+		}
+		if _, err := cms.Create(cm); err != nil {
+			glog.Errorf("failed to create DNS configmap %s: %v", c.dnsConfigMap, err)
+		}
+		return
+	} else if err != nil {
+		glog.Errorf("failed to get DNS configmap %s: %v", c.dnsConfigMap, err)
+		return
+	}
+	if cm.Data[CorefileKey] == corefile {
+		return
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[CorefileKey] = corefile
+	if _, err := cms.Update(cm); err != nil {
+		glog.Errorf("failed to update DNS configmap %s: %v", c.dnsConfigMap, err)
+		return
+	}
+	glog.Infof("updated Corefile of DNS configmap %s", c.dnsConfigMap)
+}
@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// InjectedEnvAnnotation holds the JSON encoded env variables injected by
+// Nezha into the containers of a workload.
+const InjectedEnvAnnotation = "nezha.fast-ml.io/env"
+
+// EnvVar is an environment variable of a config entry, e.g. an SDK endpoint
+// override such as AWS_ENDPOINT_URL.
+type EnvVar struct {
+	Name  string `yaml:"name" json:"name"`
+	Value string `yaml:"value" json:"value"`
+}
+
+// ForwardProxy is an explicit HTTP proxy, reached with CONNECT for HTTPS.
+type ForwardProxy struct {
+	URL string `yaml:"url"`
+	// NoProxy lists the hosts, domains and CIDRs reached directly, in
+	// addition to DefaultNoProxy and the cluster CIDRs of the webhook.
+	NoProxy []string `yaml:"noProxy,omitempty"`
+}
+
+// DefaultNoProxy are always reached without the forward proxy.
+var DefaultNoProxy = []string{"localhost", "127.0.0.1", ".svc", ".cluster.local"}
+
+// ProxyEnv returns the variables pointing HTTP clients to the proxy, in
+// upper and lower case since tools read either. noProxy is appended to
+// DefaultNoProxy and the NoProxy of the proxy.
+func (p *ForwardProxy) ProxyEnv(noProxy []string) []EnvVar {
+	hosts := append(append(append([]string{}, DefaultNoProxy...), noProxy...), p.NoProxy...)
+	no := strings.Join(hosts, ",")
+	return []EnvVar{
+		{Name: "HTTP_PROXY", Value: p.URL},
+		{Name: "HTTPS_PROXY", Value: p.URL},
+		{Name: "NO_PROXY", Value: no},
+		{Name: "http_proxy", Value: p.URL},
+		{Name: "https_proxy", Value: p.URL},
+		{Name: "no_proxy", Value: no},
+	}
+}
+
+// ParseCIDRs splits a comma separated list of CIDRs.
+func ParseCIDRs(list string) ([]string, error) {
+	var cidrs []string
+	for _, cidr := range strings.Split(list, ",") {
+		if cidr = strings.TrimSpace(cidr); len(cidr) == 0 {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", cidr)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// DetectClusterCIDRs returns the pod CIDRs of the nodes and the address of
+// the kubernetes Service, the one cluster IP clients reach without a .svc
+// name. The service CIDR is not exposed by the API.
+func DetectClusterCIDRs(clientset kubernetes.Interface) ([]string, error) {
+	nodes, err := clientset.CoreV1().Nodes().List(metaV1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %v", err)
+	}
+	var cidrs []string
+	seen := make(map[string]bool)
+	for _, node := range nodes.Items {
+		if cidr := node.Spec.PodCIDR; len(cidr) > 0 && !seen[cidr] {
+			seen[cidr] = true
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	svc, err := clientset.CoreV1().Services("default").Get("kubernetes", metaV1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the kubernetes service: %v", err)
+	}
+	if ip := net.ParseIP(svc.Spec.ClusterIP); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		cidrs = append(cidrs, fmt.Sprintf("%s/%d", ip, bits))
+	}
+	return cidrs, nil
+}
+
+// OwnedEnv returns the env variables recorded as injected by Nezha.
+func OwnedEnv(annotations map[string]string) []EnvVar {
+	var env []EnvVar
+	if data, ok := annotations[InjectedEnvAnnotation]; ok {
+		if err := json.Unmarshal([]byte(data), &env); err != nil {
+			return nil
+		}
+	}
+	return env
+}
+
+// MergeEnv removes the owned variables from current, unless their value was
+// changed since, and appends the desired variables current does not set.
+func MergeEnv(current []coreV1.EnvVar, owned, desired []EnvVar) []coreV1.EnvVar {
+	ownedValues := make(map[string]string)
+	for _, e := range owned {
+		ownedValues[e.Name] = e.Value
+	}
+	var result []coreV1.EnvVar
+	set := make(map[string]bool)
+	for _, e := range current {
+		if v, ok := ownedValues[e.Name]; ok && e.ValueFrom == nil && e.Value == v {
+			continue
+		}
+		result = append(result, e)
+		set[e.Name] = true
+	}
+	for _, e := range desired {
+		if !set[e.Name] {
+			result = append(result, coreV1.EnvVar{Name: e.Name, Value: e.Value})
+		}
+	}
+	return result
+}
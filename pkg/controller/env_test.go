@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestMergeEnv(t *testing.T) {
+	endpoint := EnvVar{Name: "AWS_ENDPOINT_URL", Value: "http://cache"}
+	tests := []struct {
+		name    string
+		current []coreV1.EnvVar
+		owned   []EnvVar
+		desired []EnvVar
+		want    []coreV1.EnvVar
+	}{
+		{
+			name:    "inject",
+			current: []coreV1.EnvVar{{Name: "HOME", Value: "/root"}},
+			desired: []EnvVar{endpoint},
+			want:    []coreV1.EnvVar{{Name: "HOME", Value: "/root"}, {Name: "AWS_ENDPOINT_URL", Value: "http://cache"}},
+		},
+		{
+			name:    "user value wins",
+			current: []coreV1.EnvVar{{Name: "AWS_ENDPOINT_URL", Value: "http://mine"}},
+			desired: []EnvVar{endpoint},
+			want:    []coreV1.EnvVar{{Name: "AWS_ENDPOINT_URL", Value: "http://mine"}},
+		},
+		{
+			name:    "replace owned",
+			current: []coreV1.EnvVar{{Name: "AWS_ENDPOINT_URL", Value: "http://cache"}},
+			owned:   []EnvVar{endpoint},
+			desired: []EnvVar{{Name: "AWS_ENDPOINT_URL", Value: "http://cache2"}},
+			want:    []coreV1.EnvVar{{Name: "AWS_ENDPOINT_URL", Value: "http://cache2"}},
+		},
+		{
+			name:    "remove owned",
+			current: []coreV1.EnvVar{{Name: "HOME", Value: "/root"}, {Name: "AWS_ENDPOINT_URL", Value: "http://cache"}},
+			owned:   []EnvVar{endpoint},
+			want:    []coreV1.EnvVar{{Name: "HOME", Value: "/root"}},
+		},
+		{
+			name:    "keep owned changed by the user",
+			current: []coreV1.EnvVar{{Name: "AWS_ENDPOINT_URL", Value: "http://mine"}},
+			owned:   []EnvVar{endpoint},
+			want:    []coreV1.EnvVar{{Name: "AWS_ENDPOINT_URL", Value: "http://mine"}},
+		},
+		{
+			name: "keep owned name set from a secret",
+			current: []coreV1.EnvVar{{Name: "AWS_ENDPOINT_URL", Value: "http://cache", ValueFrom: &coreV1.EnvVarSource{
+				SecretKeyRef: &coreV1.SecretKeySelector{Key: "endpoint"},
+			}}},
+			owned: []EnvVar{endpoint},
+			want: []coreV1.EnvVar{{Name: "AWS_ENDPOINT_URL", Value: "http://cache", ValueFrom: &coreV1.EnvVarSource{
+				SecretKeyRef: &coreV1.SecretKeySelector{Key: "endpoint"},
+			}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := MergeEnv(test.current, test.owned, test.desired); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("MergeEnv() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDetectClusterCIDRs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var obj interface{}
+		switch r.URL.Path {
+		case "/api/v1/nodes":
+			obj = &coreV1.NodeList{Items: []coreV1.Node{
+				{ObjectMeta: metaV1.ObjectMeta{Name: "a"}, Spec: coreV1.NodeSpec{PodCIDR: "10.244.0.0/24"}},
+				{ObjectMeta: metaV1.ObjectMeta{Name: "b"}, Spec: coreV1.NodeSpec{PodCIDR: "10.244.1.0/24"}},
+				{ObjectMeta: metaV1.ObjectMeta{Name: "c"}, Spec: coreV1.NodeSpec{PodCIDR: "10.244.0.0/24"}},
+				{ObjectMeta: metaV1.ObjectMeta{Name: "d"}},
+			}}
+		case "/api/v1/namespaces/default/services/kubernetes":
+			obj = &coreV1.Service{Spec: coreV1.ServiceSpec{ClusterIP: "10.96.0.1"}}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(obj)
+	}))
+	defer srv.Close()
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidrs, err := DetectClusterCIDRs(clientset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.244.0.0/24", "10.244.1.0/24", "10.96.0.1/32"}
+	if !reflect.DeepEqual(cidrs, want) {
+		t.Errorf("cidrs %v, want %v", cidrs, want)
+	}
+}
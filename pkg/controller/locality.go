@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"fmt"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DatasetNodeLabelPrefix is the prefix of the node labels caches publish for
+// the datasets they hold, e.g. dataset.nezha.fast-ml.io/cifar=true.
+const DatasetNodeLabelPrefix = "dataset.nezha.fast-ml.io/"
+
+// DatasetNodeLabel returns the node label marking a node that holds dataset.
+func DatasetNodeLabel(dataset string) (string, error) {
+	label := DatasetNodeLabelPrefix + dataset
+	if errs := validation.IsQualifiedName(label); len(errs) > 0 {
+		return "", fmt.Errorf("invalid dataset name %q: %v", dataset, errs)
+	}
+	return label, nil
+}
+
+// PreferDatasetNodes returns a copy of affinity with a preferred node
+// affinity term for nodes holding dataset. It returns nil if the term
+// is already there.
+func PreferDatasetNodes(affinity *coreV1.Affinity, dataset string, weight int32) (*coreV1.Affinity, error) {
+	label, err := DatasetNodeLabel(dataset)
+	if err != nil {
+		return nil, err
+	}
+	term := coreV1.PreferredSchedulingTerm{
+		Weight: weight,
+		Preference: coreV1.NodeSelectorTerm{
+			MatchExpressions: []coreV1.NodeSelectorRequirement{{
+				Key:      label,
+				Operator: coreV1.NodeSelectorOpExists,
+			}},
+		},
+	}
+
+	if affinity == nil {
+		affinity = &coreV1.Affinity{}
+	} else {
+		affinity = affinity.DeepCopy()
+	}
+	if affinity.NodeAffinity == nil {
+		affinity.NodeAffinity = &coreV1.NodeAffinity{}
+	}
+	preferred := affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+	for _, t := range preferred {
+		for _, expr := range t.Preference.MatchExpressions {
+			if expr.Key == label {
+				return nil, nil
+			}
+		}
+	}
+	affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(preferred, term)
+	return affinity, nil
+}
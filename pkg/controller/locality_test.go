@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+)
+
+func TestPreferDatasetNodes(t *testing.T) {
+	term := func(key string, weight int32) coreV1.PreferredSchedulingTerm {
+		return coreV1.PreferredSchedulingTerm{
+			Weight: weight,
+			Preference: coreV1.NodeSelectorTerm{
+				MatchExpressions: []coreV1.NodeSelectorRequirement{{Key: key, Operator: coreV1.NodeSelectorOpExists}},
+			},
+		}
+	}
+	preferred := func(terms ...coreV1.PreferredSchedulingTerm) *coreV1.Affinity {
+		return &coreV1.Affinity{NodeAffinity: &coreV1.NodeAffinity{PreferredDuringSchedulingIgnoredDuringExecution: terms}}
+	}
+	zone := term("topology.kubernetes.io/zone", 10)
+	tests := []struct {
+		name     string
+		affinity *coreV1.Affinity
+		dataset  string
+		want     *coreV1.Affinity
+		wantErr  bool
+	}{
+		{
+			name:    "no affinity",
+			dataset: "cifar",
+			want:    preferred(term("dataset.nezha.fast-ml.io/cifar", 50)),
+		},
+		{
+			name:     "pod affinity kept",
+			affinity: &coreV1.Affinity{PodAffinity: &coreV1.PodAffinity{}},
+			dataset:  "cifar",
+			want: &coreV1.Affinity{
+				PodAffinity:  &coreV1.PodAffinity{},
+				NodeAffinity: &coreV1.NodeAffinity{PreferredDuringSchedulingIgnoredDuringExecution: []coreV1.PreferredSchedulingTerm{term("dataset.nezha.fast-ml.io/cifar", 50)}},
+			},
+		},
+		{
+			name:     "appended to other terms",
+			affinity: preferred(zone),
+			dataset:  "cifar",
+			want:     preferred(zone, term("dataset.nezha.fast-ml.io/cifar", 50)),
+		},
+		{
+			name:     "already preferred",
+			affinity: preferred(term("dataset.nezha.fast-ml.io/cifar", 5)),
+			dataset:  "cifar",
+		},
+		{
+			name:    "invalid dataset",
+			dataset: "cifar 10",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var before *coreV1.Affinity
+			if test.affinity != nil {
+				before = test.affinity.DeepCopy()
+			}
+			got, err := PreferDatasetNodes(test.affinity, test.dataset, 50)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("PreferDatasetNodes() error %v, want error %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("PreferDatasetNodes() = %+v, want %+v", got, test.want)
+			}
+			if !reflect.DeepEqual(test.affinity, before) {
+				t.Errorf("PreferDatasetNodes() modified its argument")
+			}
+		})
+	}
+}
@@ -0,0 +1,562 @@
+package controller
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/fast-ml/nezha/pkg/apis/nezha/v1alpha1"
+	"github.com/fast-ml/nezha/pkg/client"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// DatasetAnnotation on a Job names the DatasetPrefetch it reads.
+	DatasetAnnotation = "nezha.fast-ml.io/dataset"
+	// HeldByLabel marks a Job suspended until the named DatasetPrefetch completes.
+	HeldByLabel = "nezha.fast-ml.io/held-by-prefetch"
+
+	prefetchResyncPeriod   = 30 * time.Second
+	prefetchStatusPeriod   = 5 * time.Second
+	prefetchFetchTimeout   = 30 * time.Minute
+	prefetchRetries        = 3
+	defaultPrefetchPort    = 80
+	defaultPrefetchWorkers = 4
+)
+
+// prefetchRetryDelay is the wait before the first retry of a fetch.
+var prefetchRetryDelay = 2 * time.Second
+
+// NewDatasetPrefetchInformer watches DatasetPrefetches in namespace, or in
+// all namespaces when it is empty.
+func NewDatasetPrefetchInformer(nezhaClient client.Interface, namespace string) cache.SharedIndexInformer {
+	lw := &cache.ListWatch{
+		ListFunc: func(options metaV1.ListOptions) (runtime.Object, error) {
+			return nezhaClient.DatasetPrefetches(namespace).List(options)
+		},
+		WatchFunc: func(options metaV1.ListOptions) (watch.Interface, error) {
+			return nezhaClient.DatasetPrefetches(namespace).Watch(options)
+		},
+	}
+	return cache.NewSharedIndexInformer(lw, &v1alpha1.DatasetPrefetch{}, prefetchResyncPeriod, cache.Indexers{})
+}
+
+type prefetchRun struct {
+	generation int64
+	stop       chan struct{}
+
+	total    int64
+	fetched  int64
+	bytes    int64
+	failures int64
+
+	lock    sync.Mutex
+	lastErr string
+}
+
+func (r *prefetchRun) fail(err error) {
+	atomic.AddInt64(&r.failures, 1)
+	r.lock.Lock()
+	r.lastErr = err.Error()
+	r.lock.Unlock()
+}
+
+func (r *prefetchRun) message() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lastErr
+}
+
+// PrefetchController fetches the objects of each DatasetPrefetch through its
+// target cache and releases the jobs held for it once it completes.
+type PrefetchController struct {
+	client     client.Interface
+	kubeClient kubernetes.Interface
+	namespace  string
+	informer   cache.SharedIndexInformer
+	httpClient *http.Client
+
+	// tfJobs releases the TFJobs held for a prefetch when set.
+	tfJobs client.TFJobsGetter
+
+	lock    sync.Mutex
+	running map[string]*prefetchRun
+	// finished holds the generation of the last run of each prefetch, so
+	// that events of that run arriving late do not restart it.
+	finished map[string]int64
+}
+
+// NewPrefetchController returns a controller of the DatasetPrefetches in
+// namespace. tfJobs, when not nil, lets it release held TFJobs.
+func NewPrefetchController(nezhaClient client.Interface, kubeClient kubernetes.Interface, tfJobs client.TFJobsGetter, namespace string) *PrefetchController {
+	c := &PrefetchController{
+		client:     nezhaClient,
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		informer:   NewDatasetPrefetchInformer(nezhaClient, namespace),
+		httpClient: &http.Client{Timeout: prefetchFetchTimeout},
+		tfJobs:     tfJobs,
+		running:    make(map[string]*prefetchRun),
+		finished:   make(map[string]int64),
+	}
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.sync(obj.(*v1alpha1.DatasetPrefetch))
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			c.sync(cur.(*v1alpha1.DatasetPrefetch))
+		},
+		DeleteFunc: c.deleted,
+	})
+	return c
+}
+
+func (c *PrefetchController) Run(stopCh <-chan struct{}) {
+	glog.Infof("prefetch controller starting")
+	go c.informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
+		glog.Errorf("prefetch informer initial sync failed")
+		return
+	}
+	c.releaseOrphans()
+	<-stopCh
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, run := range c.running {
+		close(run.stop)
+		delete(c.running, key)
+	}
+}
+
+func (c *PrefetchController) sync(p *v1alpha1.DatasetPrefetch) {
+	key := p.Namespace + "/" + p.Name
+	if p.Status.ObservedGeneration == p.Generation {
+		switch p.Status.Phase {
+		case v1alpha1.PrefetchComplete:
+			// resync releases jobs admitted while the prefetch was finishing
+			c.releaseJobs(p)
+			return
+		case v1alpha1.PrefetchFailed:
+			// the jobs stay held until the prefetch is updated or deleted
+			return
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation, ok := c.finished[key]; ok && generation >= p.Generation {
+		// a stale event of a run that is over
+		return
+	}
+	if run, ok := c.running[key]; ok {
+		if run.generation == p.Generation {
+			return
+		}
+		glog.V(2).Infof("prefetch %s changed, restarting", key)
+		close(run.stop)
+	}
+	run := &prefetchRun{generation: p.Generation, stop: make(chan struct{})}
+	c.running[key] = run
+	go c.prefetch(p.DeepCopy(), run)
+}
+
+// deleted stops the run of a deleted prefetch and releases its jobs, which
+// would otherwise stay suspended.
+func (c *PrefetchController) deleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	p, ok := obj.(*v1alpha1.DatasetPrefetch)
+	if !ok {
+		return
+	}
+	c.cancel(p.Namespace + "/" + p.Name)
+	c.releaseJobs(p)
+}
+
+func (c *PrefetchController) cancel(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if run, ok := c.running[key]; ok {
+		close(run.stop)
+		delete(c.running, key)
+	}
+	delete(c.finished, key)
+}
+
+func (c *PrefetchController) done(key string, run *prefetchRun) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.running[key] == run {
+		delete(c.running, key)
+		c.finished[key] = run.generation
+	}
+}
+
+func (c *PrefetchController) prefetch(p *v1alpha1.DatasetPrefetch, run *prefetchRun) {
+	key := p.Namespace + "/" + p.Name
+	defer c.done(key, run)
+	glog.Infof("prefetching %s", key)
+
+	now := metaV1.Now()
+	c.updateStatus(p, func(status *v1alpha1.DatasetPrefetchStatus) {
+		*status = v1alpha1.DatasetPrefetchStatus{
+			ObservedGeneration: run.generation,
+			Phase:              v1alpha1.PrefetchRunning,
+			StartTime:          &now,
+		}
+	})
+
+	ip, err := ResolveTarget(c.kubeClient, p.Spec.Target)
+	if err == nil && net.ParseIP(ip) == nil {
+		err = fmt.Errorf("invalid target IP %q", ip)
+	}
+	if err != nil {
+		run.fail(err)
+		c.finish(p, run)
+		return
+	}
+	port := int(p.Spec.Port)
+	if port == 0 {
+		port = defaultPrefetchPort
+	}
+	endpoint := net.JoinHostPort(ip, strconv.Itoa(port))
+
+	urls := make(chan string)
+	go func() {
+		defer close(urls)
+		for _, u := range p.Spec.URLs {
+			atomic.AddInt64(&run.total, 1)
+			select {
+			case urls <- u:
+			case <-run.stop:
+				return
+			}
+		}
+		for _, prefix := range p.Spec.Prefixes {
+			err := c.listPrefix(endpoint, prefix, run.stop, func(u string) bool {
+				atomic.AddInt64(&run.total, 1)
+				select {
+				case urls <- u:
+					return true
+				case <-run.stop:
+					return false
+				}
+			})
+			if err != nil {
+				run.fail(err)
+			}
+		}
+	}()
+
+	workers := int(p.Spec.Parallelism)
+	if workers <= 0 {
+		workers = defaultPrefetchWorkers
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range urls {
+				var n int64
+				err := withRetries(run.stop, func() error {
+					var err error
+					n, err = c.fetch(endpoint, u)
+					return err
+				})
+				if err != nil {
+					glog.V(3).Infof("prefetch %s: %v", key, err)
+					run.fail(err)
+					continue
+				}
+				atomic.AddInt64(&run.fetched, 1)
+				atomic.AddInt64(&run.bytes, n)
+			}
+		}()
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	ticker := time.NewTicker(prefetchStatusPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.updateStatus(p, run.progress)
+		case <-run.stop:
+			glog.Infof("prefetch %s cancelled", key)
+			return
+		case <-finished:
+			c.finish(p, run)
+			return
+		}
+	}
+}
+
+func (r *prefetchRun) progress(status *v1alpha1.DatasetPrefetchStatus) {
+	status.ObservedGeneration = r.generation
+	status.ObjectsTotal = atomic.LoadInt64(&r.total)
+	status.ObjectsFetched = atomic.LoadInt64(&r.fetched)
+	status.BytesFetched = atomic.LoadInt64(&r.bytes)
+	status.Failures = atomic.LoadInt64(&r.failures)
+	status.Message = r.message()
+}
+
+func (c *PrefetchController) finish(p *v1alpha1.DatasetPrefetch, run *prefetchRun) {
+	now := metaV1.Now()
+	phase := v1alpha1.PrefetchComplete
+	if atomic.LoadInt64(&run.failures) > 0 {
+		phase = v1alpha1.PrefetchFailed
+	}
+	c.updateStatus(p, func(status *v1alpha1.DatasetPrefetchStatus) {
+		run.progress(status)
+		status.Phase = phase
+		status.CompletionTime = &now
+		if phase == v1alpha1.PrefetchFailed && p.Spec.HoldJobs {
+			status.Message += "; held jobs wait until the prefetch is updated or deleted"
+		}
+	})
+	glog.Infof("prefetch %s/%s %s: %d objects, %d bytes, %d failures", p.Namespace, p.Name, phase,
+		atomic.LoadInt64(&run.fetched), atomic.LoadInt64(&run.bytes), atomic.LoadInt64(&run.failures))
+	if phase == v1alpha1.PrefetchFailed {
+		if p.Spec.HoldJobs {
+			glog.Warningf("prefetch %s/%s failed, its jobs stay held until it is updated or deleted: %s", p.Namespace, p.Name, run.message())
+		}
+		return
+	}
+	c.releaseJobs(p)
+}
+
+// withRetries calls f until it succeeds, up to prefetchRetries more times,
+// waiting twice as long between each attempt. It gives up when stop is
+// closed and returns the last error.
+func withRetries(stop <-chan struct{}, f func() error) error {
+	delay := prefetchRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt == prefetchRetries {
+			return err
+		}
+		glog.V(3).Infof("retrying in %v: %v", delay, err)
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return err
+		}
+		delay *= 2
+	}
+}
+
+func (c *PrefetchController) updateStatus(p *v1alpha1.DatasetPrefetch, mutate func(*v1alpha1.DatasetPrefetchStatus)) {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := c.client.DatasetPrefetches(p.Namespace).Get(p.Name, metaV1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		mutate(&latest.Status)
+		_, err = c.client.DatasetPrefetches(p.Namespace).UpdateStatus(latest)
+		return err
+	})
+	if err != nil {
+		glog.Warningf("failed to update status of prefetch %s/%s: %v", p.Namespace, p.Name, err)
+	}
+}
+
+// releaseJobs resumes the jobs and TFJobs suspended by the webhook for p.
+func (c *PrefetchController) releaseJobs(p *v1alpha1.DatasetPrefetch) {
+	c.releaseTFJobs(p)
+	jobs, err := c.kubeClient.BatchV1().Jobs(p.Namespace).List(metaV1.ListOptions{
+		LabelSelector: HeldByLabel + "=" + p.Name,
+	})
+	if err != nil {
+		glog.Warningf("failed to list jobs held by prefetch %s/%s: %v", p.Namespace, p.Name, err)
+		return
+	}
+	patch := []byte(fmt.Sprintf(`{"metadata":{"labels":{%q:null}},"spec":{"suspend":false}}`, HeldByLabel))
+	for _, job := range jobs.Items {
+		if _, err := c.kubeClient.BatchV1().Jobs(p.Namespace).Patch(job.Name, types.MergePatchType, patch); err != nil {
+			glog.Warningf("failed to resume job %s/%s: %v", job.Namespace, job.Name, err)
+			continue
+		}
+		glog.Infof("resumed job %s/%s after prefetch %s", job.Namespace, job.Name, p.Name)
+	}
+}
+
+// releaseOrphans resumes the jobs and TFJobs held for prefetches deleted
+// while the controller was not watching.
+func (c *PrefetchController) releaseOrphans() {
+	var held []metaV1.ObjectMeta
+	jobs, err := c.kubeClient.BatchV1().Jobs(c.namespace).List(metaV1.ListOptions{LabelSelector: HeldByLabel})
+	if err != nil {
+		glog.Warningf("failed to list held jobs: %v", err)
+	} else {
+		for _, job := range jobs.Items {
+			held = append(held, job.ObjectMeta)
+		}
+	}
+	if c.tfJobs != nil {
+		tfJobs, err := c.tfJobs.TFJobs(c.namespace).List(HeldByLabel)
+		if err != nil {
+			glog.Warningf("failed to list held tfjobs: %v", err)
+		}
+		for _, tfJob := range tfJobs {
+			held = append(held, tfJob.ObjectMeta)
+		}
+	}
+	released := map[string]bool{}
+	for _, meta := range held {
+		name := meta.Labels[HeldByLabel]
+		key := meta.Namespace + "/" + name
+		if released[key] {
+			continue
+		}
+		if _, exists, _ := c.informer.GetStore().GetByKey(key); exists {
+			continue
+		}
+		released[key] = true
+		glog.Infof("prefetch %s is gone, releasing its jobs", key)
+		c.releaseJobs(&v1alpha1.DatasetPrefetch{ObjectMeta: metaV1.ObjectMeta{Namespace: meta.Namespace, Name: name}})
+	}
+}
+
+// fetch downloads rawURL through the cache at endpoint and returns the
+// number of bytes read.
+func (c *PrefetchController) fetch(endpoint, rawURL string) (int64, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, fmt.Errorf("invalid url %s: %v", rawURL, err)
+	}
+	resp, err := c.get(endpoint, u.Host, u.RequestURI())
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch %s: %v", rawURL, err)
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		return n, fmt.Errorf("failed to read %s: %v", rawURL, err)
+	}
+	return n, nil
+}
+
+func (c *PrefetchController) get(endpoint, host, requestURI string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", "http://"+endpoint+requestURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	// the cache picks the upstream by the Host header
+	req.Host = host
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp, nil
+}
+
+type listBucketResult struct {
+	IsTruncated bool   `xml:"IsTruncated"`
+	NextMarker  string `xml:"NextMarker"`
+	Contents    []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+}
+
+// listPrefix lists a virtual-hosted bucket URL such as
+// http://bucket.s3.amazonaws.com/train/ with the S3/GCS XML API and calls
+// emit with the URL of each object until it returns false.
+func (c *PrefetchController) listPrefix(endpoint, prefix string, stop <-chan struct{}, emit func(string) bool) error {
+	u, err := url.Parse(prefix)
+	if err != nil {
+		return fmt.Errorf("invalid prefix %s: %v", prefix, err)
+	}
+	keyPrefix := strings.TrimPrefix(u.Path, "/")
+	marker := ""
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		query := url.Values{}
+		query.Set("prefix", keyPrefix)
+		if len(marker) > 0 {
+			query.Set("marker", marker)
+		}
+		result := listBucketResult{}
+		err := withRetries(stop, func() error {
+			resp, err := c.get(endpoint, u.Host, "/?"+query.Encode())
+			if err != nil {
+				return fmt.Errorf("failed to list %s: %v", prefix, err)
+			}
+			defer resp.Body.Close()
+			result = listBucketResult{}
+			if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+				return fmt.Errorf("failed to decode listing of %s: %v", prefix, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, object := range result.Contents {
+			if strings.HasSuffix(object.Key, "/") {
+				continue
+			}
+			objectURL := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/" + object.Key}
+			if !emit(objectURL.String()) {
+				return nil
+			}
+			marker = object.Key
+		}
+		if !result.IsTruncated || len(result.Contents) == 0 {
+			return nil
+		}
+		if len(result.NextMarker) > 0 {
+			marker = result.NextMarker
+		}
+	}
+}
+
+func (c *PrefetchController) releaseTFJobs(p *v1alpha1.DatasetPrefetch) {
+	if c.tfJobs == nil {
+		return
+	}
+	tfJobs, err := c.tfJobs.TFJobs(p.Namespace).List(HeldByLabel + "=" + p.Name)
+	if err != nil {
+		glog.Warningf("failed to list tfjobs held by prefetch %s/%s: %v", p.Namespace, p.Name, err)
+		return
+	}
+	patch := []byte(fmt.Sprintf(`{"metadata":{"labels":{%q:null}},"spec":{"runPolicy":{"suspend":false}}}`, HeldByLabel))
+	for _, tfJob := range tfJobs {
+		if err := c.tfJobs.TFJobs(p.Namespace).Patch(tfJob.Name, types.MergePatchType, patch); err != nil {
+			glog.Warningf("failed to resume tfjob %s/%s: %v", tfJob.Namespace, tfJob.Name, err)
+			continue
+		}
+		glog.Infof("resumed tfjob %s/%s after prefetch %s", tfJob.Namespace, tfJob.Name, p.Name)
+	}
+}
@@ -0,0 +1,261 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fast-ml/nezha/pkg/apis/nezha/v1alpha1"
+	"github.com/fast-ml/nezha/pkg/client"
+	batchV1 "k8s.io/api/batch/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestPrefetchSyncIgnoresStaleEvents(t *testing.T) {
+	c := &PrefetchController{
+		running:  make(map[string]*prefetchRun),
+		finished: map[string]int64{"default/cifar": 2},
+	}
+	p := &v1alpha1.DatasetPrefetch{ObjectMeta: metaV1.ObjectMeta{Namespace: "default", Name: "cifar", Generation: 2}}
+	p.Status = v1alpha1.DatasetPrefetchStatus{ObservedGeneration: 2, Phase: v1alpha1.PrefetchRunning}
+	c.sync(p)
+	if len(c.running) != 0 {
+		t.Fatalf("a stale Running event restarted the prefetch")
+	}
+
+	// events of the current run leave it alone
+	c.running["default/cifar"] = &prefetchRun{generation: 3, stop: make(chan struct{})}
+	p.Generation = 3
+	c.sync(p)
+	if run := c.running["default/cifar"]; run == nil || run.generation != 3 {
+		t.Fatalf("running %v, want generation 3", run)
+	}
+	c.done("default/cifar", c.running["default/cifar"])
+	if c.finished["default/cifar"] != 3 {
+		t.Errorf("finished generation %d, want 3", c.finished["default/cifar"])
+	}
+	c.cancel("default/cifar")
+	if _, ok := c.finished["default/cifar"]; ok {
+		t.Errorf("finished generation kept after delete")
+	}
+}
+
+func TestWithRetries(t *testing.T) {
+	delay := prefetchRetryDelay
+	prefetchRetryDelay = time.Millisecond
+	defer func() { prefetchRetryDelay = delay }()
+
+	tests := []struct {
+		name         string
+		failures     int
+		stop         bool
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"success", 0, false, 1, false},
+		{"success after retries", 2, false, 3, false},
+		{"retries exhausted", 10, false, prefetchRetries + 1, true},
+		{"stopped", 10, true, 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stop := make(chan struct{})
+			if test.stop {
+				close(stop)
+			}
+			attempts := 0
+			err := withRetries(stop, func() error {
+				attempts++
+				if attempts <= test.failures {
+					return errors.New("unavailable")
+				}
+				return nil
+			})
+			if attempts != test.wantAttempts {
+				t.Errorf("%d attempts, want %d", attempts, test.wantAttempts)
+			}
+			if (err != nil) != test.wantErr {
+				t.Errorf("error %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// fakePrefetchServer serves held jobs and the cifar DatasetPrefetch, and
+// records the resumed jobs.
+type fakePrefetchServer struct {
+	t *testing.T
+
+	lock     sync.Mutex
+	jobs     []batchV1.Job
+	prefetch *v1alpha1.DatasetPrefetch
+	resumed  []string
+}
+
+func (s *fakePrefetchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	const jobsPath = "/apis/batch/v1/namespaces/default/jobs"
+	const prefetchPath = "/apis/nezha.fast-ml.io/v1alpha1/namespaces/default/datasetprefetches/cifar"
+	switch {
+	case r.URL.Path == jobsPath && r.Method == "GET":
+		selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		list := batchV1.JobList{}
+		for _, job := range s.jobs {
+			if selector.Matches(labels.Set(job.Labels)) {
+				list.Items = append(list.Items, job)
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+	case strings.HasPrefix(r.URL.Path, jobsPath+"/") && r.Method == "PATCH":
+		s.resumed = append(s.resumed, path.Base(r.URL.Path))
+		w.Write([]byte(`{}`))
+	case r.URL.Path == prefetchPath && r.Method == "GET":
+		json.NewEncoder(w).Encode(s.prefetch)
+	case r.URL.Path == prefetchPath+"/status" && r.Method == "PUT":
+		s.prefetch = &v1alpha1.DatasetPrefetch{}
+		if err := json.NewDecoder(r.Body).Decode(s.prefetch); err != nil {
+			s.t.Fatal(err)
+		}
+		json.NewEncoder(w).Encode(s.prefetch)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+	}
+}
+
+func (s *fakePrefetchServer) resumedJobs() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.resumed
+}
+
+// fakeTFJobs holds TFJobs and records the resumed ones.
+type fakeTFJobs struct {
+	held    []client.TFJob
+	resumed []string
+}
+
+func (f *fakeTFJobs) TFJobs(namespace string) client.TFJobInterface {
+	return f
+}
+
+func (f *fakeTFJobs) List(labelSelector string) ([]client.TFJob, error) {
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	var tfJobs []client.TFJob
+	for _, tfJob := range f.held {
+		if selector.Matches(labels.Set(tfJob.Labels)) {
+			tfJobs = append(tfJobs, tfJob)
+		}
+	}
+	return tfJobs, nil
+}
+
+func (f *fakeTFJobs) Patch(name string, pt types.PatchType, data []byte) error {
+	f.resumed = append(f.resumed, name)
+	return nil
+}
+
+func heldBy(prefetch string) metaV1.ObjectMeta {
+	return metaV1.ObjectMeta{Namespace: "default", Labels: map[string]string{HeldByLabel: prefetch}}
+}
+
+// newTestPrefetchController returns a controller of the cifar prefetch
+// with job train and TFJob tf held for it, and job other held for the
+// imagenet prefetch.
+func newTestPrefetchController(t *testing.T) (*PrefetchController, *fakePrefetchServer, *fakeTFJobs, func()) {
+	fake := &fakePrefetchServer{t: t}
+	for name, prefetch := range map[string]string{"train": "cifar", "other": "imagenet"} {
+		job := batchV1.Job{ObjectMeta: heldBy(prefetch)}
+		job.Name = name
+		fake.jobs = append(fake.jobs, job)
+	}
+	fake.prefetch = &v1alpha1.DatasetPrefetch{
+		ObjectMeta: metaV1.ObjectMeta{Namespace: "default", Name: "cifar", Generation: 1},
+		Spec:       v1alpha1.DatasetPrefetchSpec{HoldJobs: true},
+	}
+	tf := client.TFJob{ObjectMeta: heldBy("cifar")}
+	tf.Name = "tf"
+	tfJobs := &fakeTFJobs{held: []client.TFJob{tf}}
+	srv := httptest.NewServer(fake)
+	config := &rest.Config{Host: srv.URL}
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nezhaClient, err := client.NewForConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewPrefetchController(nezhaClient, kubeClient, tfJobs, "default"), fake, tfJobs, srv.Close
+}
+
+func TestPrefetchDeleteReleasesJobs(t *testing.T) {
+	c, fake, tfJobs, stop := newTestPrefetchController(t)
+	defer stop()
+	c.finished["default/cifar"] = 1
+	c.deleted(cache.DeletedFinalStateUnknown{Key: "default/cifar", Obj: fake.prefetch})
+	if got := fake.resumedJobs(); !reflect.DeepEqual(got, []string{"train"}) {
+		t.Errorf("resumed jobs %v, want train", got)
+	}
+	if !reflect.DeepEqual(tfJobs.resumed, []string{"tf"}) {
+		t.Errorf("resumed tfjobs %v, want tf", tfJobs.resumed)
+	}
+	if _, ok := c.finished["default/cifar"]; ok {
+		t.Errorf("finished generation kept after delete")
+	}
+}
+
+func TestPrefetchFailedHoldsJobs(t *testing.T) {
+	c, fake, tfJobs, stop := newTestPrefetchController(t)
+	defer stop()
+	run := &prefetchRun{generation: 1, failures: 1, lastErr: "unexpected status 503"}
+	c.finish(fake.prefetch, run)
+	failed := fake.prefetch
+	if failed.Status.Phase != v1alpha1.PrefetchFailed || !strings.Contains(failed.Status.Message, "held jobs wait") {
+		t.Fatalf("status %+v, want Failed with held jobs", failed.Status)
+	}
+	c.sync(failed)
+	if len(fake.resumedJobs()) > 0 || len(tfJobs.resumed) > 0 || len(c.running) > 0 {
+		t.Fatalf("failed prefetch resumed jobs %v and tfjobs %v or restarted", fake.resumedJobs(), tfJobs.resumed)
+	}
+
+	complete := failed.DeepCopy()
+	complete.Status.Phase = v1alpha1.PrefetchComplete
+	c.sync(complete)
+	if got := fake.resumedJobs(); !reflect.DeepEqual(got, []string{"train"}) {
+		t.Errorf("resumed jobs %v, want train", got)
+	}
+}
+
+func TestPrefetchReleasesOrphans(t *testing.T) {
+	c, fake, tfJobs, stop := newTestPrefetchController(t)
+	defer stop()
+	c.informer.GetStore().Add(fake.prefetch)
+	c.releaseOrphans()
+	if got := fake.resumedJobs(); !reflect.DeepEqual(got, []string{"other"}) {
+		t.Errorf("resumed jobs %v, want other", got)
+	}
+	if len(tfJobs.resumed) > 0 {
+		t.Errorf("resumed tfjobs %v of an existing prefetch", tfJobs.resumed)
+	}
+}
@@ -0,0 +1,206 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/time/rate"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// AutoRolloutLabel on a namespace lets the controller patch the pod
+// templates of its deployments when their config changes. Without it,
+// drifted workloads are only annotated with DriftAnnotation.
+const AutoRolloutLabel = "nezha.fast-ml.io/auto-rollout"
+
+const (
+	deploymentKind = "deployments"
+	jobKind        = "jobs"
+)
+
+func newWorkloadQueue(qps float64, burst int) workqueue.RateLimitingInterface {
+	limiter := workqueue.NewMaxOfRateLimiter(
+		workqueue.DefaultItemBasedRateLimiter(),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(qps), burst)},
+	)
+	return workqueue.NewNamedRateLimitingQueue(limiter, "workloads")
+}
+
+// enqueueWorkloads queues every deployment and job injected by Nezha.
+func (c *Controller) enqueueWorkloads() {
+	dps, err := c.clientset.AppsV1().Deployments(metaV1.NamespaceAll).List(metaV1.ListOptions{})
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to list deployments: %v", err))
+	} else {
+		for _, dp := range dps.Items {
+			if _, ok := dp.Annotations[InjectedConfigAnnotation]; ok {
+				c.workloadQueue.AddRateLimited(deploymentKind + "/" + dp.Namespace + "/" + dp.Name)
+			}
+		}
+	}
+	jobs, err := c.clientset.BatchV1().Jobs(metaV1.NamespaceAll).List(metaV1.ListOptions{})
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to list jobs: %v", err))
+	} else {
+		for _, job := range jobs.Items {
+			if _, ok := job.Annotations[InjectedConfigAnnotation]; ok && job.Status.CompletionTime == nil {
+				c.workloadQueue.AddRateLimited(jobKind + "/" + job.Namespace + "/" + job.Name)
+			}
+		}
+	}
+}
+
+func (c *Controller) runWorkloadWorker() {
+	for c.processNextWorkload() {
+	}
+}
+
+func (c *Controller) processNextWorkload() bool {
+	key, quit := c.workloadQueue.Get()
+	if quit {
+		return false
+	}
+	defer c.workloadQueue.Done(key)
+
+	err := c.syncWorkload(key.(string))
+	if err == nil {
+		c.workloadQueue.Forget(key)
+		return true
+	}
+	if c.workloadQueue.NumRequeues(key) < maxRetries {
+		glog.V(2).Infof("error syncing workload %v, retrying: %v", key, err)
+		c.workloadQueue.AddRateLimited(key)
+		return true
+	}
+	c.workloadQueue.Forget(key)
+	utilruntime.HandleError(fmt.Errorf("dropping workload %q out of the queue: %v", key, err))
+	return true
+}
+
+func (c *Controller) syncWorkload(key string) error {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) != 3 {
+		return nil
+	}
+	kind, namespace, name := parts[0], parts[1], parts[2]
+
+	var meta *metaV1.ObjectMeta
+	var err error
+	switch kind {
+	case deploymentKind:
+		dp, e := c.clientset.AppsV1().Deployments(namespace).Get(name, metaV1.GetOptions{})
+		if e == nil {
+			meta = &dp.ObjectMeta
+		}
+		err = e
+	case jobKind:
+		job, e := c.clientset.BatchV1().Jobs(namespace).Get(name, metaV1.GetOptions{})
+		if e == nil {
+			meta = &job.ObjectMeta
+		}
+		err = e
+	}
+	if errors.IsNotFound(err) || meta == nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	configName := meta.Annotations[InjectedConfigAnnotation]
+	if strings.HasPrefix(configName, CacheRouteConfigPrefix) {
+		return nil
+	}
+	conf := GetConfigByName(configName, c.getConfig())
+	if !injectedStale(meta.Annotations, conf) {
+		if _, ok := meta.Annotations[DriftAnnotation]; ok {
+			return c.patchWorkload(kind, namespace, name, map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]interface{}{DriftAnnotation: nil},
+				},
+			})
+		}
+		return nil
+	}
+
+	// pod templates of jobs are immutable, so their drift is only reported
+	if kind == deploymentKind && c.autoRollout(namespace) {
+		glog.Infof("rolling out %s with updated config %s", key, configName)
+		hash := "none"
+		if conf != nil {
+			hash = conf.Hash()
+		}
+		return c.patchWorkload(kind, namespace, name, map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]interface{}{DriftAnnotation: nil},
+			},
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"annotations": map[string]interface{}{RolloutAnnotation: hash},
+					},
+				},
+			},
+		})
+	}
+
+	if _, ok := meta.Annotations[DriftAnnotation]; ok {
+		return nil
+	}
+	glog.Warningf("%s has a stale injection of config %s", key, configName)
+	return c.patchWorkload(kind, namespace, name, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{DriftAnnotation: "true"},
+		},
+	})
+}
+
+func (c *Controller) autoRollout(namespace string) bool {
+	ns, err := c.clientset.CoreV1().Namespaces().Get(namespace, metaV1.GetOptions{})
+	if err != nil {
+		glog.Warningf("failed to get namespace %s: %v", namespace, err)
+		return false
+	}
+	return ns.Labels[AutoRolloutLabel] == "true"
+}
+
+func (c *Controller) patchWorkload(kind, namespace, name string, patch map[string]interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case deploymentKind:
+		_, err = c.clientset.AppsV1().Deployments(namespace).Patch(name, types.MergePatchType, data)
+	case jobKind:
+		_, err = c.clientset.BatchV1().Jobs(namespace).Patch(name, types.MergePatchType, data)
+	}
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// injectedStale tells whether the state injected into a workload, recorded
+// in its annotations, differs from its config entry conf, nil when the entry
+// no longer exists.
+func injectedStale(annotations map[string]string, conf *Config) bool {
+	hash, ok := annotations[InjectedHashAnnotation]
+	if !ok {
+		// injected before the hash was recorded
+		var desired []coreV1.HostAlias
+		if conf != nil {
+			desired = conf.HostAliases()
+		}
+		return !SameAliases(OwnedAliases(annotations), desired)
+	}
+	return conf == nil || hash != conf.Hash()
+}
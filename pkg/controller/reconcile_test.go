@@ -0,0 +1,37 @@
+package controller
+
+import (
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+)
+
+func TestInjectedStale(t *testing.T) {
+	aliases := []coreV1.HostAlias{{IP: "10.0.0.1", Hostnames: []string{"s3.example.com"}}}
+	conf := &Config{Name: "s3", App: "app", Label: "train", Aliases: aliases}
+	dns := &Config{Name: "s3", App: "app", Label: "train", Aliases: aliases, DNS: true}
+	withEnv := &Config{Name: "s3", App: "app", Label: "train", Aliases: aliases, Env: []EnvVar{{Name: "A", Value: "1"}}}
+	legacy := map[string]string{InjectedAliasesAnnotation: `[{"ip":"10.0.0.1","hostnames":["s3.example.com"]}]`}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		conf        *Config
+		want        bool
+	}{
+		{"same entry", map[string]string{InjectedHashAnnotation: conf.Hash()}, conf, false},
+		{"env added", map[string]string{InjectedHashAnnotation: conf.Hash()}, withEnv, true},
+		{"switched to DNS", map[string]string{InjectedHashAnnotation: conf.Hash()}, dns, true},
+		{"DNS entry", map[string]string{InjectedHashAnnotation: dns.Hash()}, dns, false},
+		{"entry removed", map[string]string{InjectedHashAnnotation: dns.Hash()}, nil, true},
+		{"without hash, same aliases", legacy, conf, false},
+		{"without hash, entry removed", legacy, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := injectedStale(test.annotations, test.conf); got != test.want {
+				t.Errorf("injectedStale() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// SidecarName is the name of the injected cache container and of its
+	// cache volume.
+	SidecarName = "nezha-cache"
+	// SidecarConfigVolume is the name of the volume of the sidecar's
+	// ConfigMap.
+	SidecarConfigVolume = "nezha-cache-config"
+	// SidecarAnnotation holds the hash of the sidecar injected into a
+	// workload, so that it is replaced when its config entry changes.
+	SidecarAnnotation = "nezha.fast-ml.io/sidecar"
+	// DefaultSidecarImage is the Nezha proxy, which runs in parent mode
+	// from the environment below.
+	DefaultSidecarImage = "docker.io/rootfs/nezha-proxy:latest"
+
+	sidecarCacheDir  = "/cache"
+	sidecarConfigDir = "/etc/nezha"
+)
+
+// Sidecar is a cache agent injected into the matched pods. The hostnames of
+// the entry are aliased to 127.0.0.1, where the agent must listen on port
+// 80, and the agent reaches the aliased addresses, the cluster cache, as its
+// parent tier. It gets:
+//
+//	NEZHA_PARENTS    comma separated hostname=IP of the entry's aliases
+//	NEZHA_CACHE_DIR  the cache volume mount, /cache
+//	NEZHA_CONFIG_DIR the ConfigMap mount, /etc/nezha, if any
+type Sidecar struct {
+	// Image of the agent, DefaultSidecarImage when empty.
+	Image string   `yaml:"image,omitempty"`
+	Args  []string `yaml:"args,omitempty"`
+	// ConfigMap, e.g. holding an nginx.conf, is mounted at /etc/nezha.
+	ConfigMap string            `yaml:"configMap,omitempty"`
+	Requests  map[string]string `yaml:"requests,omitempty"`
+	Limits    map[string]string `yaml:"limits,omitempty"`
+	Cache     SidecarCache      `yaml:"cache,omitempty"`
+}
+
+// SidecarCache is the volume of the sidecar cache: an emptyDir, or a
+// generic ephemeral volume when StorageClassName is set.
+type SidecarCache struct {
+	// Medium of the emptyDir, "" or Memory.
+	Medium string `yaml:"medium,omitempty"`
+	// SizeLimit of the emptyDir, or size of the ephemeral volume.
+	SizeLimit        string `yaml:"sizeLimit,omitempty"`
+	StorageClassName string `yaml:"storageClassName,omitempty"`
+}
+
+// sidecarAliases maps every hostname of aliases to the loopback address the
+// sidecar listens on.
+func sidecarAliases(aliases []coreV1.HostAlias) []coreV1.HostAlias {
+	var hostnames []string
+	for _, alias := range aliases {
+		hostnames = append(hostnames, alias.Hostnames...)
+	}
+	if len(hostnames) == 0 {
+		return nil
+	}
+	return []coreV1.HostAlias{{IP: "127.0.0.1", Hostnames: hostnames}}
+}
+
+// Hash identifies the sidecar of aliases in the SidecarAnnotation.
+func (s *Sidecar) Hash(aliases []coreV1.HostAlias) string {
+	js, _ := json.Marshal(struct {
+		Sidecar *Sidecar
+		Aliases []coreV1.HostAlias
+	}{s, aliases})
+	sum := sha256.Sum256(js)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Container returns the sidecar container, whose parents are aliases.
+func (s *Sidecar) Container(aliases []coreV1.HostAlias) (coreV1.Container, error) {
+	var parents []string
+	for _, alias := range aliases {
+		for _, hostname := range alias.Hostnames {
+			parents = append(parents, hostname+"="+alias.IP)
+		}
+	}
+	image := s.Image
+	if len(image) == 0 {
+		image = DefaultSidecarImage
+	}
+	c := coreV1.Container{
+		Name:  SidecarName,
+		Image: image,
+		Args:  s.Args,
+		Env: []coreV1.EnvVar{
+			{Name: "NEZHA_PARENTS", Value: strings.Join(parents, ",")},
+			{Name: "NEZHA_CACHE_DIR", Value: sidecarCacheDir},
+		},
+		VolumeMounts: []coreV1.VolumeMount{{Name: SidecarName, MountPath: sidecarCacheDir}},
+	}
+	if len(s.ConfigMap) > 0 {
+		c.Env = append(c.Env, coreV1.EnvVar{Name: "NEZHA_CONFIG_DIR", Value: sidecarConfigDir})
+		c.VolumeMounts = append(c.VolumeMounts, coreV1.VolumeMount{Name: SidecarConfigVolume, MountPath: sidecarConfigDir, ReadOnly: true})
+	}
+	var err error
+	if c.Resources.Requests, err = resourceList(s.Requests); err != nil {
+		return c, err
+	}
+	if c.Resources.Limits, err = resourceList(s.Limits); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// Volumes returns the volumes of the sidecar. They are maps since the
+// ephemeral volume source is newer than the vendored API.
+func (s *Sidecar) Volumes() []map[string]interface{} {
+	cache := map[string]interface{}{"name": SidecarName}
+	if len(s.Cache.StorageClassName) > 0 {
+		size := s.Cache.SizeLimit
+		if len(size) == 0 {
+			size = "10Gi"
+		}
+		cache["ephemeral"] = map[string]interface{}{
+			"volumeClaimTemplate": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"accessModes":      []string{"ReadWriteOnce"},
+					"storageClassName": s.Cache.StorageClassName,
+					"resources": map[string]interface{}{
+						"requests": map[string]string{"storage": size},
+					},
+				},
+			},
+		}
+	} else {
+		emptyDir := map[string]interface{}{}
+		if len(s.Cache.Medium) > 0 {
+			emptyDir["medium"] = s.Cache.Medium
+		}
+		if len(s.Cache.SizeLimit) > 0 {
+			emptyDir["sizeLimit"] = s.Cache.SizeLimit
+		}
+		cache["emptyDir"] = emptyDir
+	}
+	volumes := []map[string]interface{}{cache}
+	if len(s.ConfigMap) > 0 {
+		volumes = append(volumes, map[string]interface{}{
+			"name":      SidecarConfigVolume,
+			"configMap": map[string]interface{}{"name": s.ConfigMap},
+		})
+	}
+	return volumes
+}
+
+func resourceList(quantities map[string]string) (coreV1.ResourceList, error) {
+	if len(quantities) == 0 {
+		return nil, nil
+	}
+	list := coreV1.ResourceList{}
+	for name, value := range quantities {
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, err
+		}
+		list[coreV1.ResourceName(name)] = q
+	}
+	return list, nil
+}
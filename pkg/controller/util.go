@@ -12,53 +12,94 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-func GetAliases(app string, config []Config) []coreV1.HostAlias {
-	for _, conf := range config {
-		glog.V(5).Infof("looking for %s using %s", app, conf.Label)
-		if conf.Label == app {
-			return conf.Aliases
+// GetPodConfig returns the config matching a pod's labels. A config
+// without an app key matches the pod's "app" label.
+func GetPodConfig(labels map[string]string, config []Config) *Config {
+	for i := range config {
+		key := config[i].App
+		if len(key) == 0 {
+			key = "app"
 		}
+		glog.V(5).Infof("looking for %s using %s", key, config[i].Label)
+		if v, ok := labels[key]; ok && v == config[i].Label {
+			return &config[i]
+		}
+	}
+	return nil
+}
+
+func GetPodAliases(labels map[string]string, config []Config) []coreV1.HostAlias {
+	if conf := GetPodConfig(labels, config); conf != nil {
+		return conf.HostAliases()
 	}
 	return nil
 }
 
+// HasAliases tells whether every hostname of want already resolves to
+// the same IP in have.
+func HasAliases(have, want []coreV1.HostAlias) bool {
+	ips := make(map[string]string)
+	for _, alias := range have {
+		for _, hostname := range alias.Hostnames {
+			ips[hostname] = alias.IP
+		}
+	}
+	for _, alias := range want {
+		for _, hostname := range alias.Hostnames {
+			if ips[hostname] != alias.IP {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func GetAliasesByKV(k, v string, config []Config) []coreV1.HostAlias {
-	for _, conf := range config {
-		glog.V(5).Infof("looking for %s, %s using %s", k, v, conf.Label)
-		if conf.App == k && conf.Label == v {
-			return conf.Aliases
+	if conf := GetConfigByKV(k, v, config); conf != nil {
+		return conf.Aliases
+	}
+	return nil
+}
+
+func GetConfigByKV(k, v string, config []Config) *Config {
+	for i := range config {
+		glog.V(5).Infof("looking for %s, %s using %s", k, v, config[i].Label)
+		if config[i].App == k && config[i].Label == v {
+			return &config[i]
 		}
 	}
 	return nil
 }
 
 func ConfigMapToConfig(cm *coreV1.ConfigMap) (*[]Config, error) {
-	var c []Config
-	err := yaml.Unmarshal([]byte(cm.Data["config"]), &c)
-	if err != nil {
-		return nil, err
-	}
-	glog.V(5).Infof("configs %+v", c)
-	return &c, err
+	return BytesToConfig([]byte(cm.Data["config"]))
 }
 
 func FileToConfig(filePath string) (*[]Config, error) {
-	var c []Config
 	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open %s: %v", filePath, err)
 	}
-	err = yaml.Unmarshal(data, &c)
+	return BytesToConfig(data)
+}
+
+// BytesToConfig parses a hostaliases config, rejecting unknown fields and
+// invalid entries.
+func BytesToConfig(data []byte) (*[]Config, error) {
+	var c []Config
+	err := yaml.UnmarshalStrict(data, &c)
 	if err != nil {
 		return nil, err
 	}
+	if errs := ValidateConfig(c); len(errs) > 0 {
+		return nil, errs.ToAggregate()
+	}
 	glog.V(5).Infof("configs %+v", c)
 	return &c, err
-
 }
 
-// Get a clientset with in-cluster config.
-func GetClient(kubeMaster, kubeConfig string) *kubernetes.Clientset {
+// Get a rest config, in-cluster unless a master or kubeconfig is given.
+func GetClusterConfig(kubeMaster, kubeConfig string) *rest.Config {
 	var clusterConfig *rest.Config
 	var err error
 	if len(kubeMaster) > 0 || len(kubeConfig) > 0 {
@@ -70,8 +111,12 @@ func GetClient(kubeMaster, kubeConfig string) *kubernetes.Clientset {
 	if err != nil {
 		glog.Fatal(err.Error())
 	}
+	return clusterConfig
+}
 
-	clientset, err := kubernetes.NewForConfig(clusterConfig)
+// Get a clientset with in-cluster config.
+func GetClient(kubeMaster, kubeConfig string) *kubernetes.Clientset {
+	clientset, err := kubernetes.NewForConfig(GetClusterConfig(kubeMaster, kubeConfig))
 	if err != nil {
 		glog.Fatal(err)
 	}
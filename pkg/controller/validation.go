@@ -0,0 +1,259 @@
+package controller
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ValidateConfig checks every entry of a hostaliases config and returns
+// all errors found, with the entry index and field path.
+func ValidateConfig(configs []Config) field.ErrorList {
+	var allErrs field.ErrorList
+	names := make(map[string]int)
+	selectors := make(map[string]int)
+	// DNS entries share one nameserver, their hostnames must be unique
+	// across entries
+	dnsHostnames := make(map[string]string)
+	for i, conf := range configs {
+		p := field.NewPath("config").Index(i)
+
+		if len(conf.Name) == 0 {
+			allErrs = append(allErrs, field.Required(p.Child("name"), ""))
+		} else if j, ok := names[conf.Name]; ok {
+			allErrs = append(allErrs, field.Invalid(p.Child("name"), conf.Name, fmt.Sprintf("duplicates the name of entry %d", j)))
+		} else {
+			names[conf.Name] = i
+		}
+
+		key := conf.App
+		if len(key) > 0 {
+			for _, msg := range validation.IsQualifiedName(key) {
+				allErrs = append(allErrs, field.Invalid(p.Child("app"), key, msg))
+			}
+		} else {
+			key = "app"
+		}
+		if len(conf.Label) == 0 {
+			allErrs = append(allErrs, field.Required(p.Child("label"), ""))
+		} else {
+			for _, msg := range validation.IsValidLabelValue(conf.Label) {
+				allErrs = append(allErrs, field.Invalid(p.Child("label"), conf.Label, msg))
+			}
+		}
+		selector := key + "=" + conf.Label
+		if j, ok := selectors[selector]; ok {
+			allErrs = append(allErrs, field.Invalid(p.Child("label"), conf.Label, fmt.Sprintf("selector %s overlaps with entry %d", selector, j)))
+		} else {
+			selectors[selector] = i
+		}
+
+		if !conf.Injects() {
+			allErrs = append(allErrs, field.Required(p.Child("hostAliases"), "hostAliases, env or volumes is required"))
+		}
+		hostnames := make(map[string]string)
+		for j, alias := range conf.Aliases {
+			ap := p.Child("hostAliases").Index(j)
+			allErrs = append(allErrs, validateIP(ap.Child("ip"), alias.IP)...)
+			if len(alias.Hostnames) == 0 {
+				allErrs = append(allErrs, field.Required(ap.Child("hostnames"), ""))
+			}
+			for k, hostname := range alias.Hostnames {
+				hp := ap.Child("hostnames").Index(k)
+				if IsWildcard(hostname) && conf.DNS {
+					allErrs = append(allErrs, validateHostname(hp, strings.TrimPrefix(hostname, "*."))...)
+				} else {
+					allErrs = append(allErrs, validateHostname(hp, hostname)...)
+				}
+				if prev, ok := hostnames[hostname]; ok {
+					allErrs = append(allErrs, field.Invalid(hp, hostname, fmt.Sprintf("already mapped by %s", prev)))
+				} else {
+					hostnames[hostname] = hp.String()
+				}
+				if !conf.DNS {
+					continue
+				}
+				if prev, ok := dnsHostnames[hostname]; ok && !strings.HasPrefix(prev, p.String()+".") {
+					allErrs = append(allErrs, field.Invalid(hp, hostname, fmt.Sprintf("already served by %s", prev)))
+				} else {
+					dnsHostnames[hostname] = hp.String()
+				}
+			}
+		}
+		allErrs = append(allErrs, validateEnv(p.Child("env"), conf.Env)...)
+		if conf.Proxy != nil {
+			allErrs = append(allErrs, validateProxy(p.Child("proxy"), conf.Proxy)...)
+		}
+		if conf.Sidecar != nil {
+			allErrs = append(allErrs, validateSidecar(p, &conf)...)
+		}
+		allErrs = append(allErrs, validateVolumes(p.Child("volumes"), conf.Volumes)...)
+	}
+	return allErrs
+}
+
+func validateEnv(p *field.Path, env []EnvVar) field.ErrorList {
+	var allErrs field.ErrorList
+	names := make(map[string]int)
+	for i, e := range env {
+		ep := p.Index(i).Child("name")
+		if len(e.Name) == 0 {
+			allErrs = append(allErrs, field.Required(ep, ""))
+			continue
+		}
+		for _, msg := range validation.IsEnvVarName(e.Name) {
+			allErrs = append(allErrs, field.Invalid(ep, e.Name, msg))
+		}
+		if j, ok := names[e.Name]; ok {
+			allErrs = append(allErrs, field.Invalid(ep, e.Name, fmt.Sprintf("duplicates variable %d", j)))
+		} else {
+			names[e.Name] = i
+		}
+	}
+	return allErrs
+}
+
+func validateProxy(p *field.Path, proxy *ForwardProxy) field.ErrorList {
+	var allErrs field.ErrorList
+	if len(proxy.URL) == 0 {
+		return append(allErrs, field.Required(p.Child("url"), ""))
+	}
+	u, err := url.Parse(proxy.URL)
+	switch {
+	case err != nil:
+		allErrs = append(allErrs, field.Invalid(p.Child("url"), proxy.URL, err.Error()))
+	case u.Scheme != "http" && u.Scheme != "https":
+		allErrs = append(allErrs, field.NotSupported(p.Child("url"), u.Scheme, []string{"http", "https"}))
+	case len(u.Host) == 0:
+		allErrs = append(allErrs, field.Invalid(p.Child("url"), proxy.URL, "must have a host"))
+	}
+	for i, host := range proxy.NoProxy {
+		if len(host) == 0 || strings.ContainsAny(host, ", ") {
+			allErrs = append(allErrs, field.Invalid(p.Child("noProxy").Index(i), host, "must be a host, domain or CIDR"))
+		}
+	}
+	return allErrs
+}
+
+// validateSidecar checks the sidecar of the entry at path ep.
+func validateSidecar(ep *field.Path, conf *Config) field.ErrorList {
+	var allErrs field.ErrorList
+	sidecar := conf.Sidecar
+	p := ep.Child("sidecar")
+	if conf.DNS {
+		allErrs = append(allErrs, field.Invalid(ep.Child("dns"), conf.DNS, "is exclusive with sidecar"))
+	}
+	if len(conf.Aliases) == 0 {
+		allErrs = append(allErrs, field.Required(ep.Child("hostAliases"), "the sidecar caches the hostAliases"))
+	}
+	if len(sidecar.ConfigMap) > 0 {
+		for _, msg := range validation.IsDNS1123Subdomain(sidecar.ConfigMap) {
+			allErrs = append(allErrs, field.Invalid(p.Child("configMap"), sidecar.ConfigMap, msg))
+		}
+	}
+	for _, list := range []struct {
+		name       string
+		quantities map[string]string
+	}{{"requests", sidecar.Requests}, {"limits", sidecar.Limits}} {
+		for name, value := range list.quantities {
+			if _, err := resource.ParseQuantity(value); err != nil {
+				allErrs = append(allErrs, field.Invalid(p.Child(list.name).Key(name), value, err.Error()))
+			}
+		}
+	}
+	cp := p.Child("cache")
+	if m := sidecar.Cache.Medium; len(m) > 0 && m != string(coreV1.StorageMediumMemory) {
+		allErrs = append(allErrs, field.NotSupported(cp.Child("medium"), m, []string{"", string(coreV1.StorageMediumMemory)}))
+	}
+	if len(sidecar.Cache.StorageClassName) > 0 && len(sidecar.Cache.Medium) > 0 {
+		allErrs = append(allErrs, field.Invalid(cp.Child("medium"), sidecar.Cache.Medium, "only applies to emptyDir, without storageClassName"))
+	}
+	if len(sidecar.Cache.SizeLimit) > 0 {
+		if _, err := resource.ParseQuantity(sidecar.Cache.SizeLimit); err != nil {
+			allErrs = append(allErrs, field.Invalid(cp.Child("sizeLimit"), sidecar.Cache.SizeLimit, err.Error()))
+		}
+	}
+	return allErrs
+}
+
+func validateVolumes(p *field.Path, volumes []DatasetVolume) field.ErrorList {
+	var allErrs field.ErrorList
+	names := make(map[string]int)
+	for i, v := range volumes {
+		vp := p.Index(i)
+		if len(v.Name) == 0 {
+			allErrs = append(allErrs, field.Required(vp.Child("name"), ""))
+		} else if v.Name == SidecarName || v.Name == SidecarConfigVolume {
+			allErrs = append(allErrs, field.Invalid(vp.Child("name"), v.Name, "is reserved for the sidecar"))
+		} else {
+			for _, msg := range validation.IsDNS1123Label(v.Name) {
+				allErrs = append(allErrs, field.Invalid(vp.Child("name"), v.Name, msg))
+			}
+			if j, ok := names[v.Name]; ok {
+				allErrs = append(allErrs, field.Invalid(vp.Child("name"), v.Name, fmt.Sprintf("duplicates the name of volume %d", j)))
+			} else {
+				names[v.Name] = i
+			}
+		}
+		if !path.IsAbs(v.MountPath) {
+			allErrs = append(allErrs, field.Invalid(vp.Child("mountPath"), v.MountPath, "must be an absolute path"))
+		}
+		if path.IsAbs(v.SubPath) || strings.HasPrefix(path.Clean(v.SubPath), "..") {
+			allErrs = append(allErrs, field.Invalid(vp.Child("subPath"), v.SubPath, "must be a relative path within the volume"))
+		}
+		for j, c := range v.Containers {
+			for _, msg := range validation.IsDNS1123Label(c) {
+				allErrs = append(allErrs, field.Invalid(vp.Child("containers").Index(j), c, msg))
+			}
+		}
+
+		sources := 0
+		if len(v.PersistentVolumeClaim) > 0 {
+			sources++
+			for _, msg := range validation.IsDNS1123Subdomain(v.PersistentVolumeClaim) {
+				allErrs = append(allErrs, field.Invalid(vp.Child("persistentVolumeClaim"), v.PersistentVolumeClaim, msg))
+			}
+		}
+		if v.CSI != nil {
+			sources++
+			if len(v.CSI.Driver) == 0 {
+				allErrs = append(allErrs, field.Required(vp.Child("csi", "driver"), ""))
+			}
+		}
+		if len(v.HostPath) > 0 {
+			sources++
+			if !path.IsAbs(v.HostPath) {
+				allErrs = append(allErrs, field.Invalid(vp.Child("hostPath"), v.HostPath, "must be an absolute path"))
+			}
+		}
+		if sources != 1 {
+			allErrs = append(allErrs, field.Invalid(vp, v.Name, "must have exactly one of persistentVolumeClaim, csi or hostPath"))
+		}
+	}
+	return allErrs
+}
+
+func validateIP(p *field.Path, ip string) field.ErrorList {
+	if len(ip) == 0 {
+		return field.ErrorList{field.Required(p, "")}
+	}
+	var allErrs field.ErrorList
+	for _, msg := range validation.IsValidIP(ip) {
+		allErrs = append(allErrs, field.Invalid(p, ip, msg))
+	}
+	return allErrs
+}
+
+func validateHostname(p *field.Path, hostname string) field.ErrorList {
+	var allErrs field.ErrorList
+	for _, msg := range validation.IsDNS1123Subdomain(hostname) {
+		allErrs = append(allErrs, field.Invalid(p, hostname, msg))
+	}
+	return allErrs
+}
@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+)
+
+func TestValidateConfig(t *testing.T) {
+	aliases := []coreV1.HostAlias{{IP: "10.96.0.10", Hostnames: []string{"download.tensorflow.org"}}}
+	tests := []struct {
+		name    string
+		configs []Config
+		// wantFields are the fields of the errors, in order
+		wantFields []string
+	}{
+		{
+			name:    "valid",
+			configs: []Config{{Name: "tf", Label: "training", Aliases: aliases}},
+		},
+		{
+			name:       "missing name and label",
+			configs:    []Config{{Aliases: aliases}},
+			wantFields: []string{"config[0].name", "config[0].label"},
+		},
+		{
+			name:       "invalid app",
+			configs:    []Config{{Name: "tf", App: "-app", Label: "training", Aliases: aliases}},
+			wantFields: []string{"config[0].app"},
+		},
+		{
+			name: "duplicate name and selector",
+			configs: []Config{
+				{Name: "tf", Label: "training", Aliases: aliases},
+				{Name: "tf", Label: "training", Aliases: aliases},
+			},
+			wantFields: []string{"config[1].name", "config[1].label"},
+		},
+		{
+			name:       "nothing to inject",
+			configs:    []Config{{Name: "tf", Label: "training"}},
+			wantFields: []string{"config[0].hostAliases"},
+		},
+		{
+			name: "invalid aliases",
+			configs: []Config{{Name: "tf", Label: "training", Aliases: []coreV1.HostAlias{
+				{IP: "10.96.0", Hostnames: []string{"Download_TF"}},
+				{IP: "10.96.0.11"},
+				{IP: "10.96.0.12", Hostnames: []string{"download.tensorflow.org", "download.tensorflow.org"}},
+			}}},
+			wantFields: []string{
+				"config[0].hostAliases[0].ip",
+				"config[0].hostAliases[0].hostnames[0]",
+				"config[0].hostAliases[1].hostnames",
+				"config[0].hostAliases[2].hostnames[1]",
+			},
+		},
+		{
+			name: "invalid env",
+			configs: []Config{{
+				Name:  "env",
+				Label: "training",
+				Env:   []EnvVar{{Name: "1A"}, {Name: ""}, {Name: "B"}, {Name: "B"}},
+			}},
+			wantFields: []string{
+				"config[0].env[0].name",
+				"config[0].env[1].name",
+				"config[0].env[3].name",
+			},
+		},
+		{
+			name: "invalid proxy",
+			configs: []Config{{
+				Name:  "proxy",
+				Label: "training",
+				Proxy: &ForwardProxy{URL: "socks5://squid:1080", NoProxy: []string{"a, b"}},
+			}},
+			wantFields: []string{
+				"config[0].proxy.url",
+				"config[0].proxy.noProxy[0]",
+			},
+		},
+		{
+			name: "wildcards need dns",
+			configs: []Config{
+				{Name: "s3", Label: "a", Aliases: []coreV1.HostAlias{{IP: "10.96.0.50", Hostnames: []string{"*.s3.amazonaws.com"}}}},
+				{Name: "s3-dns", Label: "b", DNS: true, Aliases: []coreV1.HostAlias{{IP: "10.96.0.50", Hostnames: []string{"*.s3.amazonaws.com"}}}},
+			},
+			wantFields: []string{"config[0].hostAliases[0].hostnames[0]"},
+		},
+		{
+			name: "dns hostnames across entries",
+			configs: []Config{
+				{Name: "a", Label: "a", DNS: true, Aliases: aliases},
+				{Name: "b", Label: "b", DNS: true, Aliases: aliases},
+			},
+			wantFields: []string{"config[1].hostAliases[0].hostnames[0]"},
+		},
+		{
+			name: "invalid sidecar",
+			configs: []Config{{
+				Name:  "sidecar",
+				Label: "training",
+				DNS:   true,
+				Env:   []EnvVar{{Name: "A", Value: "a"}},
+				Sidecar: &Sidecar{
+					Requests: map[string]string{"memory": "lots"},
+					Cache:    SidecarCache{Medium: "HugePages"},
+				},
+			}},
+			wantFields: []string{
+				"config[0].dns",
+				"config[0].hostAliases",
+				"config[0].sidecar.requests[memory]",
+				"config[0].sidecar.cache.medium",
+			},
+		},
+		{
+			name: "invalid volumes",
+			configs: []Config{{
+				Name:  "volumes",
+				Label: "training",
+				Volumes: []DatasetVolume{
+					{Name: "data", MountPath: "/data", PersistentVolumeClaim: "data"},
+					{Name: "data", MountPath: "data", SubPath: "../x", PersistentVolumeClaim: "data"},
+					{Name: SidecarName, MountPath: "/cache"},
+				},
+			}},
+			wantFields: []string{
+				"config[0].volumes[1].name",
+				"config[0].volumes[1].mountPath",
+				"config[0].volumes[1].subPath",
+				"config[0].volumes[2].name",
+				"config[0].volumes[2]",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var fields []string
+			for _, err := range ValidateConfig(test.configs) {
+				fields = append(fields, err.Field)
+			}
+			if !reflect.DeepEqual(fields, test.wantFields) {
+				t.Errorf("ValidateConfig() errors on %v, want %v", fields, test.wantFields)
+			}
+		})
+	}
+}
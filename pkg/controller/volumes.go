@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"encoding/json"
+
+	coreV1 "k8s.io/api/core/v1"
+)
+
+// InjectedVolumesAnnotation holds the JSON encoded dataset volumes injected
+// by Nezha into a workload.
+const InjectedVolumesAnnotation = "nezha.fast-ml.io/volumes"
+
+// DatasetVolume is a pre-populated dataset mounted into the matched pods,
+// from exactly one of a PVC, a CSI ephemeral volume or a host path.
+type DatasetVolume struct {
+	Name      string `yaml:"name" json:"name"`
+	MountPath string `yaml:"mountPath" json:"mountPath"`
+	SubPath   string `yaml:"subPath,omitempty" json:"subPath,omitempty"`
+	ReadOnly  bool   `yaml:"readOnly,omitempty" json:"readOnly,omitempty"`
+	// Containers are the names of the containers and init containers the
+	// volume is mounted into, all containers but the init containers and the
+	// sidecar when empty.
+	Containers []string `yaml:"containers,omitempty" json:"containers,omitempty"`
+
+	// PersistentVolumeClaim is the name of a claim in the pod's namespace.
+	PersistentVolumeClaim string     `yaml:"persistentVolumeClaim,omitempty" json:"persistentVolumeClaim,omitempty"`
+	CSI                   *CSIVolume `yaml:"csi,omitempty" json:"csi,omitempty"`
+	HostPath              string     `yaml:"hostPath,omitempty" json:"hostPath,omitempty"`
+}
+
+// CSIVolume is an ephemeral volume of a CSI driver.
+type CSIVolume struct {
+	Driver           string            `yaml:"driver" json:"driver"`
+	FSType           string            `yaml:"fsType,omitempty" json:"fsType,omitempty"`
+	VolumeAttributes map[string]string `yaml:"volumeAttributes,omitempty" json:"volumeAttributes,omitempty"`
+}
+
+// OwnedVolumes returns the dataset volumes recorded as injected by Nezha.
+func OwnedVolumes(annotations map[string]string) []DatasetVolume {
+	var volumes []DatasetVolume
+	if data, ok := annotations[InjectedVolumesAnnotation]; ok {
+		if err := json.Unmarshal([]byte(data), &volumes); err != nil {
+			return nil
+		}
+	}
+	return volumes
+}
+
+// Volume returns the pod volume. It is a map since CSI ephemeral volumes
+// are newer than the vendored API.
+func (v *DatasetVolume) Volume() map[string]interface{} {
+	volume := map[string]interface{}{"name": v.Name}
+	switch {
+	case len(v.PersistentVolumeClaim) > 0:
+		volume["persistentVolumeClaim"] = map[string]interface{}{"claimName": v.PersistentVolumeClaim, "readOnly": v.ReadOnly}
+	case v.CSI != nil:
+		csi := map[string]interface{}{"driver": v.CSI.Driver, "readOnly": v.ReadOnly}
+		if len(v.CSI.FSType) > 0 {
+			csi["fsType"] = v.CSI.FSType
+		}
+		if len(v.CSI.VolumeAttributes) > 0 {
+			csi["volumeAttributes"] = v.CSI.VolumeAttributes
+		}
+		volume["csi"] = csi
+	default:
+		volume["hostPath"] = map[string]interface{}{"path": v.HostPath}
+	}
+	return volume
+}
+
+// Mounts tells whether the volume is mounted into the container name,
+// which is an init container when init is set.
+func (v *DatasetVolume) Mounts(name string, init bool) bool {
+	if len(v.Containers) == 0 {
+		return !init && name != SidecarName
+	}
+	for _, c := range v.Containers {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeVolumeMounts removes the mounts of the owned and desired volumes from
+// current and appends the mounts of desired into container name. desired
+// must not have the volumes of the pod that Nezha does not own, or their
+// mounts are replaced.
+func MergeVolumeMounts(current []coreV1.VolumeMount, name string, init bool, owned, desired []DatasetVolume) []coreV1.VolumeMount {
+	drop := make(map[string]bool)
+	for _, volumes := range [][]DatasetVolume{owned, desired} {
+		for _, v := range volumes {
+			drop[v.Name] = true
+		}
+	}
+	var result []coreV1.VolumeMount
+	for _, m := range current {
+		if !drop[m.Name] {
+			result = append(result, m)
+		}
+	}
+	for _, v := range desired {
+		if v.Mounts(name, init) {
+			result = append(result, coreV1.VolumeMount{Name: v.Name, MountPath: v.MountPath, SubPath: v.SubPath, ReadOnly: v.ReadOnly})
+		}
+	}
+	return result
+}
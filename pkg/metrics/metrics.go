@@ -0,0 +1,278 @@
+// Package metrics implements the few Prometheus metric types Nezha needs and
+// serves them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics and serves them over HTTP.
+type Registry struct {
+	lock       sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// ServeHTTP writes all metrics in registration order.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	collectors := append([]collector{}, r.collectors...)
+	r.lock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	bw.Flush()
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+// series formats name{labels} with the label values of key and the extra
+// label pair, if any.
+func (d *desc) series(name, key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+escapeLabel(v)+`"`)
+		}
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+`="`+escapeLabel(extra[1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// values is a float64 per label values, shared by counters and gauges.
+type values struct {
+	desc
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func (v *values) add(delta float64, labels []string) {
+	key := v.key(labels)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.values[key] += delta
+}
+
+func (v *values) set(value float64, labels []string) {
+	key := v.key(labels)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.values[key] = value
+}
+
+func (v *values) write(w *bufio.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.header(w)
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s %s\n", v.series(v.name, key), formatFloat(v.values[key]))
+	}
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	values
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{values{desc: desc{name, help, "counter", labels}, values: map[string]float64{}}}
+	r.register(c)
+	return c
+}
+
+// Inc increments the counter of the label values by 1.
+func (c *CounterVec) Inc(labels ...string) {
+	c.add(1, labels)
+}
+
+// Add increments the counter of the label values by delta, which must not
+// be negative.
+func (c *CounterVec) Add(delta float64, labels ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %s cannot decrease", c.name))
+	}
+	c.add(delta, labels)
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct {
+	values
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{values{desc: desc{name, help, "gauge", labels}, values: map[string]float64{}}}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeVec) Set(value float64, labels ...string) {
+	g.set(value, labels)
+}
+
+func (g *GaugeVec) Add(delta float64, labels ...string) {
+	g.add(delta, labels)
+}
+
+// funcMetric is a metric without labels read when it is served.
+type funcMetric struct {
+	desc
+	f func() float64
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.header(w)
+	fmt.Fprintf(w, "%s %s\n", m.name, formatFloat(m.f()))
+}
+
+// NewCounterFunc registers a counter whose value is read from f, which must
+// not decrease.
+func (r *Registry) NewCounterFunc(name, help string, f func() float64) {
+	r.register(&funcMetric{desc{name: name, help: help, kind: "counter"}, f})
+}
+
+// NewGaugeFunc registers a gauge whose value is read from f.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(&funcMetric{desc{name: name, help: help, kind: "gauge"}, f})
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogram
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: append([]float64{}, buckets...),
+		values:  map[string]*histogram{},
+	}
+	sort.Float64s(h.buckets)
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labels ...string) {
+	key := h.key(labels)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.header(w)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_bucket", key, "le", formatFloat(bound)), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_bucket", key, "le", "+Inf"), v.count)
+		fmt.Fprintf(w, "%s %s\n", h.series(h.name+"_sum", key), formatFloat(v.sum))
+		fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_count", key), v.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
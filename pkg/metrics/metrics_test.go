@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	tests := []struct {
+		name     string
+		register func(r *Registry)
+		want     string
+	}{
+		{
+			name: "counter",
+			register: func(r *Registry) {
+				c := r.NewCounterVec("requests_total", "Requests.\nBy code.", "code", "path")
+				c.Inc("500", "/b")
+				c.Add(2, "200", `/a"\`)
+				c.Inc("200", `/a"\`)
+			},
+			want: `# HELP requests_total Requests.\nBy code.
+# TYPE requests_total counter
+requests_total{code="200",path="/a\"\\"} 3
+requests_total{code="500",path="/b"} 1
+`,
+		},
+		{
+			name: "gauge",
+			register: func(r *Registry) {
+				g := r.NewGaugeVec("temperature", "Temperature.", "room")
+				g.Set(20.5, "kitchen")
+				g.Add(-1, "kitchen")
+				g.Set(math.Inf(1), "oven")
+			},
+			want: `# HELP temperature Temperature.
+# TYPE temperature gauge
+temperature{room="kitchen"} 19.5
+temperature{room="oven"} +Inf
+`,
+		},
+		{
+			name: "funcs in registration order",
+			register: func(r *Registry) {
+				r.NewGaugeFunc("capacity_bytes", "Capacity.", func() float64 { return 1 << 30 })
+				r.NewCounterFunc("starts_total", "Starts.", func() float64 { return 3 })
+			},
+			want: `# HELP capacity_bytes Capacity.
+# TYPE capacity_bytes gauge
+capacity_bytes 1.073741824e+09
+# HELP starts_total Starts.
+# TYPE starts_total counter
+starts_total 3
+`,
+		},
+		{
+			name: "histogram",
+			register: func(r *Registry) {
+				h := r.NewHistogramVec("duration_seconds", "Duration.", []float64{1, 0.1}, "route")
+				h.Observe(0.05, "a")
+				h.Observe(0.5, "a")
+				h.Observe(2, "a")
+			},
+			want: `# HELP duration_seconds Duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{route="a",le="0.1"} 1
+duration_seconds_bucket{route="a",le="1"} 2
+duration_seconds_bucket{route="a",le="+Inf"} 3
+duration_seconds_sum{route="a"} 2.55
+duration_seconds_count{route="a"} 3
+`,
+		},
+		{
+			name: "unlabeled histogram without observations",
+			register: func(r *Registry) {
+				r.NewHistogramVec("idle_seconds", "Idle.", DefBuckets)
+			},
+			want: `# HELP idle_seconds Idle.
+# TYPE idle_seconds histogram
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewRegistry()
+			test.register(r)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+			if got := w.Header().Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+				t.Errorf("content type %s", got)
+			}
+			if got := w.Body.String(); got != test.want {
+				t.Errorf("got\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("requests_total", "Requests.", "code")
+	tests := []struct {
+		name string
+		f    func()
+	}{
+		{name: "decreasing counter", f: func() { c.Add(-1, "200") }},
+		{name: "missing label value", f: func() { c.Inc() }},
+		{name: "extra label value", f: func() { c.Inc("200", "GET") }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("no panic")
+				}
+			}()
+			test.f()
+		})
+	}
+}
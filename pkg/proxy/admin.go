@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// ObjectStatus is an object listed by the admin API.
+type ObjectStatus struct {
+	Object
+	Pinned bool `json:"pinned"`
+}
+
+// PurgeResult is the response of /purge.
+type PurgeResult struct {
+	Purged int `json:"purged"`
+}
+
+// AdminHandler serves the metrics, health and statistics of the proxy, and
+// lists, purges and pins the cached objects. It is meant for a port not
+// exposed to the workloads.
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p.registry)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, p.Stats())
+	})
+	mux.HandleFunc("/objects", p.serveObjects)
+	mux.HandleFunc("/purge", p.servePurge)
+	mux.HandleFunc("/pin", p.pinHandler(true))
+	mux.HandleFunc("/unpin", p.pinHandler(false))
+	return mux
+}
+
+// serveObjects lists the objects matching the key, prefix, route and
+// dataset parameters, most recently used first.
+func (p *Proxy) serveObjects(w http.ResponseWriter, r *http.Request) {
+	match := objectFilter(r.URL.Query())
+	objects := []ObjectStatus{}
+	for _, obj := range p.cache.Objects() {
+		if match(&obj) {
+			objects = append(objects, ObjectStatus{Object: obj, Pinned: p.cache.IsPinned(&obj)})
+		}
+	}
+	writeJSON(w, objects)
+}
+
+// servePurge deletes the objects matching the parameters, all of them
+// with all=true.
+func (p *Proxy) servePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	filtered := false
+	for _, param := range []string{"key", "prefix", "route", "dataset"} {
+		filtered = filtered || len(query.Get(param)) > 0
+	}
+	if !filtered && query.Get("all") != "true" {
+		http.Error(w, "key, prefix, route or dataset is required, or all=true", http.StatusBadRequest)
+		return
+	}
+	purged := p.cache.Purge(objectFilter(query))
+	glog.Infof("purged %d objects matching %s", purged, r.URL.RawQuery)
+	writeJSON(w, PurgeResult{Purged: purged})
+}
+
+func (p *Proxy) pinHandler(pinned bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		dataset := r.URL.Query().Get("dataset")
+		if len(dataset) == 0 {
+			http.Error(w, "dataset is required", http.StatusBadRequest)
+			return
+		}
+		if err := p.cache.Pin(dataset, pinned); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		glog.Infof("dataset %s pinned: %v", dataset, pinned)
+		writeJSON(w, p.cache.Pinned())
+	}
+}
+
+// objectFilter matches the objects with the key, prefix, route and dataset
+// of query, those set. Keys and prefixes may be URLs.
+func objectFilter(query url.Values) func(obj *Object) bool {
+	key, prefix := trimScheme(query.Get("key")), trimScheme(query.Get("prefix"))
+	route, dataset := query.Get("route"), query.Get("dataset")
+	return func(obj *Object) bool {
+		return (len(key) == 0 || obj.Key == key) &&
+			strings.HasPrefix(obj.Key, prefix) &&
+			(len(route) == 0 || obj.Route == route) &&
+			(len(dataset) == 0 || obj.Dataset == dataset)
+	}
+}
+
+func trimScheme(s string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(s, "http://"), "https://")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Warningf("failed to write response: %v", err)
+	}
+}
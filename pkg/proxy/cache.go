@@ -0,0 +1,360 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Object is the metadata of a cached object. Hits and LastAccess are only
+// kept in memory.
+type Object struct {
+	// Key is the hostname and request URI, e.g.
+	// bucket.s3.amazonaws.com/train/0.tar.
+	Key     string `json:"key"`
+	Route   string `json:"route"`
+	Dataset string `json:"dataset,omitempty"`
+	Size    int64  `json:"size"`
+	// Stored is when the object was fetched or last revalidated.
+	Stored     time.Time   `json:"stored"`
+	LastAccess time.Time   `json:"lastAccess"`
+	Hits       int64       `json:"hits"`
+	Header     http.Header `json:"header,omitempty"`
+}
+
+func (o *Object) fresh(ttl time.Duration) bool {
+	return time.Since(o.Stored) < ttl
+}
+
+// pinnedFile lists the pinned datasets in the cache directory.
+const pinnedFile = "pinned-datasets"
+
+// Cache keeps objects on disk, each in a file named after the hash of its
+// key next to a JSON file of its metadata, and evicts the least recently
+// used ones beyond its capacity, except those of pinned datasets.
+type Cache struct {
+	dir      string
+	capacity int64
+
+	lock    sync.Mutex
+	lru     *list.List // of *Object, most recently used first
+	objects map[string]*list.Element
+	size    int64
+	pinned  map[string]bool
+	// onAdd and onRemove are called with the lock held.
+	onAdd    func(obj Object)
+	onRemove func(obj Object, evicted bool)
+}
+
+// NewCache loads the objects stored in dir, creating it if needed, and
+// removes the files of partial fills.
+func NewCache(dir string, capacity int64) (*Cache, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("cache capacity must be positive")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		dir:      dir,
+		capacity: capacity,
+		lru:      list.New(),
+		objects:  map[string]*list.Element{},
+		pinned:   map[string]bool{},
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, pinnedFile)); err == nil {
+		var pinned []string
+		if err := json.Unmarshal(data, &pinned); err != nil {
+			return nil, fmt.Errorf("%s: %v", pinnedFile, err)
+		}
+		for _, dataset := range pinned {
+			c.pinned[dataset] = true
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var loaded []*Object
+	known := map[string]bool{pinnedFile: true}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		obj := &Object{}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err == nil {
+			err = json.Unmarshal(data, obj)
+		}
+		if err == nil && c.path(obj.Key)+".json" != filepath.Join(dir, f.Name()) {
+			err = fmt.Errorf("metadata of %s in the wrong file", obj.Key)
+		}
+		if err == nil {
+			var info os.FileInfo
+			if info, err = os.Stat(c.path(obj.Key)); err == nil && info.Size() != obj.Size {
+				err = fmt.Errorf("size %d, metadata says %d", info.Size(), obj.Size)
+			}
+		}
+		if err != nil {
+			glog.Warningf("dropping cached object %s: %v", f.Name(), err)
+			continue
+		}
+		obj.LastAccess = obj.Stored
+		loaded = append(loaded, obj)
+		known[f.Name()] = true
+		known[strings.TrimSuffix(f.Name(), ".json")] = true
+	}
+	for _, f := range files {
+		if !known[f.Name()] {
+			os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].Stored.After(loaded[j].Stored) })
+	for _, obj := range loaded {
+		c.objects[obj.Key] = c.lru.PushBack(obj)
+		c.size += obj.Size
+	}
+	c.evict()
+	glog.Infof("loaded %d cached objects, %d bytes", c.lru.Len(), c.size)
+	return c, nil
+}
+
+func (c *Cache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// Lookup returns the metadata of the object of key.
+func (c *Cache) Lookup(key string) (Object, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.objects[key]
+	if !ok {
+		return Object{}, false
+	}
+	return *e.Value.(*Object), true
+}
+
+// Open returns the content of the object of key and counts a hit.
+func (c *Cache) Open(key string) (*os.File, Object, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.objects[key]
+	if !ok {
+		return nil, Object{}, os.ErrNotExist
+	}
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return nil, Object{}, err
+	}
+	obj := e.Value.(*Object)
+	obj.Hits++
+	obj.LastAccess = time.Now()
+	c.lru.MoveToFront(e)
+	return f, *obj, nil
+}
+
+// Create returns a temporary file to fill with an object before storing it.
+func (c *Cache) Create() (*os.File, error) {
+	return ioutil.TempFile(c.dir, "fill-")
+}
+
+// Store moves the temporary file name to the object of obj.Key, replacing
+// the previous one, and evicts objects beyond the capacity.
+func (c *Cache) Store(name string, obj Object) error {
+	if obj.Size > c.capacity {
+		return fmt.Errorf("%s: %d bytes exceed the cache capacity", obj.Key, obj.Size)
+	}
+	obj.Stored = time.Now()
+	obj.LastAccess = obj.Stored
+	obj.Hits = 0
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.objects[obj.Key]; ok {
+		c.remove(e, false)
+	}
+	if err := os.Rename(name, c.path(obj.Key)); err != nil {
+		return err
+	}
+	if err := c.writeMetadata(&obj); err != nil {
+		os.Remove(c.path(obj.Key))
+		return err
+	}
+	c.objects[obj.Key] = c.lru.PushFront(&obj)
+	c.size += obj.Size
+	if c.onAdd != nil {
+		c.onAdd(obj)
+	}
+	c.evict()
+	return nil
+}
+
+// revalidatedHeaders are updated by a 304 response.
+var revalidatedHeaders = []string{"Cache-Control", "Etag", "Expires", "Last-Modified"}
+
+// Revalidate marks the object of key as fresh, with the validators of a
+// Not Modified response.
+func (c *Cache) Revalidate(key string, header http.Header) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.objects[key]
+	if !ok {
+		return
+	}
+	obj := e.Value.(*Object)
+	obj.Stored = time.Now()
+	for _, h := range revalidatedHeaders {
+		if v, ok := header[h]; ok {
+			if obj.Header == nil {
+				obj.Header = http.Header{}
+			}
+			obj.Header[h] = v
+		}
+	}
+	if err := c.writeMetadata(obj); err != nil {
+		glog.Warningf("failed to save the metadata of %s: %v", key, err)
+	}
+}
+
+// Purge deletes the objects matched by match and returns how many.
+func (c *Cache) Purge(match func(obj *Object) bool) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	purged := 0
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if match(e.Value.(*Object)) {
+			c.remove(e, false)
+			purged++
+		}
+		e = next
+	}
+	return purged
+}
+
+// Pin keeps the objects of dataset, cached now or later, from being
+// evicted, or lets them be evicted again.
+func (c *Cache) Pin(dataset string, pinned bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.pinned[dataset] == pinned {
+		return nil
+	}
+	if pinned {
+		c.pinned[dataset] = true
+	} else {
+		delete(c.pinned, dataset)
+		defer c.evict()
+	}
+	datasets := c.pinnedDatasets()
+	data, err := json.Marshal(datasets)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(c.dir, pinnedFile), data, 0644)
+	}
+	return err
+}
+
+// Pinned returns the pinned datasets, sorted.
+func (c *Cache) Pinned() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.pinnedDatasets()
+}
+
+func (c *Cache) pinnedDatasets() []string {
+	datasets := []string{}
+	for dataset := range c.pinned {
+		datasets = append(datasets, dataset)
+	}
+	sort.Strings(datasets)
+	return datasets
+}
+
+// IsPinned tells whether the dataset of obj is pinned.
+func (c *Cache) IsPinned(obj *Object) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.isPinned(obj)
+}
+
+func (c *Cache) isPinned(obj *Object) bool {
+	return len(obj.Dataset) > 0 && c.pinned[obj.Dataset]
+}
+
+// Objects returns the cached objects, most recently used first.
+func (c *Cache) Objects() []Object {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	objects := make([]Object, 0, c.lru.Len())
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		objects = append(objects, *e.Value.(*Object))
+	}
+	return objects
+}
+
+// Usage returns the number of objects and their size in bytes.
+func (c *Cache) Usage() (objects int, size int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len(), c.size
+}
+
+func (c *Cache) Capacity() int64 {
+	return c.capacity
+}
+
+// watch calls add with the objects already cached, then sets the
+// callbacks of the objects stored and removed.
+func (c *Cache) watch(add func(obj Object), remove func(obj Object, evicted bool)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		add(*e.Value.(*Object))
+	}
+	c.onAdd, c.onRemove = add, remove
+}
+
+func (c *Cache) writeMetadata(obj *Object) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path(obj.Key)+".json", data, 0644)
+}
+
+func (c *Cache) evict() {
+	for e := c.lru.Back(); e != nil && c.size > c.capacity; {
+		prev := e.Prev()
+		if !c.isPinned(e.Value.(*Object)) {
+			c.remove(e, true)
+		}
+		e = prev
+	}
+}
+
+func (c *Cache) remove(e *list.Element, evicted bool) {
+	obj := e.Value.(*Object)
+	c.lru.Remove(e)
+	delete(c.objects, obj.Key)
+	c.size -= obj.Size
+	os.Remove(c.path(obj.Key))
+	os.Remove(c.path(obj.Key) + ".json")
+	if c.onRemove != nil {
+		c.onRemove(*obj, evicted)
+	}
+}
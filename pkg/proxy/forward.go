@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/client-go/util/cert"
+)
+
+// Modes of the requests served as a forward proxy.
+const (
+	// forwardHTTP is a request to a hostname without route.
+	forwardHTTP = "http"
+	// forwardTunnel is a CONNECT relayed as is.
+	forwardTunnel = "tunnel"
+	// forwardBump is a CONNECT to a route with bump, decrypted and served
+	// from the cache.
+	forwardBump   = "bump"
+	forwardDenied = "denied"
+	forwardError  = "error"
+)
+
+// tunnelPort is the only port CONNECT is allowed to.
+const tunnelPort = "443"
+
+// Bumper issues the certificates of the bumped hostnames, signed by a CA
+// the workloads trust.
+type Bumper struct {
+	caCert *x509.Certificate
+	caKey  *rsa.PrivateKey
+	key    *rsa.PrivateKey
+
+	lock  sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// NewBumper returns a Bumper signing with the PEM encoded CA certificate
+// and RSA key.
+func NewBumper(certPEM, keyPEM []byte) (*Bumper, error) {
+	certs, err := cert.ParseCertsPEM(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA certificate: %v", err)
+	}
+	key, err := cert.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA key: %v", err)
+	}
+	caKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("CA key is not an RSA key")
+	}
+	// a single key for every certificate, they live as long as the proxy
+	leafKey, err := cert.NewPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	return &Bumper{caCert: certs[0], caKey: caKey, key: leafKey, certs: map[string]*tls.Certificate{}}, nil
+}
+
+// certificate returns the certificate of host, issued on first use.
+func (b *Bumper) certificate(host string) (*tls.Certificate, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if c, ok := b.certs[host]; ok && time.Now().Before(c.Leaf.NotAfter) {
+		return c, nil
+	}
+	leaf, err := cert.NewSignedCert(cert.Config{
+		CommonName: host,
+		AltNames:   cert.AltNames{DNSNames: []string{host}},
+		Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, b.key, b.caCert, b.caKey)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Certificate{Certificate: [][]byte{leaf.Raw, b.caCert.Raw}, PrivateKey: b.key, Leaf: leaf}
+	b.certs[host] = c
+	return c, nil
+}
+
+// forwardAllowed tells whether host, without route, is in ForwardAllow.
+func (p *Proxy) forwardAllowed(host string) bool {
+	for _, domain := range p.ForwardAllow {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// forward serves a request to a hostname without route, in proxy form.
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request) {
+	if !p.Forward || r.URL.Scheme != "http" {
+		p.metrics.forwarded.Inc(forwardDenied)
+		http.Error(w, fmt.Sprintf("no route for %s", r.Host), http.StatusMisdirectedRequest)
+		return
+	}
+	if !p.forwardAllowed(hostname(r.URL.Host)) {
+		p.metrics.forwarded.Inc(forwardDenied)
+		http.Error(w, fmt.Sprintf("forwarding to %s is not allowed", r.URL.Host), http.StatusForbidden)
+		return
+	}
+	p.metrics.forwarded.Inc(forwardHTTP)
+	rp := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.Host = r.URL.Host
+		},
+		Transport: p.transport,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			p.metrics.forwarded.Inc(forwardError)
+			glog.V(2).Infof("forwarding %s %s: %v", r.Method, r.URL, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	rp.ServeHTTP(w, r)
+}
+
+// connect bumps the CONNECT tunnels to the routes with bump, and relays
+// those to the other routes and to ForwardAllow to port 443 of their host.
+func (p *Proxy) connect(w http.ResponseWriter, r *http.Request) {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, tunnelPort
+	}
+	host = hostname(host)
+	route := p.route(host)
+	bump := route != nil && route.Bump && p.Bumper != nil
+	if !p.Forward || (!bump && (port != tunnelPort || (route == nil && !p.forwardAllowed(host)))) {
+		p.metrics.forwarded.Inc(forwardDenied)
+		http.Error(w, fmt.Sprintf("CONNECT to %s is not allowed", r.Host), http.StatusForbidden)
+		return
+	}
+
+	var upstream net.Conn
+	if !bump {
+		if upstream, err = net.DialTimeout("tcp", net.JoinHostPort(host, port), 30*time.Second); err != nil {
+			p.metrics.forwarded.Inc(forwardError)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT is not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		glog.Warningf("CONNECT to %s: %v", r.Host, err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	client := &bufferedConn{Conn: conn, reader: buffered.Reader}
+
+	if !bump {
+		p.metrics.forwarded.Inc(forwardTunnel)
+		done := make(chan struct{}, 2)
+		go func() {
+			io.Copy(upstream, client)
+			done <- struct{}{}
+		}()
+		go func() {
+			io.Copy(client, upstream)
+			done <- struct{}{}
+		}()
+		// either side closing ends the tunnel
+		<-done
+		return
+	}
+
+	p.metrics.forwarded.Inc(forwardBump)
+	tlsConn := tls.Server(client, &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.Bumper.certificate(host)
+		},
+	})
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// the tunnel only serves the host it was opened to
+			if hostname(req.Host) != host {
+				http.Error(w, fmt.Sprintf("tunnel to %s cannot serve %s", host, req.Host), http.StatusMisdirectedRequest)
+				return
+			}
+			p.ServeHTTP(w, req)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       90 * time.Second,
+	}
+	server.Serve(newConnListener(tlsConn))
+}
+
+// bufferedConn reads what the server buffered before the hijack first.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// connListener accepts a single connection, and returns once it is closed.
+type connListener struct {
+	conn     net.Conn
+	accepted bool
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return &closeNotifyConn{Conn: l.conn, close: l.closeOnce}, nil
+	}
+	<-l.closed
+	return nil, io.EOF
+}
+
+func (l *connListener) closeOnce() {
+	l.once.Do(func() { close(l.closed) })
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce()
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+type closeNotifyConn struct {
+	net.Conn
+	close func()
+}
+
+func (c *closeNotifyConn) Close() error {
+	defer c.close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fast-ml/nezha/pkg/metrics"
+	"k8s.io/client-go/util/cert"
+)
+
+// newForwardProxy serves a proxy in forward mode whose route bumps
+// *.example.com, fetched from an origin over HTTP, and returns a client of
+// it trusting its CA.
+func newForwardProxy(t *testing.T) (*Proxy, *origin, *http.Client, func()) {
+	o := &origin{requests: map[string]int{}}
+	originServer := httptest.NewServer(o)
+	dir, err := ioutil.TempDir("", "nezha-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := []Route{{
+		Name:      "data",
+		Hostnames: []string{"*.example.com"},
+		Origin:    originServer.URL,
+		Bump:      true,
+	}}
+	if err := ValidateRoutes(routes); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(cache, routes, metrics.NewRegistry())
+	p.Forward = true
+
+	caKey, err := cert.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := cert.NewSelfSignedCACert(cert.Config{CommonName: "nezha-proxy-ca"}, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Bumper, err = NewBumper(cert.EncodeCertPEM(caCert), cert.EncodePrivateKeyPEM(caKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	proxyServer := httptest.NewServer(p)
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	transport := &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}
+	return p, o, &http.Client{Transport: transport}, func() {
+		transport.CloseIdleConnections()
+		proxyServer.Close()
+		originServer.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestForward(t *testing.T) {
+	p, o, client, cleanup := newForwardProxy(t)
+	defer cleanup()
+	unrouted := httptest.NewServer(o)
+	defer unrouted.Close()
+	p.ForwardAllow = []string{"127.0.0.1"}
+
+	tests := []struct {
+		name       string
+		url        string
+		wantCode   int
+		wantResult string
+	}{
+		{name: "bump miss", url: "https://data.example.com/train/a", wantCode: http.StatusOK, wantResult: resultMiss},
+		{name: "bump hit", url: "https://data.example.com/train/a", wantCode: http.StatusOK, wantResult: resultHit},
+		{name: "route over http", url: "http://other.example.com/train/b", wantCode: http.StatusOK, wantResult: resultMiss},
+		{name: "forwarded", url: unrouted.URL + "/train/c", wantCode: http.StatusOK},
+	}
+	for _, test := range tests {
+		resp, err := client.Get(test.url)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.wantCode {
+			t.Errorf("%s: status %d, want %d", test.name, resp.StatusCode, test.wantCode)
+		}
+		if got := resp.Header.Get(CacheHeader); got != test.wantResult {
+			t.Errorf("%s: %q, want %q", test.name, got, test.wantResult)
+		}
+		if want := "object" + resp.Request.URL.Path; string(body) != want {
+			t.Errorf("%s: body %q, want %q", test.name, body, want)
+		}
+	}
+	if got := o.count("/train/a"); got != 1 {
+		t.Errorf("%d origin requests of the bumped object, want 1", got)
+	}
+
+	text := scrape(p)
+	for _, want := range []string{
+		`nezha_proxy_forwarded_total{mode="bump"} 1`,
+		`nezha_proxy_forwarded_total{mode="http"} 1`,
+	} {
+		if !strings.Contains(text, want+"\n") {
+			t.Errorf("metrics miss %s", want)
+		}
+	}
+}
+
+func TestForwardDenied(t *testing.T) {
+	p, _, _, cleanup := newForwardProxy(t)
+	defer cleanup()
+	p.Bumper = nil
+	p.ForwardAllow = []string{"allowed.test"}
+
+	tests := []struct {
+		name     string
+		forward  bool
+		method   string
+		target   string
+		wantCode int
+	}{
+		{name: "connect to another port", forward: true, method: "CONNECT", target: "data.example.com:8443", wantCode: http.StatusForbidden},
+		{name: "connect without forward", method: "CONNECT", target: "data.example.com:443", wantCode: http.StatusForbidden},
+		{name: "connect not allowed", forward: true, method: "CONNECT", target: "unrouted.test:443", wantCode: http.StatusForbidden},
+		{name: "connect to a lookalike of an allowed domain", forward: true, method: "CONNECT", target: "notallowed.test:443", wantCode: http.StatusForbidden},
+		{name: "https in proxy form", forward: true, method: "GET", target: "https://unrouted.test/a", wantCode: http.StatusMisdirectedRequest},
+		{name: "http without forward", method: "GET", target: "http://unrouted.test/a", wantCode: http.StatusMisdirectedRequest},
+		{name: "http not allowed", forward: true, method: "GET", target: "http://unrouted.test/a", wantCode: http.StatusForbidden},
+		{name: "http to a lookalike of an allowed domain", forward: true, method: "GET", target: "http://evil-allowed.test/a", wantCode: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		p.Forward = test.forward
+		req := httptest.NewRequest(test.method, test.target, nil)
+		if test.method == "CONNECT" {
+			req.Host = test.target
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		if w.Code != test.wantCode {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, test.wantCode)
+		}
+	}
+	if text := scrape(p); !strings.Contains(text, `nezha_proxy_forwarded_total{mode="denied"} 8`+"\n") {
+		t.Errorf("metrics miss 8 denied requests")
+	}
+}
+
+func TestForwardAllowed(t *testing.T) {
+	p := &Proxy{ForwardAllow: []string{"pypi.org", ".Amazonaws.com"}}
+	for host, want := range map[string]bool{
+		"pypi.org":                   true,
+		"files.pypi.org":             true,
+		"s3.us-west-2.amazonaws.com": true,
+		"amazonaws.com":              true,
+		"notpypi.org":                false,
+		"pypi.org.evil.test":         false,
+		"github.com":                 false,
+	} {
+		if got := p.forwardAllowed(host); got != want {
+			t.Errorf("%s: allowed %v, want %v", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/fast-ml/nezha/pkg/controller"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// cachedLabelValue is the value of the dataset labels published by the
+// proxy. Dataset labels with another value, e.g. set by hand, are left
+// alone.
+const cachedLabelValue = "cached"
+
+// NodeLabeler publishes the datasets with objects in the cache as
+// controller.DatasetNodeLabel labels of the node of the proxy, which the
+// webhook prefers for the workloads reading them.
+type NodeLabeler struct {
+	client kubernetes.Interface
+	node   string
+	cache  *Cache
+}
+
+// NewNodeLabeler returns a labeler of node for the datasets of cache.
+func NewNodeLabeler(client kubernetes.Interface, node string, cache *Cache) *NodeLabeler {
+	return &NodeLabeler{client: client, node: node, cache: cache}
+}
+
+// Run syncs every period until stopCh is closed.
+func (l *NodeLabeler) Run(period time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := l.Sync(); err != nil {
+			glog.Warningf("failed to label node %s: %v", l.node, err)
+		}
+	}, period, stopCh)
+}
+
+// Sync labels the node with the datasets in the cache and removes the
+// labels it published for the datasets evicted since.
+func (l *NodeLabeler) Sync() error {
+	node, err := l.client.CoreV1().Nodes().Get(l.node, metaV1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	cached := map[string]bool{}
+	for _, obj := range l.cache.Objects() {
+		if len(obj.Dataset) == 0 {
+			continue
+		}
+		label, err := controller.DatasetNodeLabel(obj.Dataset)
+		if err != nil {
+			glog.V(2).Infof("not labelling node %s: %v", l.node, err)
+			continue
+		}
+		cached[label] = true
+	}
+	labels := map[string]interface{}{}
+	for key, value := range node.Labels {
+		if strings.HasPrefix(key, controller.DatasetNodeLabelPrefix) && value == cachedLabelValue && !cached[key] {
+			labels[key] = nil
+		}
+	}
+	for label := range cached {
+		if _, ok := node.Labels[label]; !ok {
+			labels[label] = cachedLabelValue
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"labels": labels}})
+	if err != nil {
+		return err
+	}
+	if _, err := l.client.CoreV1().Nodes().Patch(l.node, types.MergePatchType, patch); err != nil {
+		return err
+	}
+	glog.Infof("updated dataset labels of node %s: %v", l.node, labels)
+	return nil
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestNodeLabeler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nezha-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := NewCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, dataset := range map[string]string{"a": "cifar", "b": "cifar 10", "c": ""} {
+		f, err := cache.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if err := cache.Store(f.Name(), Object{Key: key, Route: "data", Dataset: dataset}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	node := &coreV1.Node{}
+	node.Name = "node-1"
+	node.Labels = map[string]string{
+		"dataset.nezha.fast-ml.io/imagenet": cachedLabelValue,
+		"dataset.nezha.fast-ml.io/mnist":    "true",
+	}
+	var patches []map[string]map[string]map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path != "/api/v1/nodes/node-1" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			return
+		}
+		if r.Method == "PATCH" {
+			var patch map[string]map[string]map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				t.Fatal(err)
+			}
+			patches = append(patches, patch)
+			for key, value := range patch["metadata"]["labels"] {
+				if value == nil {
+					delete(node.Labels, key)
+				} else {
+					node.Labels[key] = value.(string)
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(node)
+	}))
+	defer srv.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewNodeLabeler(client, "node-1", cache)
+	for i := 0; i < 2; i++ {
+		if err := l.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{
+		"dataset.nezha.fast-ml.io/cifar": cachedLabelValue,
+		"dataset.nezha.fast-ml.io/mnist": "true",
+	}
+	if !reflect.DeepEqual(node.Labels, want) {
+		t.Errorf("labels %v, want %v", node.Labels, want)
+	}
+	if len(patches) != 1 {
+		t.Errorf("%d patches, want 1", len(patches))
+	}
+}
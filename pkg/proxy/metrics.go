@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"sync/atomic"
+
+	"github.com/fast-ml/nezha/pkg/metrics"
+)
+
+// Results of a request to the proxy.
+const (
+	// resultHit is served from a fresh object.
+	resultHit = "hit"
+	// resultMiss is fetched from the origin and stored.
+	resultMiss = "miss"
+	// resultRevalidated is served from a stale object the origin did not
+	// modify.
+	resultRevalidated = "revalidated"
+	// resultCoalesced is served from an object fetched for a concurrent
+	// request.
+	resultCoalesced = "coalesced"
+	// resultStale is served from a stale object because the origin failed.
+	resultStale = "stale"
+	// resultBypass is passed to the origin without caching.
+	resultBypass = "bypass"
+	resultError  = "error"
+)
+
+// Sources of the bytes served.
+const (
+	sourceCache  = "cache"
+	sourceOrigin = "origin"
+)
+
+// source tells where the response of a result is read from.
+func source(result string) string {
+	switch result {
+	case resultMiss, resultBypass, resultError:
+		return sourceOrigin
+	}
+	return sourceCache
+}
+
+// HitRatio returns the share of the cacheable requests, counted by result,
+// served from the cache, false if there were none.
+func HitRatio(requests map[string]int64) (float64, bool) {
+	var hits, total int64
+	for result, n := range requests {
+		switch result {
+		case resultBypass:
+			continue
+		case resultHit, resultRevalidated, resultCoalesced, resultStale:
+			hits += n
+		}
+		total += n
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return float64(hits) / float64(total), true
+}
+
+type proxyMetrics struct {
+	requests         *metrics.CounterVec
+	bytes            *metrics.CounterVec
+	upstreamDuration *metrics.HistogramVec
+	upstreamErrors   *metrics.CounterVec
+	evictions        *metrics.CounterVec
+	cachedBytes      *metrics.GaugeVec
+	cachedObjects    *metrics.GaugeVec
+	clientRequests   *metrics.CounterVec
+	forwarded        *metrics.CounterVec
+}
+
+func newProxyMetrics(r *metrics.Registry, cache *Cache, coalescing *int64) *proxyMetrics {
+	m := &proxyMetrics{
+		requests: r.NewCounterVec("nezha_proxy_requests_total",
+			"Requests by route, dataset and result.", "route", "dataset", "result"),
+		bytes: r.NewCounterVec("nezha_proxy_response_bytes_total",
+			"Bytes served by route, dataset and source, cache or origin.", "route", "dataset", "source"),
+		upstreamDuration: r.NewHistogramVec("nezha_proxy_upstream_duration_seconds",
+			"Time to the response headers of the origin.", metrics.DefBuckets, "route"),
+		upstreamErrors: r.NewCounterVec("nezha_proxy_upstream_errors_total",
+			"Origin requests that failed or returned a 5xx status.", "route"),
+		evictions: r.NewCounterVec("nezha_proxy_evictions_total",
+			"Objects evicted to make room for others.", "route", "dataset"),
+		cachedBytes: r.NewGaugeVec("nezha_proxy_cache_bytes",
+			"Size of the cached objects.", "route", "dataset"),
+		cachedObjects: r.NewGaugeVec("nezha_proxy_cache_objects",
+			"Number of cached objects.", "route", "dataset"),
+		clientRequests: r.NewCounterVec("nezha_proxy_client_requests_total",
+			"Requests by client address and result.", "client", "result"),
+		forwarded: r.NewCounterVec("nezha_proxy_forwarded_total",
+			"Requests and tunnels served as a forward proxy, by mode.", "mode"),
+	}
+	r.NewGaugeFunc("nezha_proxy_cache_capacity_bytes",
+		"Capacity of the cache.", func() float64 {
+			return float64(cache.Capacity())
+		})
+	r.NewGaugeFunc("nezha_proxy_coalesced_requests",
+		"Requests waiting for the fill of an object by another request.", func() float64 {
+			return float64(atomic.LoadInt64(coalescing))
+		})
+	cache.watch(func(obj Object) {
+		m.cachedBytes.Add(float64(obj.Size), obj.Route, obj.Dataset)
+		m.cachedObjects.Add(1, obj.Route, obj.Dataset)
+	}, func(obj Object, evicted bool) {
+		m.cachedBytes.Add(-float64(obj.Size), obj.Route, obj.Dataset)
+		m.cachedObjects.Add(-1, obj.Route, obj.Dataset)
+		if evicted {
+			m.evictions.Inc(obj.Route, obj.Dataset)
+		}
+	})
+	return m
+}
@@ -0,0 +1,523 @@
+// Package proxy implements the Nezha caching proxy. It serves the storage
+// hostnames aliased to it from a disk cache, keyed by hostname and request
+// URI, and fetches the missing objects from their origin once however many
+// pods ask for them.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/fast-ml/nezha/pkg/metrics"
+)
+
+// CacheHeader tells clients how a response was served, e.g. hit or miss.
+const CacheHeader = "X-Nezha-Cache"
+
+// otherClients counts the requests of the clients beyond MaxClients.
+const otherClients = "other"
+
+// Proxy serves GET and HEAD requests without query from the cache, and
+// passes the others to the origin.
+type Proxy struct {
+	// Forward serves as an explicit HTTP proxy too: requests in proxy form
+	// to hostnames without route are forwarded, and CONNECT tunnels are
+	// relayed, or bumped with Bumper for the routes with bump.
+	Forward bool
+	Bumper  *Bumper
+	// ForwardAllow are the domains, with their subdomains, whose hostnames
+	// without route are forwarded to and tunnelled to. The others are
+	// denied.
+	ForwardAllow []string
+	// MaxClients is the number of client addresses whose requests are
+	// counted apart in nezha_proxy_client_requests_total, those of the
+	// others are counted as client "other". 0 disables the metric.
+	MaxClients int
+
+	cache  *Cache
+	routes map[string]*Route
+	// wildcards are the routes of *.domain hostnames, by .domain.
+	wildcards map[string]*Route
+	transport http.RoundTripper
+	registry  *metrics.Registry
+	metrics   *proxyMetrics
+
+	lock    sync.Mutex
+	fills   map[string]*fill
+	stats   map[string]*RouteStats
+	clients map[string]bool
+	// coalescing is the number of requests waiting for a fill.
+	coalescing int64
+}
+
+// fill is the fetch of an object shared by concurrent requests.
+type fill struct {
+	done   chan struct{}
+	stored bool
+}
+
+// New returns a proxy serving routes from cache and registering its
+// metrics in registry.
+func New(cache *Cache, routes []Route, registry *metrics.Registry) *Proxy {
+	p := &Proxy{
+		cache:     cache,
+		routes:    map[string]*Route{},
+		wildcards: map[string]*Route{},
+		registry:  registry,
+		transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConnsPerHost:   32,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+			// objects are stored as the origin serves them
+			DisableCompression: true,
+		},
+		fills:   map[string]*fill{},
+		stats:   map[string]*RouteStats{},
+		clients: map[string]bool{},
+	}
+	for i := range routes {
+		r := &routes[i]
+		for _, h := range r.Hostnames {
+			h = strings.ToLower(h)
+			if strings.HasPrefix(h, "*.") {
+				p.wildcards[h[1:]] = r
+			} else {
+				p.routes[h] = r
+			}
+		}
+	}
+	p.metrics = newProxyMetrics(registry, cache, &p.coalescing)
+	return p
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+	host := hostname(r.Host)
+	route := p.route(host)
+	if route == nil {
+		if r.URL.IsAbs() {
+			p.forward(w, r)
+			return
+		}
+		http.Error(w, fmt.Sprintf("no route for %s", host), http.StatusMisdirectedRequest)
+		return
+	}
+	key := host + r.URL.RequestURI()
+	dataset := route.dataset(key)
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || len(r.URL.RawQuery) > 0 {
+		p.pass(w, r, route, dataset)
+		return
+	}
+
+	obj, cached := p.cache.Lookup(key)
+	if cached && obj.fresh(route.ttl()) && p.serveObject(w, r, route, key, dataset, resultHit) {
+		return
+	}
+	if !cached && r.Method == http.MethodHead {
+		p.pass(w, r, route, dataset)
+		return
+	}
+	f, leader := p.join(key)
+	if !leader {
+		atomic.AddInt64(&p.coalescing, 1)
+		<-f.done
+		atomic.AddInt64(&p.coalescing, -1)
+		if !f.stored || !p.serveObject(w, r, route, key, dataset, resultCoalesced) {
+			p.pass(w, r, route, dataset)
+		}
+		return
+	}
+	var stale *Object
+	if cached {
+		stale = &obj
+	}
+	stored := p.fill(w, r, route, key, dataset, stale)
+	p.lock.Lock()
+	delete(p.fills, key)
+	p.lock.Unlock()
+	f.stored = stored
+	close(f.done)
+}
+
+// route returns the route of host, the one with the longest wildcard
+// domain if no hostname is equal, nil if none.
+func (p *Proxy) route(host string) *Route {
+	if r, ok := p.routes[host]; ok {
+		return r
+	}
+	var route *Route
+	length := 0
+	for domain, r := range p.wildcards {
+		if strings.HasSuffix(host, domain) && len(domain) > length {
+			route, length = r, len(domain)
+		}
+	}
+	return route
+}
+
+// join returns the fill of key and whether the caller is the one to fetch
+// it.
+func (p *Proxy) join(key string) (*fill, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if f, ok := p.fills[key]; ok {
+		return f, false
+	}
+	f := &fill{done: make(chan struct{})}
+	p.fills[key] = f
+	return f, true
+}
+
+// fill fetches the object of key, or revalidates the stale one, serves it
+// and tells whether it is in the cache. The fetch goes on when the client
+// goes away, for the requests waiting for it.
+func (p *Proxy) fill(w http.ResponseWriter, r *http.Request, route *Route, key, dataset string, stale *Object) bool {
+	req, err := p.upstreamRequest(context.Background(), r, route)
+	if err == nil {
+		req.Method = http.MethodGet
+		for _, h := range []string{"Accept-Encoding", "Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+			req.Header.Del(h)
+		}
+		if stale != nil {
+			if etag := stale.Header.Get("Etag"); len(etag) > 0 {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if modified := stale.Header.Get("Last-Modified"); len(modified) > 0 {
+				req.Header.Set("If-Modified-Since", modified)
+			}
+		}
+	}
+	var resp *http.Response
+	if err == nil {
+		resp, err = p.upstream(route).RoundTrip(req)
+	}
+	if err != nil {
+		if stale != nil && p.serveObject(w, r, route, key, dataset, resultStale) {
+			glog.Warningf("serving stale %s: %v", key, err)
+			return true
+		}
+		p.record(r, route, dataset, resultError, 0)
+		http.Error(w, fmt.Sprintf("fetching %s: %v", key, err), http.StatusBadGateway)
+		return false
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && stale != nil:
+		p.cache.Revalidate(key, resp.Header)
+		if p.serveObject(w, r, route, key, dataset, resultRevalidated) {
+			return true
+		}
+		// evicted meanwhile
+		p.pass(w, r, route, dataset)
+		return false
+	case resp.StatusCode == http.StatusOK && cacheable(resp.Header, len(r.Header.Get("Authorization")) > 0):
+		return p.store(w, r, route, key, dataset, resp)
+	case resp.StatusCode >= 500 && stale != nil:
+		if p.serveObject(w, r, route, key, dataset, resultStale) {
+			glog.Warningf("serving stale %s: origin returned %s", key, resp.Status)
+			return true
+		}
+	}
+	copyHeader(w.Header(), resp.Header)
+	w.Header().Set(CacheHeader, resultBypass)
+	w.WriteHeader(resp.StatusCode)
+	n, _ := io.Copy(w, resp.Body)
+	p.record(r, route, dataset, resultBypass, n)
+	return false
+}
+
+// store writes the body of resp to the cache and serves it from there.
+func (p *Proxy) store(w http.ResponseWriter, r *http.Request, route *Route, key, dataset string, resp *http.Response) bool {
+	tmp, err := p.cache.Create()
+	if err != nil {
+		glog.Errorf("failed to create a cache file: %v", err)
+		p.record(r, route, dataset, resultError, 0)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	defer tmp.Close()
+	size, err := io.Copy(tmp, resp.Body)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		p.metrics.upstreamErrors.Inc(route.Name)
+		p.record(r, route, dataset, resultError, 0)
+		http.Error(w, fmt.Sprintf("fetching %s: %v", key, err), http.StatusBadGateway)
+		return false
+	}
+	obj := Object{Key: key, Route: route.Name, Dataset: dataset, Size: size, Header: storedHeader(resp.Header)}
+	stored := true
+	if err := p.cache.Store(tmp.Name(), obj); err != nil {
+		// still served from the unlinked file
+		glog.Warningf("not caching %s: %v", key, err)
+		os.Remove(tmp.Name())
+		stored = false
+	}
+	p.serveFile(w, r, tmp, obj, route, resultMiss)
+	return stored
+}
+
+// serveObject serves the cached object of key, false if it is gone.
+func (p *Proxy) serveObject(w http.ResponseWriter, r *http.Request, route *Route, key, dataset, result string) bool {
+	f, obj, err := p.cache.Open(key)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	obj.Dataset = dataset
+	p.serveFile(w, r, f, obj, route, result)
+	return true
+}
+
+// serveFile serves the content of obj with support for ranges and
+// conditional requests.
+func (p *Proxy) serveFile(w http.ResponseWriter, r *http.Request, content io.ReadSeeker, obj Object, route *Route, result string) {
+	copyHeader(w.Header(), obj.Header)
+	w.Header().Set(CacheHeader, result)
+	modified, _ := http.ParseTime(obj.Header.Get("Last-Modified"))
+	cw := &countingWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, "", modified, content)
+	p.record(r, route, obj.Dataset, result, cw.n)
+}
+
+// pass forwards r to the origin without caching the response.
+func (p *Proxy) pass(w http.ResponseWriter, r *http.Request, route *Route, dataset string) {
+	var director error
+	rp := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			u, host, err := route.upstream(scheme(r), hostname(r.Host), r.URL.RequestURI())
+			if err != nil {
+				director = err
+				return
+			}
+			req.URL, req.Host = u, host
+		},
+		Transport: p.upstream(route),
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if director != nil {
+				err = director
+			}
+			glog.V(2).Infof("passing %s %s: %v", r.Method, r.Host+r.URL.RequestURI(), err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	cw := &countingWriter{ResponseWriter: w}
+	w.Header().Set(CacheHeader, resultBypass)
+	rp.ServeHTTP(cw, r)
+	p.record(r, route, dataset, resultBypass, cw.n)
+}
+
+// upstreamRequest returns the request of r to the origin of route.
+func (p *Proxy) upstreamRequest(ctx context.Context, r *http.Request, route *Route) (*http.Request, error) {
+	u, host, err := route.upstream(scheme(r), hostname(r.Host), r.URL.RequestURI())
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(r.Method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Host = host
+	copyHeader(req.Header, r.Header)
+	return req, nil
+}
+
+// upstream returns the transport to the origin of route, observing the
+// latency and the errors.
+func (p *Proxy) upstream(route *Route) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		resp, err := p.transport.RoundTrip(req)
+		p.metrics.upstreamDuration.Observe(time.Since(start).Seconds(), route.Name)
+		if err != nil || resp.StatusCode >= 500 {
+			p.metrics.upstreamErrors.Inc(route.Name)
+		}
+		return resp, err
+	})
+}
+
+// RouteStats are the requests of a route since the proxy started and the
+// bytes they were served.
+type RouteStats struct {
+	Route       string           `json:"route"`
+	Requests    map[string]int64 `json:"requests"`
+	CacheBytes  int64            `json:"cacheBytes"`
+	OriginBytes int64            `json:"originBytes"`
+	// Objects and Size are what the route has in the cache.
+	Objects int   `json:"objects"`
+	Size    int64 `json:"size"`
+}
+
+// Stats are the statistics of the proxy and its routes.
+type Stats struct {
+	Capacity int64        `json:"capacity"`
+	Size     int64        `json:"size"`
+	Objects  int          `json:"objects"`
+	Pinned   []string     `json:"pinned"`
+	Routes   []RouteStats `json:"routes"`
+}
+
+func (p *Proxy) record(r *http.Request, route *Route, dataset, result string, bytes int64) {
+	p.metrics.requests.Inc(route.Name, dataset, result)
+	p.metrics.bytes.Add(float64(bytes), route.Name, dataset, source(result))
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.MaxClients > 0 {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		if !p.clients[client] && len(p.clients) >= p.MaxClients {
+			client = otherClients
+		} else {
+			p.clients[client] = true
+		}
+		p.metrics.clientRequests.Inc(client, result)
+	}
+	s := p.routeStats(route.Name)
+	s.Requests[result]++
+	if source(result) == sourceCache {
+		s.CacheBytes += bytes
+	} else {
+		s.OriginBytes += bytes
+	}
+}
+
+// routeStats returns the stats of route, p.lock must be held.
+func (p *Proxy) routeStats(route string) *RouteStats {
+	s, ok := p.stats[route]
+	if !ok {
+		s = &RouteStats{Route: route, Requests: map[string]int64{}}
+		p.stats[route] = s
+	}
+	return s
+}
+
+// Stats returns the statistics of the routes, sorted by name.
+func (p *Proxy) Stats() Stats {
+	objects := p.cache.Objects()
+	stats := Stats{Capacity: p.cache.Capacity(), Objects: len(objects), Pinned: p.cache.Pinned()}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	byRoute := map[string]*RouteStats{}
+	for name, s := range p.stats {
+		c := *s
+		c.Requests = map[string]int64{}
+		for result, n := range s.Requests {
+			c.Requests[result] = n
+		}
+		byRoute[name] = &c
+	}
+	for _, obj := range objects {
+		s, ok := byRoute[obj.Route]
+		if !ok {
+			s = &RouteStats{Route: obj.Route, Requests: map[string]int64{}}
+			byRoute[obj.Route] = s
+		}
+		s.Objects++
+		s.Size += obj.Size
+		stats.Size += obj.Size
+	}
+	for _, s := range byRoute {
+		stats.Routes = append(stats.Routes, *s)
+	}
+	sort.Slice(stats.Routes, func(i, j int) bool { return stats.Routes[i].Route < stats.Routes[j].Route })
+	return stats
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// countingWriter counts the bytes of the response body.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+func scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// cacheable tells whether the origin allows to share a response. The
+// response to an authorized request is only shared when the origin
+// explicitly allows it, as in RFC 9111 section 3.5.
+func cacheable(header http.Header, authorized bool) bool {
+	shared := false
+	for _, v := range header["Cache-Control"] {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			switch {
+			case directive == "no-store", directive == "private":
+				return false
+			case directive == "public", directive == "must-revalidate", strings.HasPrefix(directive, "s-maxage="):
+				shared = true
+			}
+		}
+	}
+	return shared || !authorized
+}
+
+// hopHeaders are not forwarded, nor stored.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = append([]string{}, v...)
+	}
+	for _, h := range hopHeaders {
+		dst.Del(h)
+	}
+}
+
+// storedHeader returns the headers of a response kept with the object,
+// without those depending on the request.
+func storedHeader(header http.Header) http.Header {
+	stored := http.Header{}
+	copyHeader(stored, header)
+	for _, h := range []string{"Accept-Ranges", "Content-Length", "Content-Range", "Date", "Set-Cookie"} {
+		stored.Del(h)
+	}
+	return stored
+}
@@ -0,0 +1,370 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fast-ml/nezha/pkg/metrics"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// origin serves the body of each path with an ETag and counts the
+// requests by path.
+type origin struct {
+	lock     sync.Mutex
+	requests map[string]int
+	release  chan struct{}
+}
+
+func (o *origin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.lock.Lock()
+	o.requests[r.URL.RequestURI()]++
+	o.lock.Unlock()
+	if o.release != nil {
+		<-o.release
+	}
+	switch r.URL.Path {
+	case "/private":
+		w.Header().Set("Cache-Control", "private")
+	case "/public":
+		w.Header().Set("Cache-Control", "public, max-age=60")
+	}
+	etag := `"` + r.URL.Path + `"`
+	w.Header().Set("Etag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write([]byte("object" + r.URL.Path))
+}
+
+func (o *origin) count(uri string) int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.requests[uri]
+}
+
+func newTestProxy(t *testing.T, capacity int64, ttl time.Duration) (*Proxy, *origin, func()) {
+	o := &origin{requests: map[string]int{}}
+	server := httptest.NewServer(o)
+	dir, err := ioutil.TempDir("", "nezha-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := []Route{{
+		Name:      "data",
+		Hostnames: []string{"data.example.com"},
+		Origin:    server.URL,
+		TTL:       metav1.Duration{Duration: ttl},
+		Datasets:  []Dataset{{Name: "train", Prefix: "data.example.com/train/"}},
+	}}
+	if err := ValidateRoutes(routes); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewCache(dir, capacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(cache, routes, metrics.NewRegistry()), o, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func get(p *Proxy, uri string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "http://data.example.com"+uri, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	return w
+}
+
+func scrape(p *Proxy) string {
+	w := httptest.NewRecorder()
+	p.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}
+
+func TestProxy(t *testing.T) {
+	tests := []struct {
+		name        string
+		ttl         time.Duration
+		header      []string
+		requests    []string
+		wantResults []string
+		wantOrigin  int
+	}{
+		{
+			name:        "hit",
+			requests:    []string{"/train/a", "/train/a"},
+			wantResults: []string{resultMiss, resultHit},
+			wantOrigin:  1,
+		},
+		{
+			name:        "revalidated",
+			ttl:         time.Nanosecond,
+			requests:    []string{"/train/a", "/train/a"},
+			wantResults: []string{resultMiss, resultRevalidated},
+			wantOrigin:  2,
+		},
+		{
+			name:        "query",
+			requests:    []string{"/?prefix=train", "/?prefix=train"},
+			wantResults: []string{resultBypass, resultBypass},
+			wantOrigin:  2,
+		},
+		{
+			name:        "private",
+			requests:    []string{"/private", "/private"},
+			wantResults: []string{resultBypass, resultBypass},
+			wantOrigin:  2,
+		},
+		{
+			name:        "authorized",
+			header:      []string{"Authorization", "Bearer token"},
+			requests:    []string{"/train/a", "/train/a"},
+			wantResults: []string{resultBypass, resultBypass},
+			wantOrigin:  2,
+		},
+		{
+			name:        "authorized public",
+			header:      []string{"Authorization", "Bearer token"},
+			requests:    []string{"/public", "/public"},
+			wantResults: []string{resultMiss, resultHit},
+			wantOrigin:  1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, o, cleanup := newTestProxy(t, 1<<20, test.ttl)
+			defer cleanup()
+			for i, uri := range test.requests {
+				w := get(p, uri, test.header...)
+				if w.Code != http.StatusOK {
+					t.Fatalf("%s: status %d", uri, w.Code)
+				}
+				if got := w.Header().Get(CacheHeader); got != test.wantResults[i] {
+					t.Errorf("request %d: %s, want %s", i, got, test.wantResults[i])
+				}
+				if want := "object" + strings.Split(uri, "?")[0]; w.Body.String() != want {
+					t.Errorf("request %d: body %q, want %q", i, w.Body.String(), want)
+				}
+			}
+			if got := o.count(test.requests[0]); got != test.wantOrigin {
+				t.Errorf("%d origin requests, want %d", got, test.wantOrigin)
+			}
+		})
+	}
+}
+
+func TestProxyRange(t *testing.T) {
+	p, _, cleanup := newTestProxy(t, 1<<20, 0)
+	defer cleanup()
+	get(p, "/train/a")
+	w := get(p, "/train/a", "Range", "bytes=0-5")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "object" {
+		t.Errorf("range: status %d, body %q", w.Code, w.Body.String())
+	}
+	w = get(p, "/train/a", "If-None-Match", `"/train/a"`)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("conditional: status %d, want 304", w.Code)
+	}
+}
+
+func TestProxyCoalesces(t *testing.T) {
+	p, o, cleanup := newTestProxy(t, 1<<20, 0)
+	defer cleanup()
+	o.release = make(chan struct{})
+
+	results := make(chan string, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			results <- get(p, "/train/a").Header().Get(CacheHeader)
+		}()
+	}
+	for atomic.LoadInt64(&p.coalescing) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(o.release)
+	counts := map[string]int{}
+	for i := 0; i < 3; i++ {
+		counts[<-results]++
+	}
+	if counts[resultMiss] != 1 || counts[resultCoalesced] != 2 {
+		t.Errorf("results %v, want 1 miss and 2 coalesced", counts)
+	}
+	if got := o.count("/train/a"); got != 1 {
+		t.Errorf("%d origin requests, want 1", got)
+	}
+}
+
+func TestProxyEvictsAndReloads(t *testing.T) {
+	// each object is 14 bytes
+	p, _, cleanup := newTestProxy(t, 30, 0)
+	defer cleanup()
+	for _, uri := range []string{"/train/a", "/train/b", "/train/a", "/train/c"} {
+		get(p, uri)
+	}
+	var keys []string
+	for _, obj := range p.cache.Objects() {
+		keys = append(keys, obj.Key)
+	}
+	if want := "data.example.com/train/c data.example.com/train/a"; strings.Join(keys, " ") != want {
+		t.Errorf("cached %v, want %s", keys, want)
+	}
+
+	text := scrape(p)
+	for _, want := range []string{
+		`nezha_proxy_requests_total{route="data",dataset="train",result="hit"} 1`,
+		`nezha_proxy_requests_total{route="data",dataset="train",result="miss"} 3`,
+		`nezha_proxy_response_bytes_total{route="data",dataset="train",source="cache"} 14`,
+		`nezha_proxy_response_bytes_total{route="data",dataset="train",source="origin"} 42`,
+		`nezha_proxy_evictions_total{route="data",dataset="train"} 1`,
+		`nezha_proxy_cache_bytes{route="data",dataset="train"} 28`,
+		`nezha_proxy_cache_objects{route="data",dataset="train"} 2`,
+		`nezha_proxy_upstream_duration_seconds_count{route="data"} 3`,
+	} {
+		if !strings.Contains(text, want+"\n") {
+			t.Errorf("metrics miss %s", want)
+		}
+	}
+
+	stats := p.Stats()
+	if len(stats.Routes) != 1 || stats.Routes[0].Requests[resultHit] != 1 || stats.Routes[0].Objects != 2 || stats.Size != 28 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	reloaded, err := NewCache(p.cache.dir, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objects, size := reloaded.Usage(); objects != 2 || size != 28 {
+		t.Errorf("reloaded %d objects of %d bytes, want 2 of 28", objects, size)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	// each object is 14 bytes
+	p, _, cleanup := newTestProxy(t, 30, 0)
+	defer cleanup()
+	admin := p.AdminHandler()
+	call := func(method, uri string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(method, uri, nil))
+		return w
+	}
+
+	if w := call("POST", "/pin?dataset=train"); w.Code != http.StatusOK {
+		t.Fatalf("pin: %d %s", w.Code, w.Body)
+	}
+	for _, uri := range []string{"/train/a", "/other/b", "/train/c"} {
+		get(p, uri)
+	}
+	var objects []ObjectStatus
+	if err := json.Unmarshal(call("GET", "/objects?dataset=train").Body.Bytes(), &objects); err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || !objects[0].Pinned || !objects[1].Pinned {
+		t.Errorf("pinned objects %+v, want train/a and train/c", objects)
+	}
+	if objects, _ := p.cache.Usage(); objects != 2 {
+		t.Errorf("%d objects, want the other one evicted", objects)
+	}
+
+	tests := []struct {
+		uri        string
+		wantCode   int
+		wantPurged int
+	}{
+		{uri: "/purge", wantCode: http.StatusBadRequest},
+		{uri: "/purge?key=http://data.example.com/train/missing", wantCode: http.StatusOK},
+		{uri: "/purge?prefix=http://data.example.com/train/a", wantCode: http.StatusOK, wantPurged: 1},
+		{uri: "/purge?all=true", wantCode: http.StatusOK, wantPurged: 1},
+	}
+	for _, test := range tests {
+		w := call("POST", test.uri)
+		if w.Code != test.wantCode {
+			t.Errorf("%s: status %d, want %d", test.uri, w.Code, test.wantCode)
+			continue
+		}
+		var result PurgeResult
+		if w.Code == http.StatusOK && (json.Unmarshal(w.Body.Bytes(), &result) != nil || result.Purged != test.wantPurged) {
+			t.Errorf("%s: %s, want %d purged", test.uri, w.Body, test.wantPurged)
+		}
+	}
+
+	if w := call("POST", "/unpin?dataset=train"); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("unpin: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	p, _, cleanup := newTestProxy(t, 1<<20, 0)
+	defer cleanup()
+	p.MaxClients = 1
+	for _, client := range []string{"10.0.0.1:1234", "10.0.0.1:1235", "10.0.0.2:1234"} {
+		req := httptest.NewRequest("GET", "http://data.example.com/train/a", nil)
+		req.RemoteAddr = client
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	text := scrape(p)
+	for _, want := range []string{
+		`nezha_proxy_client_requests_total{client="10.0.0.1",result="miss"} 1`,
+		`nezha_proxy_client_requests_total{client="10.0.0.1",result="hit"} 1`,
+		`nezha_proxy_client_requests_total{client="other",result="hit"} 1`,
+	} {
+		if !strings.Contains(text, want+"\n") {
+			t.Errorf("metrics miss %s", want)
+		}
+	}
+}
+
+func TestProxyParent(t *testing.T) {
+	routes, err := ParentRoutes("data.example.com=10.0.0.1, models.example.com=fd00::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes[0].Parent != "10.0.0.1:80" || routes[1].Parent != "[fd00::1]:80" {
+		t.Errorf("routes %+v", routes)
+	}
+	for _, parents := range []string{"", "data.example.com", "data.example.com=parent"} {
+		if _, err := ParentRoutes(parents); err == nil {
+			t.Errorf("parents %q: no error", parents)
+		}
+	}
+
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + r.URL.Path))
+	}))
+	defer parent.Close()
+	dir, err := ioutil.TempDir("", "nezha-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	routes = []Route{{Name: "data", Hostnames: []string{"data.example.com"}, Parent: strings.TrimPrefix(parent.URL, "http://")}}
+	if err := ValidateRoutes(routes); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(cache, routes, metrics.NewRegistry())
+	for _, want := range []string{resultMiss, resultHit} {
+		w := get(p, "/train/a")
+		if got := w.Header().Get(CacheHeader); got != want || w.Body.String() != "data.example.com/train/a" {
+			t.Errorf("%s with body %q, want %s from the parent", got, w.Body.String(), want)
+		}
+	}
+}
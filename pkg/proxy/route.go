@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultTTL is how long an object is served without revalidation when its
+// route sets no ttl.
+const DefaultTTL = 24 * time.Hour
+
+// Route serves the objects of a set of storage hostnames from the cache.
+type Route struct {
+	Name string `json:"name"`
+	// Hostnames may start with *. to match every subdomain, e.g.
+	// *.s3.us-west-2.amazonaws.com for the buckets of a region.
+	Hostnames []string `json:"hostnames"`
+	// Origin is the URL objects are fetched from, the hostname of the
+	// request over HTTP when empty.
+	Origin string `json:"origin,omitempty"`
+	// Parent is the address, host:port, of a cache the objects are fetched
+	// from over HTTP with the Host of the request, instead of Origin.
+	Parent string `json:"parent,omitempty"`
+	// TTL is how long an object is served before it is revalidated.
+	TTL metav1.Duration `json:"ttl,omitempty"`
+	// Datasets name groups of objects, for metrics and statistics.
+	Datasets []Dataset `json:"datasets,omitempty"`
+	// Bump decrypts the CONNECT tunnels to the hostnames of the route, so
+	// that HTTPS is served from the cache too. The workloads must trust
+	// the CA of the proxy.
+	Bump bool `json:"bump,omitempty"`
+
+	origin *url.URL
+}
+
+// Dataset is the objects whose key, hostname and path, starts with Prefix,
+// e.g. bucket.s3.amazonaws.com/train/.
+type Dataset struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+}
+
+// LoadRoutes reads the routes of a YAML or JSON file.
+func LoadRoutes(file string) ([]Route, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var routes []Route
+	if err := yaml.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if err := ValidateRoutes(routes); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return routes, nil
+}
+
+// ParentRoutes returns the routes of parents, comma separated hostname=IP
+// pairs such as the NEZHA_PARENTS of a sidecar, fetching each hostname from
+// the cache on port 80 of its IP.
+func ParentRoutes(parents string) ([]Route, error) {
+	var routes []Route
+	for _, pair := range strings.Split(parents, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 || net.ParseIP(pair[i+1:]) == nil {
+			return nil, fmt.Errorf("parent %q is not hostname=IP", pair)
+		}
+		host := pair[:i]
+		routes = append(routes, Route{Name: host, Hostnames: []string{host}, Parent: net.JoinHostPort(pair[i+1:], "80")})
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no parents")
+	}
+	if err := ValidateRoutes(routes); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// ValidateRoutes checks that routes have unique names and hostnames and
+// parses their origins.
+func ValidateRoutes(routes []Route) error {
+	names := map[string]bool{}
+	hostnames := map[string]string{}
+	for i := range routes {
+		r := &routes[i]
+		if len(r.Name) == 0 {
+			return fmt.Errorf("route %d has no name", i)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("route %s is defined twice", r.Name)
+		}
+		names[r.Name] = true
+		if len(r.Hostnames) == 0 {
+			return fmt.Errorf("route %s has no hostnames", r.Name)
+		}
+		for _, h := range r.Hostnames {
+			h = strings.ToLower(h)
+			if strings.Contains(strings.TrimPrefix(h, "*."), "*") {
+				return fmt.Errorf("route %s: hostname %s may only start with *.", r.Name, h)
+			}
+			if other, ok := hostnames[h]; ok {
+				return fmt.Errorf("hostname %s is in routes %s and %s", h, other, r.Name)
+			}
+			hostnames[h] = r.Name
+		}
+		if len(r.Origin) > 0 {
+			u, err := url.Parse(r.Origin)
+			if err != nil {
+				return fmt.Errorf("route %s: %v", r.Name, err)
+			}
+			if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+				return fmt.Errorf("route %s: origin %s is not an http or https URL", r.Name, r.Origin)
+			}
+			r.origin = u
+		}
+		if len(r.Parent) > 0 {
+			if len(r.Origin) > 0 {
+				return fmt.Errorf("route %s: origin and parent are exclusive", r.Name)
+			}
+			if _, _, err := net.SplitHostPort(r.Parent); err != nil {
+				return fmt.Errorf("route %s: parent: %v", r.Name, err)
+			}
+		}
+		if r.TTL.Duration < 0 {
+			return fmt.Errorf("route %s: negative ttl", r.Name)
+		}
+		for _, d := range r.Datasets {
+			if len(d.Name) == 0 || len(d.Prefix) == 0 {
+				return fmt.Errorf("route %s: datasets need a name and a prefix", r.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Route) ttl() time.Duration {
+	if r.TTL.Duration == 0 {
+		return DefaultTTL
+	}
+	return r.TTL.Duration
+}
+
+// dataset returns the dataset with the longest prefix of key.
+func (r *Route) dataset(key string) string {
+	name, length := "", 0
+	for _, d := range r.Datasets {
+		if strings.HasPrefix(key, d.Prefix) && len(d.Prefix) > length {
+			name, length = d.Name, len(d.Prefix)
+		}
+	}
+	return name
+}
+
+// upstream returns the URL and Host header requestURI of host is fetched
+// with.
+func (r *Route) upstream(scheme, host, requestURI string) (*url.URL, string, error) {
+	if len(r.Parent) > 0 {
+		u, err := url.Parse("http://" + r.Parent + requestURI)
+		return u, host, err
+	}
+	if r.origin == nil {
+		u, err := url.Parse(scheme + "://" + host + requestURI)
+		return u, host, err
+	}
+	ref, err := url.Parse(requestURI)
+	if err != nil {
+		return nil, "", err
+	}
+	u := *r.origin
+	u.Path = strings.TrimSuffix(u.Path, "/") + ref.Path
+	u.RawPath = ""
+	if len(ref.RawPath) > 0 {
+		u.RawPath = strings.TrimSuffix(r.origin.EscapedPath(), "/") + ref.RawPath
+	}
+	u.RawQuery = ref.RawQuery
+	return &u, u.Host, nil
+}
+
+// hostname strips the port from a Host header and lowercases it.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}